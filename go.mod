@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	github.com/caarlos0/env/v6 v6.6.0
+	github.com/jackc/pgx/v5 v5.3.1
 	github.com/prometheus/client_golang v1.10.0
 	github.com/stretchr/testify v1.8.1
 	go.uber.org/zap v1.24.0
@@ -18,7 +19,6 @@ require (
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/jackc/pgx/v5 v5.3.1 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+// DefaultNeonAccount is the name of the account configured with NEON_API_KEY.
+// Projects created before named accounts were added belong to it.
+const DefaultNeonAccount = ""
+
+// NeonAccountConfig describes a named Neon API account in NEON_ACCOUNTS.
+type NeonAccountConfig struct {
+	APIKey string
+	// Name of the environment variable with the API key. Allows to keep secrets out of the config.
+	APIKeyEnv string
+	// Default is $PROVIDER.
+	Provider string
+	// Overrides the API base URL, default is https://$Provider/api/v2.
+	APIURL string
+	// Projects are created in this organization, if set.
+	OrgID string
+	// Weight of the account when a project is created. Default is 1, 0 means that new projects
+	// are not created, existing projects are still managed.
+	Weight *float64
+	// Projects are created only in these regions, e.g. "aws-us-east-1". Empty means all regions of the provider.
+	Regions []string
+}
+
+// NeonAccount is an API account that owns projects, see models.Project.NeonAccount.
+type NeonAccount struct {
+	Name     string
+	Provider string
+	OrgID    string
+	Weight   float64
+	Regions  []string
+	Client   *neonapi.Client
+}
+
+// Returns true if the account can create projects in the region.
+func (a *NeonAccount) servesRegion(region models.Region) bool {
+	if a.Provider != region.Provider {
+		return false
+	}
+	if len(a.Regions) == 0 {
+		return true
+	}
+	for _, name := range a.Regions {
+		if name == region.DatabaseRegion {
+			return true
+		}
+	}
+	return false
+}
+
+// NeonAccounts has all configured accounts by name.
+type NeonAccounts struct {
+	accounts map[string]*NeonAccount
+}
+
+func NewNeonAccounts(accounts ...*NeonAccount) *NeonAccounts {
+	res := &NeonAccounts{accounts: make(map[string]*NeonAccount)}
+	for _, account := range accounts {
+		res.accounts[account.Name] = account
+	}
+	return res
+}
+
+// Get returns the account by name, the error is returned for unknown accounts.
+func (a *NeonAccounts) Get(name string) (*NeonAccount, error) {
+	account, ok := a.accounts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown neon account %q", name)
+	}
+	return account, nil
+}
+
+// Client returns the client of the account that owns the project.
+func (a *NeonAccounts) Client(name string) (*neonapi.Client, error) {
+	account, err := a.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return account.Client, nil
+}
+
+// All returns all accounts sorted by name.
+func (a *NeonAccounts) All() []*NeonAccount {
+	res := make([]*NeonAccount, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		res = append(res, account)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Providers returns unique providers of all accounts, sorted.
+func (a *NeonAccounts) Providers() []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, account := range a.All() {
+		if !seen[account.Provider] {
+			seen[account.Provider] = true
+			res = append(res, account.Provider)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Pick returns a random account by weight among the accounts that serve the region and are not
+// skipped. Returns nil if there are no such accounts.
+func (a *NeonAccounts) Pick(region models.Region, skip func(account *NeonAccount) bool) *NeonAccount {
+	var candidates rdesc.Wrand[*NeonAccount]
+	for _, account := range a.All() {
+		if account.Weight <= 0 || !account.servesRegion(region) {
+			continue
+		}
+		if skip != nil && skip(account) {
+			continue
+		}
+		candidates = append(candidates, rdesc.WrandItem[*NeonAccount]{Weight: account.Weight, Item: account})
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates.Pick()
+}
+
+// Creates the default account from NEON_API_KEY and named accounts from NEON_ACCOUNTS.
+// The default account is used for new projects only if there are no named accounts.
+func createNeonAccounts(cfg *conf.App, httpClient *httpclient.Client) (*NeonAccounts, error) {
+	retryPolicy := neonapi.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = cfg.NeonAPIMaxAttempts
+	retryPolicy.MinBackoff = cfg.NeonAPIRetryMinBackoff
+	retryPolicy.MaxBackoff = cfg.NeonAPIRetryMaxBackoff
+
+	newClient := func(provider string, apiURL string, apiKey string) *neonapi.Client {
+		var client *neonapi.Client
+		if apiURL != "" {
+			client = neonapi.NewClientWithURL(apiURL, apiKey, httpClient)
+		} else {
+			client = neonapi.NewClient(provider, apiKey, httpClient)
+		}
+		return client.WithRetryPolicy(retryPolicy)
+	}
+
+	var configs map[string]NeonAccountConfig
+	if cfg.NeonAccounts != "" {
+		if err := json.Unmarshal([]byte(cfg.NeonAccounts), &configs); err != nil {
+			return nil, fmt.Errorf("failed to parse neon accounts: %w", err)
+		}
+	}
+
+	var accounts []*NeonAccount
+	if cfg.NeonAPIKey != "" {
+		weight := 1.0
+		if len(configs) > 0 {
+			weight = 0
+		}
+		accounts = append(accounts, &NeonAccount{
+			Name:     DefaultNeonAccount,
+			Provider: cfg.Provider,
+			Weight:   weight,
+			Client:   newClient(cfg.Provider, cfg.NeonAPIURL, cfg.NeonAPIKey),
+		})
+	}
+
+	for name, config := range configs {
+		if name == DefaultNeonAccount {
+			return nil, fmt.Errorf("neon account name can't be empty")
+		}
+		apiKey := config.APIKey
+		if config.APIKeyEnv != "" {
+			apiKey = os.Getenv(config.APIKeyEnv)
+		}
+		if apiKey == "" {
+			return nil, fmt.Errorf("neon account %q has no API key", name)
+		}
+		provider := config.Provider
+		if provider == "" {
+			provider = cfg.Provider
+		}
+		weight := 1.0
+		if config.Weight != nil {
+			weight = *config.Weight
+		}
+		accounts = append(accounts, &NeonAccount{
+			Name:     name,
+			Provider: provider,
+			OrgID:    config.OrgID,
+			Weight:   weight,
+			Regions:  config.Regions,
+			Client:   newClient(provider, config.APIURL, apiKey).WithOrgID(config.OrgID),
+		})
+	}
+
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no neon accounts, set NEON_API_KEY or NEON_ACCOUNTS")
+	}
+	return NewNeonAccounts(accounts...), nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+func Test_createNeonAccounts(t *testing.T) {
+	t.Setenv("TEST_NEON_KEY", "secret")
+	cfg := &conf.App{
+		Provider:     "aws.neon.tech",
+		NeonAPIKey:   "default-key",
+		NeonAccounts: `{"org": {"APIKeyEnv": "TEST_NEON_KEY", "OrgID": "org-1", "Regions": ["aws-us-east-1"]}, "gcp": {"APIKey": "k", "Provider": "gcp.neon.tech", "Weight": 2}}`,
+	}
+	httpClient, err := httpclient.New(httpclient.Options{})
+	require.NoError(t, err)
+	accounts, err := createNeonAccounts(cfg, httpClient)
+	require.NoError(t, err)
+
+	all := accounts.All()
+	require.Len(t, all, 3)
+	assert.Equal(t, DefaultNeonAccount, all[0].Name)
+	// named accounts are used for new projects instead of the default one
+	assert.Equal(t, 0.0, all[0].Weight)
+	assert.Equal(t, "gcp", all[1].Name)
+	assert.Equal(t, 2.0, all[1].Weight)
+	assert.Equal(t, "org-1", all[2].OrgID)
+	assert.Equal(t, []string{"aws.neon.tech", "gcp.neon.tech"}, accounts.Providers())
+
+	_, err = accounts.Client("unknown")
+	assert.Error(t, err)
+
+	east := models.Region{Provider: "aws.neon.tech", DatabaseRegion: "aws-us-east-1"}
+	west := models.Region{Provider: "aws.neon.tech", DatabaseRegion: "aws-us-west-2"}
+	assert.Equal(t, "org", accounts.Pick(east, nil).Name)
+	assert.Nil(t, accounts.Pick(west, nil))
+	assert.Nil(t, accounts.Pick(east, func(account *NeonAccount) bool { return account.Name == "org" }))
+
+	cfg.NeonAccounts = `{"nokey": {}}`
+	_, err = createNeonAccounts(cfg, httpClient)
+	assert.Error(t, err)
+}
@@ -5,6 +5,7 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -15,9 +16,11 @@ import (
 
 	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
 	"github.com/petuhovskiy/neon-lights/internal/conf"
+	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
-	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
 	"github.com/petuhovskiy/neon-lights/internal/repos"
 )
 
@@ -25,10 +28,12 @@ type App struct {
 	Config        *conf.App
 	DB            *gorm.DB
 	Repo          *Repos
-	NeonClient    *neonapi.Client
+	NeonAccounts  *NeonAccounts
 	Register      *bgjobs.Register
 	ProjectLocker *bgjobs.ProjectLocker
 	RegionFilters []repos.Filter
+	// All drivers available to the rules, including the configured relays.
+	Drivers *drivers.Registry
 }
 
 func NewAppFromEnv() (*App, error) {
@@ -36,15 +41,37 @@ func NewAppFromEnv() (*App, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse config from env: %w", err)
 	}
+	return NewApp(cfg)
+}
+
+// NewApp connects to the database and creates all dependencies, e.g. for tests.
+func NewApp(cfg *conf.App) (*App, error) {
+	neonHTTPClient, err := httpclient.New(httpclient.Options{
+		Timeout: &rdesc.Duration{Duration: cfg.NeonAPITimeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create neon api http client: %w", err)
+	}
 
+	neonAccounts, err := createNeonAccounts(cfg, neonHTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create neon accounts: %w", err)
+	}
+
+	// regions of all accounts
 	regionFilters := []repos.Filter{
-		repos.FilterByRegionProvider(cfg.Provider),
+		repos.FilterByRegionProviders(neonAccounts.Providers()),
 	}
 	if cfg.RegionFilters != "" {
 		regionFilters = append(regionFilters, repos.RawFilter(cfg.RegionFilters))
 	}
 	log.Info(context.Background(), "using region filters", zap.Any("filters", regionFilters))
 
+	driverRegistry, err := createDriverRegistry(cfg.Relays)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create drivers: %w", err)
+	}
+
 	db, err := connectDB(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
@@ -55,7 +82,6 @@ func NewAppFromEnv() (*App, error) {
 		return nil, fmt.Errorf("failed to create repos: %w", err)
 	}
 
-	neonClient := neonapi.NewClient(cfg.Provider, cfg.NeonAPIKey)
 	register := bgjobs.NewRegister()
 	projectLocker := bgjobs.NewProjectLocker()
 
@@ -63,13 +89,36 @@ func NewAppFromEnv() (*App, error) {
 		Config:        cfg,
 		DB:            db,
 		Repo:          repo,
-		NeonClient:    neonClient,
+		NeonAccounts:  neonAccounts,
 		Register:      register,
 		ProjectLocker: projectLocker,
 		RegionFilters: regionFilters,
+		Drivers:       driverRegistry,
 	}, nil
 }
 
+func createDriverRegistry(relaysJSON string) (*drivers.Registry, error) {
+	registry, err := drivers.NewDefaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	if relaysJSON == "" {
+		return registry, nil
+	}
+
+	var relays map[drivers.Name]drivers.RelayConfig
+	if err := json.Unmarshal([]byte(relaysJSON), &relays); err != nil {
+		return nil, fmt.Errorf("failed to parse relays: %w", err)
+	}
+	for name, relay := range relays {
+		if err := registry.RegisterRelay(name, relay); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
 func (a *App) StartPrometheus() {
 	go func() {
 		mux := http.NewServeMux()
@@ -95,6 +144,11 @@ type Repos struct {
 	Sequence           *repos.SequenceRepo
 	GlobalRule         *repos.GlobalRuleRepo
 	Query              *repos.QueryRepo
+	Certificate        *repos.CertificateRepo
+	Branch             *repos.BranchRepo
+	Replica            *repos.ReplicaRepo
+	Consumption        *repos.ConsumptionRepo
+	Mode               *repos.ModeRepo
 	SeqExitnodeProject *repos.Sequence
 }
 
@@ -105,6 +159,11 @@ func createRepos(db *gorm.DB, cfg *conf.App) (*Repos, error) {
 		&models.Sequence{},
 		&models.GlobalRule{},
 		&models.Query{},
+		&models.Certificate{},
+		&models.Branch{},
+		&models.ReadReplica{},
+		&models.ConsumptionSnapshot{},
+		&models.ProjectMode{},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate: %w", err)
@@ -118,7 +177,8 @@ func createRepos(db *gorm.DB, cfg *conf.App) (*Repos, error) {
 	projectRepo := repos.NewProjectRepo(db)
 	sequenceRepo := repos.NewSequenceRepo(db)
 	globalRuleRepo := repos.NewGlobalRuleRepo(db)
-	queryRepo := repos.NewQueryRepo(db)
+	certificateRepo := repos.NewCertificateRepo(db)
+	queryRepo := repos.NewQueryRepo(db, certificateRepo)
 
 	exitnodeSeq, err := sequenceRepo.Get(fmt.Sprintf("exitnode-%s-project", cfg.Exitnode))
 	if err != nil {
@@ -131,6 +191,11 @@ func createRepos(db *gorm.DB, cfg *conf.App) (*Repos, error) {
 		Sequence:           sequenceRepo,
 		GlobalRule:         globalRuleRepo,
 		Query:              queryRepo,
+		Certificate:        certificateRepo,
+		Branch:             repos.NewBranchRepo(db),
+		Replica:            repos.NewReplicaRepo(db),
+		Consumption:        repos.NewConsumptionRepo(db),
+		Mode:               repos.NewModeRepo(db),
 		SeqExitnodeProject: exitnodeSeq,
 	}, nil
 }
@@ -17,12 +17,21 @@ func NewRegister() *Register {
 	return &Register{}
 }
 
-// Go a new background task.
-func (r *Register) Go(f func()) {
+// Go a new background task. The task is also added to the groups of the context, if there are any.
+func (r *Register) Go(ctx context.Context, f func()) {
+	group, _ := ctx.Value(groupKey{}).(*Group)
 	r.all.Add(1)
+	for g := group; g != nil; g = g.parent {
+		g.wg.Add(1)
+	}
 
 	go func() {
 		defer r.all.Done()
+		defer func() {
+			for g := group; g != nil; g = g.parent {
+				g.wg.Done()
+			}
+		}()
 		f()
 	}()
 }
@@ -31,3 +40,28 @@ func (r *Register) WaitAll(ctx context.Context) {
 	log.Info(ctx, "waiting for all background jobs to finish")
 	r.all.Wait()
 }
+
+type groupKey struct{}
+
+// Group tracks background jobs started with a single context, e.g. by a single rule execution.
+// Jobs of nested groups are tracked by the parent groups too.
+type Group struct {
+	wg     sync.WaitGroup
+	parent *Group
+}
+
+// WithGroup returns a context, which adds all background jobs started with it to the returned group.
+func WithGroup(ctx context.Context) (context.Context, *Group) {
+	parent, _ := ctx.Value(groupKey{}).(*Group)
+	group := &Group{parent: parent}
+	return context.WithValue(ctx, groupKey{}, group), group
+}
+
+// AfterAll calls f in the background, once all jobs of the group are finished.
+// Jobs can start new jobs with the same context, but jobs can't be added after AfterAll otherwise.
+func (g *Group) AfterAll(f func()) {
+	go func() {
+		g.wg.Wait()
+		f()
+	}()
+}
@@ -0,0 +1,44 @@
+package bgjobs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGroup_AfterAll(t *testing.T) {
+	register := NewRegister()
+	release := make(chan struct{})
+
+	ctx, outer := WithGroup(context.Background())
+	innerCtx, inner := WithGroup(ctx)
+
+	// nested job is started by a job of the inner group
+	register.Go(innerCtx, func() {
+		register.Go(innerCtx, func() { <-release })
+	})
+
+	outerDone := make(chan struct{})
+	innerDone := make(chan struct{})
+	outer.AfterAll(func() { close(outerDone) })
+	inner.AfterAll(func() { close(innerDone) })
+
+	select {
+	case <-outerDone:
+		t.Fatal("outer group finished before its jobs")
+	case <-innerDone:
+		t.Fatal("inner group finished before its jobs")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for _, done := range []chan struct{}{outerDone, innerDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("group didn't finish after its jobs")
+		}
+	}
+
+	register.WaitAll(context.Background())
+}
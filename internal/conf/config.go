@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"time"
+
 	"github.com/caarlos0/env/v6"
 )
 
@@ -16,8 +18,27 @@ type App struct {
 	// Provider is a name/domain of the current provider.
 	Provider string `env:"PROVIDER" envDefault:"staging.neon.tech"`
 
-	// NeonAPIKey is an API key for the neon.
-	NeonAPIKey string `env:"NEON_API_KEY,required"`
+	// NeonAPIKey is an API key for the neon, used by the default account. Optional if NeonAccounts is set.
+	NeonAPIKey string `env:"NEON_API_KEY"`
+
+	// NeonAccounts is a JSON object with named API accounts, name => app.NeonAccountConfig. Example:
+	// {"paid": {"APIKeyEnv": "NEON_PAID_KEY", "Weight": 2}, "org": {"APIKeyEnv": "NEON_ORG_KEY", "OrgID": "org-abc-123", "Regions": ["aws-us-east-2"]}}
+	// Projects are created with a random account by weight, and are managed with the same account later.
+	NeonAccounts string `env:"NEON_ACCOUNTS"`
+
+	// NeonAPIURL overrides the API base URL, e.g. http://localhost:8080/api/v2 for a local fake.
+	// Default is https://$PROVIDER/api/v2.
+	NeonAPIURL string `env:"NEON_API_URL"`
+
+	// NeonAPITimeout is an overall timeout for a single request to the neon API.
+	NeonAPITimeout time.Duration `env:"NEON_API_TIMEOUT" envDefault:"60s"`
+
+	// NeonAPIMaxAttempts is a number of attempts for a single neon API call, 1 disables retries.
+	NeonAPIMaxAttempts int `env:"NEON_API_MAX_ATTEMPTS" envDefault:"3"`
+
+	// Backoff between retries of the neon API calls, doubled for every retry up to the max.
+	NeonAPIRetryMinBackoff time.Duration `env:"NEON_API_RETRY_MIN_BACKOFF" envDefault:"1s"`
+	NeonAPIRetryMaxBackoff time.Duration `env:"NEON_API_RETRY_MAX_BACKOFF" envDefault:"30s"`
 
 	// DebugDB enables debug mode for the database.
 	DebugDB bool `env:"DB_DEBUG" envDefault:"false"`
@@ -26,6 +47,11 @@ type App struct {
 	// regions.provider = $PROVIDER
 	// That filter is always enabled.
 	RegionFilters string `env:"REGION_FILTERS"`
+
+	// Relays is a JSON object with relay drivers, name => drivers.RelayConfig. Example:
+	// {"cf-workers": {"URL": "https://relay.example.workers.dev/query", "AuthTokenEnv": "CF_RELAY_TOKEN"}}
+	// Relays with the same name as the built-in ones replace them.
+	Relays string `env:"RELAYS"`
 }
 
 func ParseEnv() (*App, error) {
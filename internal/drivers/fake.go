@@ -0,0 +1,99 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+const defaultFakeError = "fake error"
+
+// FakeOptions configure the fake driver. Can be passed in rule args.
+type FakeOptions struct {
+	// Latency of every query. No latency if empty.
+	Latency rdesc.Wrand[rdesc.Duration]
+	// Random duration in [0, Jitter) added to the latency.
+	Jitter *rdesc.Duration
+	// Probability of a query to fail, from 0 to 1.
+	ErrorRate float64
+	// Error messages of failed queries. Defaults to "fake error".
+	Errors rdesc.Wrand[string]
+}
+
+var _ Driver = (*FakeDriver)(nil)
+
+// FakeDriver doesn't connect anywhere. It waits for the configured latency,
+// injects errors and saves queries like the real drivers.
+type FakeDriver struct {
+	connstr string
+	saver   QuerySaver
+	opts    FakeOptions
+}
+
+func NewFake(connstr string, saver QuerySaver, opts FakeOptions) *FakeDriver {
+	return &FakeDriver{
+		connstr: connstr,
+		saver:   saver,
+		opts:    opts,
+	}
+}
+
+func (f *FakeDriver) Query(ctx context.Context, singleQuery SingleQuery) (*models.Query, error) {
+	ctx, cancel := singleQuery.withTimeout(ctx)
+	defer cancel()
+
+	request, err := json.Marshal(singleQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	q := startQuery(ctx, models.QueryDB, f.connstr, string(Fake), "fake", string(request))
+	err = f.wait(ctx)
+	if err == nil {
+		err = f.pickError()
+	}
+
+	response := ""
+	if err == nil {
+		response = `{"command":"FAKE","rowCount":0}`
+	}
+	finishQuery(ctx, q, response, err)
+	return q, saveQuery(f.saver, q, err)
+}
+
+// Sleeps for the random latency, returns earlier if the context is done.
+func (f *FakeDriver) wait(ctx context.Context) error {
+	var latency time.Duration
+	if len(f.opts.Latency) > 0 {
+		latency = f.opts.Latency.Pick().Duration
+	}
+	if f.opts.Jitter != nil && f.opts.Jitter.Duration > 0 {
+		latency += time.Duration(rand.Int63n(int64(f.opts.Jitter.Duration)))
+	}
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Returns an injected error with probability ErrorRate.
+func (f *FakeDriver) pickError() error {
+	if f.opts.ErrorRate <= 0 || rand.Float64() >= f.opts.ErrorRate {
+		return nil
+	}
+	if len(f.opts.Errors) == 0 {
+		return errors.New(defaultFakeError)
+	}
+	return errors.New(f.opts.Errors.Pick())
+}
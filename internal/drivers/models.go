@@ -1,9 +1,39 @@
 package drivers
 
+import (
+	"context"
+	"time"
+
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
 // Single query to the driver.
 type SingleQuery struct {
 	Query  string `json:"query"`
 	Params []any  `json:"params"`
+	// Optional deadline for the query, starting when the query is sent.
+	Timeout *rdesc.Duration `json:"timeout,omitempty"`
+}
+
+// Returns a context limited by the query timeout.
+func (q *SingleQuery) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if q.Timeout == nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, q.Timeout.Duration)
+}
+
+// Returns a context limited by the sum of the query timeouts. The context is limited
+// only if every query has a timeout.
+func withBatchTimeout(ctx context.Context, queries []SingleQuery) (context.Context, context.CancelFunc) {
+	var total time.Duration
+	for _, q := range queries {
+		if q.Timeout == nil {
+			return context.WithCancel(ctx)
+		}
+		total += q.Timeout.Duration
+	}
+	return context.WithTimeout(ctx, total)
 }
 
 type Name string
@@ -16,4 +46,5 @@ const (
 	VercelEdgeHTTP08 = Name("vercel-edge=http08")
 	VercelNodeHTTP09 = Name("vercel-node=http09")
 	VercelNodePool09 = Name("vercel-node=pool09")
+	Fake             = Name("fake")
 )
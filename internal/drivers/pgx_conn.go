@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ type PgxConnection struct {
 	connstr   string
 	conn      *pgx.Conn
 	connQuery *models.Query
+	connMeta  *models.QueryMeta
 	saver     QuerySaver
 	// local port, backend pid
 	connTracing string
@@ -33,15 +35,36 @@ func PgxConnect(ctx context.Context, connstr string, saver QuerySaver) (*PgxConn
 		"connect",
 		"",
 	)
-	conn, err1 := pgx.Connect(ctx, connstr)
+	meta := &models.QueryMeta{}
+	connQuery.Meta = meta
+
+	var conn *pgx.Conn
+	config, err1 := pgx.ParseConfig(connstr)
+	if err1 == nil {
+		lookup := config.LookupFunc
+		config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+			addrs, err := lookup(ctx, host)
+			meta.Host = host
+			meta.ResolvedIPs = addrs
+			return addrs, err
+		}
+		conn, err1 = pgx.ConnectConfig(ctx, config)
+	}
+
 	connTracingDetails := ""
 	if conn != nil {
 		internalConn := conn.PgConn()
 		pid := internalConn.PID()
 		netAddr := internalConn.Conn().LocalAddr().String()
 		connTracingDetails = fmt.Sprintf("pid=%v <= %s", pid, netAddr)
+		meta.LocalAddr = netAddr
+		meta.RemoteAddr = internalConn.Conn().RemoteAddr().String()
+		if tlsConn, ok := internalConn.Conn().(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			meta.TLS = models.NewTLSInfo(&state)
+		}
 	}
-	finishQuery(connQuery, connTracingDetails, err1)
+	finishQuery(ctx, connQuery, connTracingDetails, err1)
 
 	if err := saveQuery(saver, connQuery, err1); err != nil {
 		return nil, err
@@ -51,6 +74,7 @@ func PgxConnect(ctx context.Context, connstr string, saver QuerySaver) (*PgxConn
 		connstr:     connstr,
 		conn:        conn,
 		connQuery:   connQuery,
+		connMeta:    meta,
 		saver:       saver,
 		connTracing: connTracingDetails,
 	}, nil
@@ -71,6 +95,10 @@ func (c *PgxConnection) Query(ctx context.Context, req SingleQuery) (*models.Que
 		string(jsonReq),
 	)
 	query.RelatedQueryID = &c.connQuery.ID
+	query.Meta = c.connMeta
+
+	ctx, cancel := req.withTimeout(ctx)
+	defer cancel()
 
 	rows, err1 := c.conn.Query(ctx, req.Query, req.Params...)
 	// rows are always non-nil
@@ -93,11 +121,11 @@ func (c *PgxConnection) Query(ctx context.Context, req SingleQuery) (*models.Que
 			err2 = errors.Join(err1, err2)
 		}
 
-		finishQuery(query, string(jsonRows), err2)
+		finishQuery(ctx, query, string(jsonRows), err2)
 		return query, saveQuery(c.saver, query, err2)
 	}
 
-	finishQuery(query, string(jsonRows), nil)
+	finishQuery(ctx, query, string(jsonRows), nil)
 	return query, saveQuery(c.saver, query, nil)
 }
 
@@ -55,14 +55,15 @@ func startQuery(
 	}
 }
 
-func finishQuery(query *models.Query, response string, err error) {
+// Marks the query as finished. Context is used to tell cancellations and timeouts apart from
+// other errors, so it should be the one used for the query.
+func finishQuery(ctx context.Context, query *models.Query, response string, err error) {
 	if query.Response == "" {
 		query.Response = response
 	}
 
-	if err != nil && !query.IsFailed {
-		query.IsFailed = true
-		query.Error = err.Error()
+	if query.State == "" {
+		query.SetError(ctx, err)
 	}
 
 	query.IsFinished = true
@@ -0,0 +1,196 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
+)
+
+// Capability is a feature that is supported only by some drivers.
+type Capability string
+
+const (
+	// Several queries can be executed in a single transaction.
+	CapTransactions Capability = "transactions"
+	// Several statements can be sent in a single query.
+	CapMultiStatement Capability = "multi_statement"
+	// Session state (SET, temp tables, prepared statements) is kept between queries.
+	CapSessionState Capability = "session_state"
+	// LISTEN/NOTIFY is supported.
+	CapListen Capability = "listen"
+	// Query response is a JSON array of rows, every row is an array of values, e.g. [[1]].
+	CapRowsResponse Capability = "rows_response"
+)
+
+type Capabilities []Capability
+
+// Has returns true if all the given capabilities are present.
+func (c Capabilities) Has(caps ...Capability) bool {
+	for _, want := range caps {
+		found := false
+		for _, got := range c {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Params are passed to the driver constructor.
+type Params struct {
+	Connstr string
+	Saver   QuerySaver
+	// Optional, overrides the default client of HTTP-based drivers.
+	HTTPClient *httpclient.Client
+	// Options for the SQL-over-HTTP driver.
+	Serverless ServerlessOptions
+	// Options for the fake driver.
+	Fake FakeOptions
+}
+
+type Constructor func(ctx context.Context, params Params) (Driver, error)
+
+// Registration describes a driver available in the registry.
+type Registration struct {
+	Name         Name
+	Capabilities Capabilities
+	// Optional, capabilities available only with some params, in addition to Capabilities.
+	ParamCapabilities func(params Params) Capabilities
+	New               Constructor
+}
+
+// Supports returns true if the driver created with the params has all the given capabilities.
+func (r Registration) Supports(params Params, caps ...Capability) bool {
+	all := r.Capabilities
+	if r.ParamCapabilities != nil {
+		all = append(append(Capabilities{}, all...), r.ParamCapabilities(params)...)
+	}
+	return all.Has(caps...)
+}
+
+// Registry has all available drivers by name.
+type Registry struct {
+	drivers map[Name]Registration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		drivers: make(map[Name]Registration),
+	}
+}
+
+// NewDefaultRegistry returns a registry with all built-in drivers, including the built-in relays.
+func NewDefaultRegistry() (*Registry, error) {
+	r := NewRegistry()
+	r.Register(Registration{
+		Name:         PgxConn,
+		Capabilities: Capabilities{CapTransactions, CapMultiStatement, CapSessionState, CapListen, CapRowsResponse},
+		New: func(ctx context.Context, params Params) (Driver, error) {
+			connstr := appendConnstrParam(params.Connstr, "default_query_exec_mode", "simple_protocol")
+			return PgxConnect(ctx, connstr, params.Saver)
+		},
+	})
+	r.Register(Registration{
+		Name: GoServerless,
+		// only batch requests are executed in a transaction
+		ParamCapabilities: func(params Params) Capabilities {
+			if params.Serverless.Batch {
+				return Capabilities{CapTransactions}
+			}
+			return nil
+		},
+		New: func(ctx context.Context, params Params) (Driver, error) {
+			return NewServerless(params.Connstr, params.Saver, params.HTTPClient, params.Serverless)
+		},
+	})
+	r.Register(Registration{
+		Name: Fake,
+		// fake queries don't depend on each other, so every scenario can run,
+		// except those that read the returned rows
+		Capabilities: Capabilities{CapTransactions, CapMultiStatement, CapSessionState, CapListen},
+		New: func(ctx context.Context, params Params) (Driver, error) {
+			return NewFake(params.Connstr, params.Saver, params.Fake), nil
+		},
+	})
+
+	for name, config := range BuiltinRelays {
+		if err := r.RegisterRelay(name, config); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register adds a driver, replacing the existing one with the same name.
+func (r *Registry) Register(reg Registration) {
+	r.drivers[reg.Name] = reg
+}
+
+// RegisterRelay adds a relay driver. HTTP client for the relay is created once here.
+func (r *Registry) RegisterRelay(name Name, config RelayConfig) error {
+	if config.URL == "" {
+		return fmt.Errorf("relay %s has no URL", name)
+	}
+
+	var relayClient *httpclient.Client
+	if config.HTTPClient != nil {
+		var err error
+		relayClient, err = httpclient.New(*config.HTTPClient)
+		if err != nil {
+			return fmt.Errorf("invalid http client for relay %s: %w", name, err)
+		}
+	}
+
+	r.Register(Registration{
+		Name:         name,
+		Capabilities: config.Capabilities,
+		New: func(ctx context.Context, params Params) (Driver, error) {
+			client := params.HTTPClient
+			if client == nil {
+				client = relayClient
+			}
+			return NewRelay(name, params.Connstr, params.Saver, config, client), nil
+		},
+	})
+	return nil
+}
+
+// Get returns the driver registration by name.
+func (r *Registry) Get(name Name) (Registration, bool) {
+	reg, ok := r.drivers[name]
+	return reg, ok
+}
+
+// Clone returns a copy of the registry, which can be modified independently.
+func (r *Registry) Clone() *Registry {
+	c := NewRegistry()
+	for name, reg := range r.drivers {
+		c.drivers[name] = reg
+	}
+	return c
+}
+
+// New creates a driver by name.
+func (r *Registry) New(ctx context.Context, name Name, params Params) (Driver, error) {
+	reg, ok := r.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown driver: %s", name)
+	}
+	return reg.New(ctx, params)
+}
+
+func appendConnstrParam(connstr string, key string, value string) string {
+	if strings.Contains(connstr, "?") {
+		connstr += "&"
+	} else {
+		connstr += "?"
+	}
+	return connstr + key + "=" + value
+}
@@ -0,0 +1,292 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+// websockets
+const VercelEdge04 = "https://sl-driver.vercel.app/api/query"
+
+// http
+const VercelEdge07 = "https://sl-driver.vercel.app/api/v07/http_query"
+const VercelEdge08 = "https://sl-driver.vercel.app/api/v08/http_query"
+const VercelNode09 = "https://neon-vercel-node.vercel.app/api/query"
+const VercelNode09WS = "https://neon-vercel-node.vercel.app/api/ws_query"
+
+// RelayConfig describes an HTTP service that executes queries on our behalf,
+// e.g. `@neondatabase/serverless` deployed on Vercel or Cloudflare Workers.
+// The relay must accept slRequest and respond with slResponse.
+type RelayConfig struct {
+	// URL of the relay endpoint.
+	URL string
+	// Additional headers sent with every request.
+	Headers map[string]string
+	// If set, sent as "Authorization: Bearer <token>".
+	AuthToken string
+	// Name of the environment variable with the auth token. Allows to keep secrets out of the rules.
+	AuthTokenEnv string
+	// HTTP client options for requests to the relay. Default client is used if not set.
+	HTTPClient *httpclient.Options
+	// Features supported by the relay, see Capability.
+	Capabilities Capabilities
+}
+
+// websocket relays execute all queries of a request in a single session
+var wsRelayCapabilities = Capabilities{CapTransactions, CapSessionState}
+
+// BuiltinRelays are available without any configuration.
+var BuiltinRelays = map[Name]RelayConfig{
+	VercelEdge:       {URL: VercelEdge04, Capabilities: wsRelayCapabilities},
+	VercelEdgeHTTP07: {URL: VercelEdge07},
+	VercelEdgeHTTP08: {URL: VercelEdge08},
+	VercelNodeHTTP09: {URL: VercelNode09},
+	VercelNodePool09: {URL: VercelNode09WS, Capabilities: wsRelayCapabilities},
+}
+
+func (c *RelayConfig) authToken() string {
+	if c.AuthTokenEnv != "" {
+		return os.Getenv(c.AuthTokenEnv)
+	}
+	return c.AuthToken
+}
+
+type slRequest struct {
+	ConnStr string        `json:"connstr"`
+	Queries []SingleQuery `json:"queries"`
+}
+
+type slResponse struct {
+	Queries []slQueryResponse `json:"queries"`
+}
+
+type slQueryResponse struct {
+	Exitnode   string     `json:"exitnode"`
+	Kind       string     `json:"kind"`
+	Addr       string     `json:"addr"`
+	Driver     string     `json:"driver"`
+	Method     string     `json:"method"`
+	Request    string     `json:"request"`
+	Response   string     `json:"response"`
+	Error      string     `json:"error"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+	IsFailed   bool       `json:"isFailed"`
+	DurationNs *int64     `json:"durationNs"`
+}
+
+var _ Driver = (*Relay)(nil)
+var _ ManyQueriesDriver = (*Relay)(nil)
+
+// Relay sends queries to the configured relay, which executes them and returns the results.
+type Relay struct {
+	name    Name
+	saver   QuerySaver
+	connstr string
+	config  RelayConfig
+	client  *httpclient.Client
+}
+
+// NewRelay creates a driver for the relay. If client is nil, httpclient.Default is used.
+func NewRelay(name Name, connstr string, saver QuerySaver, config RelayConfig, client *httpclient.Client) *Relay {
+	if client == nil {
+		client = httpclient.Default
+	}
+	return &Relay{
+		name:    name,
+		connstr: connstr,
+		config:  config,
+		saver:   saver,
+		client:  client,
+	}
+}
+
+func (s *Relay) Query(ctx context.Context, singleQuery SingleQuery) (*models.Query, error) {
+	res, err := s.Queries(ctx, singleQuery)
+	var q *models.Query
+	if len(res) == 1 {
+		q = &res[0]
+	}
+	return q, err
+}
+
+// Queries sends all queries in a single request to the relay. The request itself is saved
+// as a parent query with kind "relay", the returned queries are related to it.
+func (s *Relay) Queries(ctx context.Context, queries ...SingleQuery) ([]models.Query, error) {
+	parent, res, err := s.queries(ctx, queries...)
+	if parent == nil {
+		return nil, err
+	}
+
+	if err2 := saveQuery(s.saver, parent, nil); err2 != nil {
+		return nil, errors.Join(err, err2)
+	}
+
+	for i := range res {
+		res[i].RelatedQueryID = &parent.ID
+		if err2 := saveQuery(s.saver, &res[i], nil); err2 != nil {
+			return res, errors.Join(err, err2)
+		}
+	}
+
+	return res, err
+}
+
+// Executes queries through the relay. Returns the parent query for the whole request
+// and a query for every sent query. Queries without a result from the relay are failed.
+func (s *Relay) queries(ctx context.Context, queries ...SingleQuery) (*models.Query, []models.Query, error) {
+	slReq := slRequest{
+		ConnStr: s.connstr,
+		Queries: queries,
+	}
+	requestBody, err := json.Marshal(slReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := withBatchTimeout(ctx, queries)
+	defer cancel()
+
+	parent := startQuery(
+		ctx,
+		models.QueryRelay,
+		s.config.URL,
+		string(s.name),
+		"POST",
+		string(requestBody),
+	)
+	parent.HTTPMode = s.client.Mode
+
+	slResp, err := s.roundTrip(ctx, parent, requestBody)
+	finishQuery(ctx, parent, "", err)
+
+	var retQueries []models.Query
+	for _, slQuery := range slResp.Queries {
+		q := s.convert(slQuery)
+		q.HTTPMode = s.client.Mode
+		q.HTTPConnReused = parent.HTTPConnReused
+		// connection to the relay, not to the database
+		q.Meta = parent.Meta
+		retQueries = append(retQueries, q)
+	}
+
+	if len(retQueries) > len(queries) {
+		log.Warn(ctx, "relay returned more results than queries sent",
+			zap.Int("sent", len(queries)), zap.Int("received", len(retQueries)))
+	}
+	for i := len(retQueries); i < len(queries); i++ {
+		retQueries = append(retQueries, s.missingQuery(ctx, parent, queries[i]))
+	}
+
+	if err == nil && len(slResp.Queries) < len(queries) {
+		err = fmt.Errorf("relay returned %d results for %d queries", len(slResp.Queries), len(queries))
+	}
+	return parent, retQueries, err
+}
+
+// Sends the request to the relay and parses the response. Response, timings and
+// connection details are saved to the parent query.
+func (s *Relay) roundTrip(ctx context.Context, parent *models.Query, requestBody []byte) (slResponse, error) {
+	var slResp slResponse
+
+	traceCtx, trace := httpclient.WithTrace(ctx)
+	req, err := http.NewRequestWithContext(traceCtx, "POST", s.config.URL, bytes.NewReader(requestBody))
+	if err != nil {
+		return slResp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.config.Headers {
+		req.Header.Set(key, value)
+	}
+	if token := s.config.authToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	var resp *http.Response
+	defer func() {
+		parent.HTTPConnReused = trace.ConnReused
+		parent.Meta = trace.Meta(req, resp)
+	}()
+
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return slResp, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return slResp, err
+	}
+	parent.Response = string(body)
+
+	log.Debug(ctx, "got response", zap.Any("body", json.RawMessage(body)))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return slResp, fmt.Errorf("bad status code %d, body: %s", resp.StatusCode, body)
+	}
+
+	if err := json.Unmarshal(body, &slResp); err != nil {
+		log.Error(ctx, "failed to unmarshal response", zap.String("body", string(body)))
+		return slResp, fmt.Errorf("invalid relay response: %w", err)
+	}
+	return slResp, nil
+}
+
+// Returns a failed query for the query without a result from the relay.
+// The query has the same timings and state as the parent.
+func (s *Relay) missingQuery(ctx context.Context, parent *models.Query, singleQuery SingleQuery) models.Query {
+	q := startQuery(ctx, models.QueryDB, s.connstr, string(s.name), "relay", singleQuery.Query)
+	q.HTTPMode = parent.HTTPMode
+	q.HTTPConnReused = parent.HTTPConnReused
+	q.Meta = parent.Meta
+	q.QueryResult = parent.QueryResult
+	q.Response = ""
+	if q.Error == "" {
+		q.Error = "no result from relay"
+	}
+	if q.State == models.QuerySucceeded {
+		q.State = models.QueryFailed
+		q.IsFailed = true
+	}
+	return *q
+}
+
+func (s *Relay) convert(slQuery slQueryResponse) models.Query {
+	state := models.QuerySucceeded
+	if slQuery.IsFailed {
+		state = models.QueryFailed
+	}
+
+	return models.Query{
+		Exitnode: slQuery.Exitnode,
+		Kind:     models.QueryDestination(slQuery.Kind),
+		Addr:     slQuery.Addr,
+		Driver:   slQuery.Driver,
+		Method:   slQuery.Method,
+		Request:  slQuery.Request,
+		QueryResult: models.QueryResult{
+			IsFinished: true,
+			Response:   slQuery.Response,
+			Error:      slQuery.Error,
+			StartedAt:  slQuery.StartedAt,
+			FinishedAt: slQuery.FinishedAt,
+			IsFailed:   slQuery.IsFailed,
+			State:      state,
+			Duration:   models.QueryDuration(slQuery.DurationNs),
+		},
+	}
+}
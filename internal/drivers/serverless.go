@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
 	"github.com/petuhovskiy/neon-lights/internal/models"
 )
 
@@ -18,22 +21,73 @@ type hosRequest struct {
 	Params []any  `json:"params"`
 }
 
+type hosBatchRequest struct {
+	Queries []hosRequest `json:"queries"`
+}
+
+// ServerlessOptions configure SQL-over-HTTP requests. Can be passed in rule args.
+type ServerlessOptions struct {
+	// Sends `Neon-Pool-Opt-In: true`. Enabled by default.
+	PoolOptIn *bool
+	// Rows are returned as arrays instead of objects.
+	ArrayMode bool
+	// Values are returned as text, without parsing.
+	RawTextOutput bool
+	// Many queries are sent in a single batch request, which is executed in a transaction.
+	// Disabled by default, queries are sent one by one and saved separately.
+	Batch bool
+	// Isolation level of batch transactions, e.g. "Serializable" or "ReadCommitted".
+	IsolationLevel string
+	// Batch transactions are read-only.
+	ReadOnly bool
+	// Batch transactions are deferrable.
+	Deferrable bool
+}
+
+// ServerlessResult is a result of a single query.
+type ServerlessResult struct {
+	Command    string            `json:"command"`
+	RowCount   *int              `json:"rowCount"`
+	RowAsArray bool              `json:"rowAsArray"`
+	Fields     []ServerlessField `json:"fields"`
+	Rows       []json.RawMessage `json:"rows"`
+}
+
+type ServerlessField struct {
+	Name       string `json:"name"`
+	DataTypeID uint32 `json:"dataTypeID"`
+}
+
+type serverlessBatchResponse struct {
+	Results []ServerlessResult `json:"results"`
+}
+
 var _ Driver = (*Serverless)(nil)
+var _ ManyQueriesDriver = (*Serverless)(nil)
 
-// SQL-over-HTTP driver.
+// SQL-over-HTTP driver. Many queries are sent one by one, or in a single batch request
+// if ServerlessOptions.Batch is set.
 type Serverless struct {
 	connstr *url.URL
 	saver   QuerySaver
+	client  *httpclient.Client
+	opts    ServerlessOptions
 }
 
-func NewServerless(connectionString string, saver QuerySaver) (*Serverless, error) {
+// NewServerless creates a SQL-over-HTTP driver. If client is nil, httpclient.Default is used.
+func NewServerless(connectionString string, saver QuerySaver, client *httpclient.Client, opts ServerlessOptions) (*Serverless, error) {
 	connstr, err := url.Parse(connectionString)
 	if err != nil {
 		return nil, err
 	}
+	if client == nil {
+		client = httpclient.Default
+	}
 	return &Serverless{
 		connstr: connstr,
 		saver:   saver,
+		client:  client,
+		opts:    opts,
 	}, nil
 }
 
@@ -41,25 +95,156 @@ func (s *Serverless) httpURL() string {
 	return fmt.Sprintf("https://%s/sql", s.connstr.Hostname())
 }
 
+func (s *Serverless) poolOptIn() bool {
+	return s.opts.PoolOptIn == nil || *s.opts.PoolOptIn
+}
+
+// Method saved to the queries, e.g. "sql-over-http(pool,batch)".
+func (s *Serverless) method(batch bool) string {
+	var flags []string
+	if s.poolOptIn() {
+		flags = append(flags, "pool")
+	}
+	if batch {
+		flags = append(flags, "batch")
+	}
+	if s.opts.ArrayMode {
+		flags = append(flags, "array")
+	}
+	if s.opts.RawTextOutput {
+		flags = append(flags, "raw")
+	}
+	if len(flags) == 0 {
+		return "sql-over-http"
+	}
+	return fmt.Sprintf("sql-over-http(%s)", strings.Join(flags, ","))
+}
+
+func (s *Serverless) setHeaders(req *http.Request, batch bool) {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Neon-Connection-String", s.connstr.String())
+	if s.poolOptIn() {
+		req.Header.Set("Neon-Pool-Opt-In", "true")
+	}
+	if s.opts.ArrayMode {
+		req.Header.Set("Neon-Array-Mode", "true")
+	}
+	if s.opts.RawTextOutput {
+		req.Header.Set("Neon-Raw-Text-Output", "true")
+	}
+	if !batch {
+		return
+	}
+	if s.opts.IsolationLevel != "" {
+		req.Header.Set("Neon-Batch-Isolation-Level", s.opts.IsolationLevel)
+	}
+	if s.opts.ReadOnly {
+		req.Header.Set("Neon-Batch-Read-Only", "true")
+	}
+	if s.opts.Deferrable {
+		req.Header.Set("Neon-Batch-Deferrable", "true")
+	}
+}
+
 func (s *Serverless) Query(ctx context.Context, singleQuery SingleQuery) (*models.Query, error) {
-	q, err := s.query(ctx, singleQuery)
+	ctx, cancel := singleQuery.withTimeout(ctx)
+	defer cancel()
+
+	// the response body is the only result
+	q, _, err := s.send(ctx, newHosRequest(singleQuery), 1, false)
+	if q == nil {
+		return nil, err
+	}
 	return q, saveQuery(s.saver, q, err)
 }
 
-func (s *Serverless) query(ctx context.Context, singleQuery SingleQuery) (retQuery *models.Query, retErr error) {
-	query := singleQuery.Query
-	params := singleQuery.Params
+// Queries sends the queries one by one, stopping at the first error. If ServerlessOptions.Batch
+// is set, all queries are sent in a single batch request, see batchQueries.
+func (s *Serverless) Queries(ctx context.Context, queries ...SingleQuery) ([]models.Query, error) {
+	if s.opts.Batch {
+		return s.batchQueries(ctx, queries)
+	}
+
+	var res []models.Query
+	for _, singleQuery := range queries {
+		q, err := s.Query(ctx, singleQuery)
+		if q != nil {
+			res = append(res, *q)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// Sends all queries in a single batch request. The batch is saved as a query, followed by a query
+// for every statement, related to the batch and holding its result. Statements without a result,
+// e.g. when the batch failed, are saved as failed with the error of the batch.
+func (s *Serverless) batchQueries(ctx context.Context, queries []SingleQuery) ([]models.Query, error) {
+	ctx, cancel := withBatchTimeout(ctx, queries)
+	defer cancel()
+
+	batch := hosBatchRequest{}
+	for _, q := range queries {
+		batch.Queries = append(batch.Queries, newHosRequest(q))
+	}
+
+	q, results, err := s.send(ctx, batch, len(queries), true)
+	if q == nil {
+		return nil, err
+	}
+	if saveErr := saveQuery(s.saver, q, nil); saveErr != nil {
+		return []models.Query{*q}, errors.Join(err, saveErr)
+	}
+
+	res := []models.Query{*q}
+	for i, singleQuery := range queries {
+		statement := *q
+		statement.ID = 0
+		statement.RelatedQueryID = &q.ID
+		statement.Request = singleQuery.Query
+		statement.Response = ""
+		if i < len(results) {
+			response, jsonErr := json.Marshal(results[i])
+			if jsonErr != nil {
+				return res, errors.Join(err, jsonErr)
+			}
+			statement.Response = string(response)
+		} else if statement.State == models.QuerySucceeded {
+			statement.State = models.QueryFailed
+			statement.IsFailed = true
+			statement.Error = "no result in the batch response"
+		}
+		if saveErr := saveQuery(s.saver, &statement, nil); saveErr != nil {
+			return res, errors.Join(err, saveErr)
+		}
+		res = append(res, statement)
+	}
+	return res, err
+}
+
+func newHosRequest(q SingleQuery) hosRequest {
+	params := q.Params
 	if params == nil {
 		params = []any{}
 	}
-
-	hos := hosRequest{
-		Query:  query,
+	return hosRequest{
+		Query:  q.Query,
 		Params: params,
 	}
-	requestBody, err := json.Marshal(hos)
+}
+
+// Sends the request with n queries, validates and returns the results.
+func (s *Serverless) send(
+	ctx context.Context,
+	requestObj any,
+	n int,
+	batch bool,
+) (retQuery *models.Query, results []ServerlessResult, retErr error) {
+	requestBody, err := json.Marshal(requestObj)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	retQuery = startQuery(
@@ -67,52 +252,118 @@ func (s *Serverless) query(ctx context.Context, singleQuery SingleQuery) (retQue
 		models.QueryDB,
 		s.connstr.String(),
 		"go-serverless",
-		"sql-over-http(pool)",
+		s.method(batch),
 		string(requestBody),
 	)
+	retQuery.HTTPMode = s.client.Mode
 
-	defer func() {
-		if retErr != nil {
-			retQuery.IsFinished = true
-			retQuery.IsFailed = true
-			retQuery.Error = retErr.Error()
-		}
-	}()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", s.httpURL(), bytes.NewReader(requestBody))
+	traceCtx, trace := httpclient.WithTrace(ctx)
+	req, err := http.NewRequestWithContext(traceCtx, "POST", s.httpURL(), bytes.NewReader(requestBody))
 	if err != nil {
-		return retQuery, err
+		finishQuery(ctx, retQuery, "", err)
+		return retQuery, nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Neon-Connection-String", s.connstr.String())
-	req.Header.Set("Neon-Pool-Opt-In", "true")
+	var resp *http.Response
+	defer func() {
+		retQuery.HTTPConnReused = trace.ConnReused
+		retQuery.Meta = trace.Meta(req, resp)
+		finishQuery(ctx, retQuery, "", retErr)
+	}()
+
+	s.setHeaders(req, batch)
 
 	startedAt := time.Now()
 	retQuery.StartedAt = &startedAt
 
-	// TODO: non-default client
-	resp, err := http.DefaultClient.Do(req)
+	resp, err = s.client.Do(req)
 	if err != nil {
-		return retQuery, err
+		return retQuery, nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return retQuery, err
+		return retQuery, nil, err
 	}
 
 	finishedAt := time.Now()
-	duration := finishedAt.Sub(startedAt)
 	retQuery.FinishedAt = &finishedAt
-	retQuery.Duration = &duration
-	retQuery.IsFinished = true
 	retQuery.Response = string(body)
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return retQuery, fmt.Errorf("bad status code %d, body: %s", resp.StatusCode, body)
+		return retQuery, nil, fmt.Errorf("bad status code %d, body: %s", resp.StatusCode, body)
+	}
+
+	results, err = parseServerlessResponse(body, n, batch, s.opts)
+	return retQuery, results, err
+}
+
+// Parses the response and checks that it matches the request options.
+func parseServerlessResponse(body []byte, n int, batch bool, opts ServerlessOptions) ([]ServerlessResult, error) {
+	var results []ServerlessResult
+	if batch {
+		var resp serverlessBatchResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("invalid batch response: %w", err)
+		}
+		results = resp.Results
+	} else {
+		var resp ServerlessResult
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+		results = []ServerlessResult{resp}
+	}
+
+	if len(results) != n {
+		return nil, fmt.Errorf("expected %d results, got %d", n, len(results))
 	}
 
-	return retQuery, nil
+	for i := range results {
+		if err := results[i].validate(opts); err != nil {
+			return nil, fmt.Errorf("invalid result #%d: %w", i, err)
+		}
+	}
+	return results, nil
+}
+
+// Checks that rows match the fields and the output format.
+func (r *ServerlessResult) validate(opts ServerlessOptions) error {
+	if r.RowAsArray != opts.ArrayMode {
+		return fmt.Errorf("rowAsArray is %v, expected %v", r.RowAsArray, opts.ArrayMode)
+	}
+
+	for i, row := range r.Rows {
+		var values []json.RawMessage
+		if r.RowAsArray {
+			if err := json.Unmarshal(row, &values); err != nil {
+				return fmt.Errorf("row #%d is not an array: %w", i, err)
+			}
+			if len(values) != len(r.Fields) {
+				return fmt.Errorf("row #%d has %d values, expected %d", i, len(values), len(r.Fields))
+			}
+		} else {
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(row, &obj); err != nil {
+				return fmt.Errorf("row #%d is not an object: %w", i, err)
+			}
+			for _, field := range r.Fields {
+				value, ok := obj[field.Name]
+				if !ok {
+					return fmt.Errorf("row #%d has no field %q", i, field.Name)
+				}
+				values = append(values, value)
+			}
+		}
+
+		if opts.RawTextOutput {
+			for j, value := range values {
+				if len(value) > 0 && value[0] != '"' && string(value) != "null" {
+					return fmt.Errorf("row #%d value #%d is not a string: %s", i, j, value)
+				}
+			}
+		}
+	}
+	return nil
 }
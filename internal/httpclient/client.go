@@ -0,0 +1,263 @@
+// Package httpclient builds configurable HTTP clients for drivers and API clients.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+const (
+	ProtocolAuto  = ""
+	ProtocolHTTP1 = "http1"
+	ProtocolHTTP2 = "http2"
+)
+
+// Options describe an HTTP client. Can be passed in rule args.
+type Options struct {
+	// Overall timeout for the request, including reading the response body.
+	Timeout *rdesc.Duration
+	// Timeout for establishing a TCP connection.
+	DialTimeout *rdesc.Duration
+	// Timeout for the TLS handshake.
+	TLSHandshakeTimeout *rdesc.Duration
+	// Timeout for waiting for response headers after the request was sent.
+	ResponseHeaderTimeout *rdesc.Duration
+	// One of "http1", "http2" or "" (negotiated by ALPN). With "http2" only h2 is offered by ALPN,
+	// and responses over other protocols are rejected.
+	Protocol string
+	// If true, every request will use a fresh connection.
+	FreshConnection bool
+	// If true, "Accept-Encoding: gzip" won't be sent.
+	DisableCompression bool
+	// Optional proxy URL, e.g. "http://proxy:3128".
+	ProxyURL string
+}
+
+// Client is an http.Client with a description of its configuration.
+type Client struct {
+	*http.Client
+	// Short description of the client configuration, saved to the queries.
+	Mode string
+}
+
+// Default is a client used when nothing is configured.
+var Default = &Client{
+	Client: http.DefaultClient,
+	Mode:   "default",
+}
+
+// New creates a new client with its own connection pool.
+func New(opts Options) (*Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if opts.DialTimeout != nil {
+		dialer.Timeout = opts.DialTimeout.Duration
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     opts.FreshConnection,
+		DisableCompression:    opts.DisableCompression,
+	}
+	if opts.TLSHandshakeTimeout != nil {
+		transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout.Duration
+	}
+	if opts.ResponseHeaderTimeout != nil {
+		transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout.Duration
+	}
+
+	var roundTripper http.RoundTripper = transport
+	switch opts.Protocol {
+	case ProtocolAuto:
+		transport.ForceAttemptHTTP2 = true
+	case ProtocolHTTP2:
+		transport.ForceAttemptHTTP2 = true
+		transport.TLSClientConfig = &tls.Config{NextProtos: []string{"h2"}}
+		roundTripper = http2Only{transport}
+	case ProtocolHTTP1:
+		// non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", opts.Protocol)
+	}
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	client := &http.Client{
+		Transport: roundTripper,
+	}
+	if opts.Timeout != nil {
+		client.Timeout = opts.Timeout.Duration
+	}
+
+	return &Client{
+		Client: client,
+		Mode:   opts.Mode(),
+	}, nil
+}
+
+// Rejects responses that were not received over HTTP/2, e.g. a server without h2 in ALPN.
+type http2Only struct {
+	*http.Transport
+}
+
+func (t http2Only) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got %s response, but http2 is required", resp.Proto)
+	}
+	return resp, nil
+}
+
+// Mode returns a short description of the options, e.g. "http2,keepalive,gzip".
+func (o Options) Mode() string {
+	parts := []string{"auto"}
+	switch o.Protocol {
+	case ProtocolHTTP1:
+		parts[0] = "http1"
+	case ProtocolHTTP2:
+		parts[0] = "http2"
+	}
+
+	if o.FreshConnection {
+		parts = append(parts, "fresh")
+	} else {
+		parts = append(parts, "keepalive")
+	}
+
+	if !o.DisableCompression {
+		parts = append(parts, "gzip")
+	}
+
+	if o.ProxyURL != "" {
+		parts = append(parts, "proxy")
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Trace collects information about the connection used for a request.
+// Fields are set by the HTTP client during the request.
+type Trace struct {
+	mu sync.Mutex
+	// ConnReused is set after the connection was obtained.
+	ConnReused *bool
+	// Addresses returned by DNS. Empty if DNS wasn't used, e.g. for reused connections.
+	ResolvedIPs []string
+	RemoteAddr  string
+	LocalAddr   string
+	// Set after a new TLS connection was established.
+	TLSState *tls.ConnectionState
+}
+
+// WithTrace returns a context that will fill the trace during the request.
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	trace := &Trace{}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			trace.mu.Lock()
+			defer trace.mu.Unlock()
+			for _, addr := range info.Addrs {
+				trace.ResolvedIPs = append(trace.ResolvedIPs, addr.IP.String())
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			trace.mu.Lock()
+			defer trace.mu.Unlock()
+			trace.TLSState = &state
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.mu.Lock()
+			defer trace.mu.Unlock()
+			reused := info.Reused
+			trace.ConnReused = &reused
+			trace.RemoteAddr = info.Conn.RemoteAddr().String()
+			trace.LocalAddr = info.Conn.LocalAddr().String()
+		},
+	})
+	return ctx, trace
+}
+
+// Meta returns the connection information collected so far. Response can be nil.
+func (t *Trace) Meta(req *http.Request, resp *http.Response) *models.QueryMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta := &models.QueryMeta{
+		Host:        req.URL.Hostname(),
+		ResolvedIPs: t.ResolvedIPs,
+		RemoteAddr:  t.RemoteAddr,
+		LocalAddr:   t.LocalAddr,
+	}
+	tlsState := t.TLSState
+	if resp != nil {
+		meta.ServerHeaders = ServerHeaders(resp.Header)
+		meta.HTTPStatus = resp.StatusCode
+		if resp.TLS != nil {
+			// available for reused connections too
+			tlsState = resp.TLS
+		}
+	}
+	meta.TLS = models.NewTLSInfo(tlsState)
+	return meta
+}
+
+// Headers that can identify the server instance behind the endpoint.
+var serverHeaders = []string{
+	"Server",
+	"Via",
+	"X-Request-Id",
+	"X-Vercel-Id",
+	"Cf-Ray",
+	"Fly-Request-Id",
+}
+
+// ServerHeaders returns headers identifying the server, including all "Neon-*" and "X-Neon-*" headers.
+func ServerHeaders(header http.Header) map[string]string {
+	res := make(map[string]string)
+	for _, name := range serverHeaders {
+		if value := header.Get(name); value != "" {
+			res[name] = value
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, "Neon-") || strings.HasPrefix(name, "X-Neon-") {
+			res[name] = strings.Join(values, ", ")
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
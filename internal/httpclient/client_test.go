@@ -0,0 +1,78 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	cli, err := New(Options{
+		Protocol:        ProtocolHTTP1,
+		FreshConnection: true,
+		ProxyURL:        "http://localhost:3128",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http1,fresh,gzip,proxy", cli.Mode)
+
+	transport := cli.Transport.(*http.Transport)
+	assert.True(t, transport.DisableKeepAlives)
+	assert.NotNil(t, transport.TLSNextProto)
+
+	cli, err = New(Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "auto,keepalive,gzip", cli.Mode)
+
+	_, err = New(Options{Protocol: "http3"})
+	assert.Error(t, err)
+}
+
+func TestNew_http2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	cli, err := New(Options{Protocol: ProtocolHTTP2})
+	require.NoError(t, err)
+	assert.Equal(t, "http2,keepalive,gzip", cli.Mode)
+	transport := cli.Transport.(http2Only).Transport
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	assert.Equal(t, []string{"h2"}, transport.TLSClientConfig.NextProtos)
+
+	resp, err := cli.Get(h2.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	// no h2 in ALPN, not downgraded to HTTP/1.1
+	_, err = cli.Get(h1.URL)
+	assert.Error(t, err)
+
+	// plain HTTP can't be HTTP/2 without h2c
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	_, err = cli.Get(plain.URL)
+	assert.ErrorContains(t, err, "http2 is required")
+}
+
+func TestServerHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Server", "proxy")
+	header.Set("Neon-Instance", "proxy-1")
+	header.Set("Content-Type", "application/json")
+
+	assert.Equal(t, map[string]string{
+		"Server":        "proxy",
+		"Neon-Instance": "proxy-1",
+	}, ServerHeaders(header))
+	assert.Nil(t, ServerHeaders(http.Header{}))
+}
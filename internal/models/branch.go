@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Branch points at which branches can be created.
+const (
+	BranchFromHead      = "head"
+	BranchFromLSN       = "lsn"
+	BranchFromTimestamp = "timestamp"
+)
+
+// Branch is a non-default branch created in a project by the create_branch rule.
+type Branch struct {
+	gorm.Model
+
+	// ProjectID is a foreign key to the project.
+	ProjectID uint `gorm:"index"`
+
+	// BranchID is given by the provider.
+	BranchID string
+
+	// ParentBranchID is the provider ID of the parent branch.
+	ParentBranchID string
+
+	// Name is given by the provider.
+	Name string
+
+	// How the branch point was chosen, one of BranchFromXXX.
+	ParentPoint string
+
+	// Branch point, as returned by the provider.
+	ParentLSN       string
+	ParentTimestamp *time.Time
+
+	// EndpointID of the read-write endpoint of the branch.
+	EndpointID string
+
+	// ConnectionString to the branch endpoint.
+	ConnectionString string
+
+	// Taken from `EXITNODE` environment variable.
+	CreatedByExitnode string
+
+	// Last time the branch was reset to its parent.
+	LastResetAt *time.Time
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TLSInfo describes a TLS connection used by the query. Only the fingerprint of the server
+// certificate is saved with the query, its details are saved to the certificates table.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	// SHA-256 of the DER-encoded server certificate, hex.
+	LeafFingerprint string `json:"leaf_fingerprint"`
+
+	leaf *CertificateInfo
+}
+
+// CertificateInfo is a summary of a single x509 certificate.
+type CertificateInfo struct {
+	// SHA-256 of the DER-encoded certificate, hex.
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	SANs        []string  `json:"sans,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// NewTLSInfo summarizes the connection state. Returns nil if there are no peer certificates.
+func NewTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	leaf := &CertificateInfo{
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		SANs:        cert.DNSNames,
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+	}
+	return &TLSInfo{
+		Version:         tls.VersionName(state.Version),
+		CipherSuite:     tls.CipherSuiteName(state.CipherSuite),
+		LeafFingerprint: leaf.Fingerprint,
+		leaf:            leaf,
+	}
+}
+
+// Leaf returns the server certificate. It's available only before the query is saved,
+// nil for the queries loaded from the database.
+func (i *TLSInfo) Leaf() *CertificateInfo {
+	if i == nil {
+		return nil
+	}
+	return i.leaf
+}
+
+// Certificate is a leaf certificate observed for the host. Unique by host and fingerprint.
+type Certificate struct {
+	gorm.Model
+
+	// Host the certificate was received from.
+	Host        string `gorm:"uniqueIndex:idx_certificates_host_fingerprint"`
+	Fingerprint string `gorm:"uniqueIndex:idx_certificates_host_fingerprint"`
+
+	Subject   string
+	Issuer    string
+	SANs      []string `gorm:"type:jsonb;serializer:json"`
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Negotiated at the last observation.
+	TLSVersion  string
+	CipherSuite string
+
+	FirstSeenAt time.Time
+	LastSeenAt  time.Time
+
+	// Set when the check_certificates rule has reported the problem, every problem is reported once.
+	ExpiryReportedAt *time.Time
+	ChangeReportedAt *time.Time
+}
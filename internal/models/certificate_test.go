@@ -0,0 +1,38 @@
+package models
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSInfo(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	info := NewTLSInfo(&tls.ConnectionState{
+		Version:          tls.VersionTLS13,
+		CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+		PeerCertificates: []*x509.Certificate{srv.Certificate()},
+	})
+	require.NotNil(t, info)
+	require.NotNil(t, info.Leaf())
+	assert.Equal(t, info.Leaf().Fingerprint, info.LeafFingerprint)
+	assert.Contains(t, info.Leaf().SANs, "example.com")
+
+	// certificate details are not saved with the query
+	j, err := json.Marshal(info)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": "TLS 1.3", "cipher_suite": "TLS_AES_128_GCM_SHA256", "leaf_fingerprint": "`+info.LeafFingerprint+`"}`, string(j))
+
+	var loaded TLSInfo
+	require.NoError(t, json.Unmarshal(j, &loaded))
+	assert.Nil(t, loaded.Leaf())
+
+	assert.Nil(t, NewTLSInfo(&tls.ConnectionState{}))
+}
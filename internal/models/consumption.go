@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// ConsumptionSnapshot is a point-in-time copy of the consumption metrics reported by the
+// provider for a project or one of its branches. Metrics are cumulative for the current
+// consumption period, so the usage between two snapshots is the difference of the values.
+type ConsumptionSnapshot struct {
+	ID uint `gorm:"primarykey"`
+	// Snapshots are looked up by (project_id, branch_id, created_at), e.g. the last one of the project.
+	CreatedAt time.Time `gorm:"index:idx_consumption_snapshots_series,priority:3"`
+
+	// ProjectID is a foreign key to the project.
+	ProjectID uint `gorm:"index:idx_consumption_snapshots_series,priority:1"`
+
+	// Provider ID of the branch, empty for the project totals.
+	BranchID string `gorm:"index:idx_consumption_snapshots_series,priority:2"`
+
+	// The node that collected the snapshot.
+	Exitnode string
+
+	// State of the read-write endpoint of the branch at the collection time, e.g. "idle".
+	// For the project totals it's the state of the default endpoint.
+	EndpointState string
+
+	ComputeTimeSeconds int64
+	ActiveTimeSeconds  int64
+	CPUUsedSec         int64
+	WrittenDataBytes   int64
+	DataTransferBytes  int64
+
+	// Only for the project totals.
+	DataStorageBytesHour   int64
+	SyntheticStorageSize   int64
+	LogicalSizeLimitBytes  int64
+	ConsumptionPeriodStart *time.Time
+
+	// Only for branches.
+	LogicalSize int64
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// ProjectMode is a definition of a mode, see Project.CurrentMode. When a project switches to the mode,
+// change_mode applies the endpoint settings, and query_project runs only the allowed scenarios.
+// Modes without a definition are plain labels.
+type ProjectMode struct {
+	Name      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Endpoint settings of the mode, nil settings are not changed.
+	SuspendTimeoutSeconds *int
+	AutoscalingMinCu      *float64
+	AutoscalingMaxCu      *float64
+	PoolerEnabled         *bool
+	// Pooler mode, e.g. "transaction".
+	PoolerMode *string
+
+	// Names of query_project scenarios allowed in the mode. Empty allows all scenarios.
+	Scenarios []string `gorm:"type:jsonb;serializer:json"`
+}
+
+// HasEndpointSettings returns true if the mode changes any endpoint setting.
+func (m *ProjectMode) HasEndpointSettings() bool {
+	return m.SuspendTimeoutSeconds != nil ||
+		m.AutoscalingMinCu != nil ||
+		m.AutoscalingMaxCu != nil ||
+		m.PoolerEnabled != nil ||
+		m.PoolerMode != nil
+}
+
+// AllowsScenario returns true if the scenario can be executed in projects of the mode.
+func (m *ProjectMode) AllowsScenario(scenario string) bool {
+	if len(m.Scenarios) == 0 {
+		return true
+	}
+	for _, name := range m.Scenarios {
+		if name == scenario {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectMode_AllowsScenario(t *testing.T) {
+	mode := ProjectMode{Name: "any"}
+	assert.True(t, mode.AllowsScenario("activityV1"))
+	assert.False(t, mode.HasEndpointSettings())
+
+	timeout := 0
+	mode = ProjectMode{Name: "always-on", SuspendTimeoutSeconds: &timeout, Scenarios: []string{"alwaysOn"}}
+	assert.True(t, mode.AllowsScenario("alwaysOn"))
+	assert.False(t, mode.AllowsScenario("activityV1"))
+	assert.True(t, mode.HasEndpointSettings())
+}
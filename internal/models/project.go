@@ -24,9 +24,19 @@ type Project struct {
 	// ConnectionString to the main branch.
 	ConnectionString string
 
+	// MainBranchID is the provider ID of the default branch. Empty for old projects.
+	MainBranchID string
+
+	// EndpointID is the provider ID of the read-write endpoint of the default branch.
+	// Empty for old projects, can be parsed from the connection string.
+	EndpointID string
+
 	// Taken from `EXITNODE` environment variable.
 	CreatedByExitnode string
 
+	// Name of the API account that owns the project, empty for the default account (NEON_API_KEY).
+	NeonAccount string
+
 	// Specified at the creation time.
 	PgVersion int
 
@@ -36,15 +46,55 @@ type Project struct {
 	// Default endpoint will be shut down after this timeout.
 	SuspendTimeoutSeconds int
 
+	// Autoscaling limits of the default endpoint, in compute units. Zero for old projects.
+	AutoscalingMinCu float64
+	AutoscalingMaxCu float64
+
+	// Number of read replicas requested at the creation time, they are created when the project is ready.
+	ReadReplicas int
+
 	// Mode name, which is used by rules to define query strategy.
 	CurrentMode string
 
+	// State of the project lifecycle, one of ProjectXXX. It's written before every step of
+	// creation and deletion, so that projects interrupted by a crash can be recovered.
+	// Only ready projects are queried by the rules.
+	State string `gorm:"not null;default:ready;index"`
+
 	// TODO:
 	// Comment about a policy of creation.
 	// CreationComment string
 
-	// Comment about a policy of deletion.
-	// DeletionComment string
+	// Reason of the deletion, e.g. the delete_project policy that selected the project.
+	DeletionComment string
+}
+
+// Project lifecycle states.
+//
+//	creating -> configuring -> ready -> deleting -> deleted
+//	    |            |                     |
+//	    +-> failed <-+                     +-> delete_failed
+const (
+	// The row is written, the project is being created in Neon. ProjectID is empty until the API responds.
+	ProjectCreating = "creating"
+	// The project exists in Neon, endpoint settings are being applied.
+	ProjectConfiguring = "configuring"
+	ProjectReady       = "ready"
+	// Creation or configuration has failed. The project can still exist in Neon, if ProjectID is set,
+	// the failed policy of delete_project deletes it.
+	ProjectFailed = "failed"
+	// The project is being deleted in Neon.
+	ProjectDeleting = "deleting"
+	// The project is deleted in Neon, the row is soft-deleted.
+	ProjectDeleted = "deleted"
+	// The API call to delete the project has failed, the project still exists in Neon.
+	// The failed policy of delete_project retries the deletion.
+	ProjectDeleteFailed = "delete_failed"
+)
+
+// Returns true if the state is an unfinished step of creation or deletion.
+func IsIntermediateProjectState(state string) bool {
+	return state == ProjectCreating || state == ProjectConfiguring || state == ProjectDeleting
 }
 
 func (p *Project) SuspendTimeout() time.Duration {
@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
 
 type QueryDestination string
 
@@ -9,6 +14,25 @@ const (
 	QueryDB QueryDestination = "db"
 	// Request to the HTTP API
 	QueryAPI QueryDestination = "api"
+	// Check performed by a rule, doesn't send anything to the network
+	QueryCheck QueryDestination = "check"
+	// Request to a relay, which executes database queries on our behalf.
+	// Queries returned by the relay are related to this one.
+	QueryRelay QueryDestination = "relay"
+)
+
+// QueryState tells why the query finished.
+type QueryState string
+
+const (
+	// Query finished without errors.
+	QuerySucceeded QueryState = "succeeded"
+	// Query was failed by the server or the network.
+	QueryFailed QueryState = "failed"
+	// Query didn't finish before the deadline.
+	QueryTimedOut QueryState = "timed_out"
+	// Query was cancelled by us, e.g. because of a shutdown.
+	QueryCancelled QueryState = "cancelled"
 )
 
 type Query struct {
@@ -22,16 +46,22 @@ type Query struct {
 	// RegionID is a foreign key to the region.
 	RegionID uint
 
+	// For DB queries to a non-default branch it's the ID of the branch, see Branch.
+	BranchID *uint
+
 	// The node that executed the query.
 	Exitnode string
 
 	// Project mode at the moment of query execution.
 	ProjectMode string
 
+	// Name of the connection string variant used for DB queries, see rules.ConnVariant.
+	ConnVariant string
+
 	// Usually refers to a connection establishment query.
 	RelatedQueryID *uint
 
-	// Query to "api" or "db".
+	// Query to "api" or "db", or a "check" done by a rule.
 	Kind QueryDestination
 
 	// For API queries it's the full URL of the API endpoint.
@@ -49,10 +79,36 @@ type Query struct {
 	// What was sent to the node. SQL query or HTTP request body.
 	Request string
 
+	// HTTP client configuration used for the request, e.g. "http2,keepalive,gzip".
+	// Empty for queries that don't use HTTP.
+	HTTPMode string
+
+	// Information about the connection used by the query, if available.
+	Meta *QueryMeta `gorm:"type:jsonb;serializer:json"`
+
 	// Result is available only for finished queries.
 	QueryResult
 }
 
+// QueryMeta identifies the server instance that handled the query.
+// Can be used to group failures by proxy instance.
+type QueryMeta struct {
+	// Host the driver connected to.
+	Host string `json:"host,omitempty"`
+	// Addresses the host was resolved to. Empty if the connection was reused.
+	ResolvedIPs []string `json:"resolved_ips,omitempty"`
+	// Address the driver actually connected to, "ip:port".
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Local address of the connection, "ip:port".
+	LocalAddr string `json:"local_addr,omitempty"`
+	// Response headers that identify the server, e.g. "Server" or "Via".
+	ServerHeaders map[string]string `json:"server_headers,omitempty"`
+	// TLS connection details, nil for plaintext connections.
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// HTTP status code of the response, 0 if there was no response.
+	HTTPStatus int `json:"http_status,omitempty"`
+}
+
 // QueryResult is available only for finished queries.
 type QueryResult struct {
 	// IsFinished is true if the query is fully finished, and no process
@@ -67,10 +123,15 @@ type QueryResult struct {
 	StartedAt *time.Time
 	// Timestamp when the query was finished.
 	FinishedAt *time.Time
-	// IsFailed is true if the query is failed.
+	// IsFailed is true if the query is failed or timed out. Cancelled queries are not failed.
 	IsFailed bool
+	// State tells apart successful, failed, timed out and cancelled queries.
+	// Empty for queries saved before the field was added.
+	State QueryState
 	// Duration is the duration of the query.
 	Duration *time.Duration
+	// HTTPConnReused is true if the HTTP request was sent over an existing connection.
+	HTTPConnReused *bool
 }
 
 func QueryDuration(ns *int64) *time.Duration {
@@ -80,3 +141,64 @@ func QueryDuration(ns *int64) *time.Duration {
 	d := time.Duration(*ns)
 	return &d
 }
+
+// SetError sets the final state of the result. Context is used to tell cancellations
+// and timeouts apart from errors returned by the server.
+func (r *QueryResult) SetError(ctx context.Context, err error) {
+	r.State = ErrorState(ctx, err)
+	if err == nil {
+		return
+	}
+	r.Error = err.Error()
+	r.IsFailed = r.State != QueryCancelled
+}
+
+type ruleDeadlineKey struct{}
+
+// WithRuleDeadline marks the deadline of ctx as the deadline of the rule execution, set by the scheduler.
+// Queries cut off by this deadline are recorded as cancelled, not as timed out.
+func WithRuleDeadline(ctx context.Context) context.Context {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, ruleDeadlineKey{}, deadline)
+}
+
+// Returns true if the deadline of ctx is the rule deadline, not a shorter timeout of the query.
+func isRuleDeadline(ctx context.Context) bool {
+	ruleDeadline, ok := ctx.Value(ruleDeadlineKey{}).(time.Time)
+	if !ok {
+		return false
+	}
+	deadline, _ := ctx.Deadline()
+	return !deadline.Before(ruleDeadline)
+}
+
+// ErrorState returns the state of the query finished with err.
+func ErrorState(ctx context.Context, err error) QueryState {
+	if err == nil {
+		return QuerySucceeded
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		if isRuleDeadline(ctx) {
+			return QueryCancelled
+		}
+		return QueryTimedOut
+	case errors.Is(ctx.Err(), context.Canceled):
+		return QueryCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return QueryTimedOut
+	case errors.Is(err, context.Canceled):
+		return QueryCancelled
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return QueryTimedOut
+	}
+
+	return QueryFailed
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryResult_SetError(t *testing.T) {
+	ctx := context.Background()
+
+	var res QueryResult
+	res.SetError(ctx, nil)
+	assert.Equal(t, QuerySucceeded, res.State)
+	assert.False(t, res.IsFailed)
+
+	res = QueryResult{}
+	res.SetError(ctx, errors.New("bad status code 500"))
+	assert.Equal(t, QueryFailed, res.State)
+	assert.True(t, res.IsFailed)
+
+	res = QueryResult{}
+	res.SetError(ctx, fmt.Errorf("request: %w", context.DeadlineExceeded))
+	assert.Equal(t, QueryTimedOut, res.State)
+	assert.True(t, res.IsFailed)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	res = QueryResult{}
+	res.SetError(cancelled, errors.New("connection reset"))
+	assert.Equal(t, QueryCancelled, res.State)
+	assert.False(t, res.IsFailed)
+	assert.Equal(t, "connection reset", res.Error)
+
+	expired, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	res = QueryResult{}
+	res.SetError(expired, errors.New("connection reset"))
+	assert.Equal(t, QueryTimedOut, res.State)
+
+	// cut off by the rule deadline
+	ruleCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	ruleCtx = WithRuleDeadline(ruleCtx)
+	queryCtx, cancel := context.WithTimeout(ruleCtx, time.Hour)
+	defer cancel()
+	<-queryCtx.Done()
+	res = QueryResult{}
+	res.SetError(queryCtx, fmt.Errorf("query: %w", context.DeadlineExceeded))
+	assert.Equal(t, QueryCancelled, res.State)
+	assert.False(t, res.IsFailed)
+
+	// the query timeout is shorter than the rule deadline
+	ruleCtx, cancel = context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	ruleCtx = WithRuleDeadline(ruleCtx)
+	queryCtx, cancel = context.WithTimeout(ruleCtx, time.Nanosecond)
+	defer cancel()
+	<-queryCtx.Done()
+	res = QueryResult{}
+	res.SetError(queryCtx, fmt.Errorf("query: %w", context.DeadlineExceeded))
+	assert.Equal(t, QueryTimedOut, res.State)
+}
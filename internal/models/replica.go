@@ -0,0 +1,20 @@
+package models
+
+import "gorm.io/gorm"
+
+// ReadReplica is a read-only endpoint on the default branch of a project.
+type ReadReplica struct {
+	gorm.Model
+
+	// ProjectID is a foreign key to the project.
+	ProjectID uint `gorm:"index"`
+
+	// EndpointID is given by the provider.
+	EndpointID string
+
+	// ConnectionString to the read-only endpoint.
+	ConnectionString string
+
+	// Taken from `EXITNODE` environment variable.
+	CreatedByExitnode string
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
 )
@@ -20,22 +25,96 @@ import (
 type Client struct {
 	baseURL    string
 	authHeader string
+	httpClient *httpclient.Client
+	retry      RetryPolicy
+	// Projects are created and listed in this organization, if set.
+	orgID string
 }
 
-func NewClient(domain string, apiKey string) *Client {
+// NewClient creates a client for the API at domain. If httpClient is nil, httpclient.Default is used.
+// Requests are retried according to DefaultRetryPolicy, see WithRetryPolicy.
+func NewClient(domain string, apiKey string, httpClient *httpclient.Client) *Client {
+	return NewClientWithURL(fmt.Sprintf("https://%s/api/v2", domain), apiKey, httpClient)
+}
+
+// NewClientWithURL creates a client for the API at baseURL, e.g. a local fake.
+func NewClientWithURL(baseURL string, apiKey string, httpClient *httpclient.Client) *Client {
+	if httpClient == nil {
+		httpClient = httpclient.Default
+	}
 	return &Client{
-		baseURL:    fmt.Sprintf("https://%s/api/v2", domain),
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
 		authHeader: fmt.Sprintf("Bearer %s", apiKey),
+		httpClient: httpClient,
+		retry:      DefaultRetryPolicy,
 	}
 }
 
+// WithRetryPolicy returns a copy of the client with the given retry policy.
+func (c *Client) WithRetryPolicy(policy RetryPolicy) *Client {
+	cli := *c
+	cli.retry = policy
+	return &cli
+}
+
+// WithOrgID returns a copy of the client that manages projects of the organization.
+func (c *Client) WithOrgID(orgID string) *Client {
+	cli := *c
+	cli.orgID = orgID
+	return &cli
+}
+
 func (c *Client) CreateProject(req *CreateProject) (*Prepared[CreateProjectResponse], error) {
 	// https://api-docs.neon.tech/reference/createproject
+	if req.OrgID == "" && c.orgID != "" {
+		reqCopy := *req
+		reqCopy.OrgID = c.orgID
+		req = &reqCopy
+	}
 	return prepare[CreateProjectResponse](c, "CreateProject", "POST", "/projects", &CreateProjectRequest{
 		Project: req,
 	})
 }
 
+// ListProjects returns a page of projects. Empty cursor means the first page, empty search means all projects.
+func (c *Client) ListProjects(cursor string, limit int, search string) (*Prepared[ListProjectsResponse], error) {
+	// https://api-docs.neon.tech/reference/listprojects
+	params := url.Values{}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if search != "" {
+		params.Set("search", search)
+	}
+	if c.orgID != "" {
+		params.Set("org_id", c.orgID)
+	}
+
+	path := "/projects"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	return prepare[ListProjectsResponse](c, "ListProjects", "GET", path, nil)
+}
+
+func (c *Client) GetProject(projectID string) (*Prepared[GetProjectResponse], error) {
+	// https://api-docs.neon.tech/reference/getproject
+	return prepare[GetProjectResponse](c, "GetProject", "GET", fmt.Sprintf("/projects/%s", projectID), nil)
+}
+
+func (c *Client) GetConnectionURI(projectID string, databaseName string, roleName string) (*Prepared[ConnectionURIResponse], error) {
+	// https://api-docs.neon.tech/reference/getconnectionuri
+	params := url.Values{}
+	params.Set("database_name", databaseName)
+	params.Set("role_name", roleName)
+	return prepare[ConnectionURIResponse](
+		c, "GetConnectionURI", "GET", fmt.Sprintf("/projects/%s/connection_uri?%s", projectID, params.Encode()), nil,
+	)
+}
+
 func (c *Client) DeleteProject(projectID string) (*Prepared[DeleteProjectResponse], error) {
 	// https://api-docs.neon.tech/reference/deleteproject
 	return prepare[DeleteProjectResponse](c, "DeleteProject", "DELETE", fmt.Sprintf("/projects/%s", projectID), nil)
@@ -54,11 +133,132 @@ func (c *Client) UpdateEndpoint(projectID string, endpointID string, update *Upd
 	)
 }
 
+func (c *Client) CreateEndpoint(projectID string, req *CreateEndpoint) (*Prepared[EndpointOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/createprojectendpoint
+	return prepare[EndpointOperationsResponse](
+		c, "CreateEndpoint", "POST", fmt.Sprintf("/projects/%s/endpoints", projectID), &CreateEndpointRequest{
+			Endpoint: req,
+		},
+	)
+}
+
+func (c *Client) GetEndpoint(projectID string, endpointID string) (*Prepared[GetEndpointResponse], error) {
+	// https://api-docs.neon.tech/reference/getprojectendpoint
+	return prepare[GetEndpointResponse](
+		c, "GetEndpoint", "GET", fmt.Sprintf("/projects/%s/endpoints/%s", projectID, endpointID), nil,
+	)
+}
+
+func (c *Client) ListEndpoints(projectID string) (*Prepared[ListEndpointsResponse], error) {
+	// https://api-docs.neon.tech/reference/listprojectendpoints
+	return prepare[ListEndpointsResponse](c, "ListEndpoints", "GET", fmt.Sprintf("/projects/%s/endpoints", projectID), nil)
+}
+
+func (c *Client) StartEndpoint(projectID string, endpointID string) (*Prepared[EndpointOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/startprojectendpoint
+	return prepare[EndpointOperationsResponse](
+		c, "StartEndpoint", "POST", fmt.Sprintf("/projects/%s/endpoints/%s/start", projectID, endpointID), nil,
+	)
+}
+
+func (c *Client) SuspendEndpoint(projectID string, endpointID string) (*Prepared[EndpointOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/suspendprojectendpoint
+	return prepare[EndpointOperationsResponse](
+		c, "SuspendEndpoint", "POST", fmt.Sprintf("/projects/%s/endpoints/%s/suspend", projectID, endpointID), nil,
+	)
+}
+
+func (c *Client) RestartEndpoint(projectID string, endpointID string) (*Prepared[EndpointOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/restartprojectendpoint
+	return prepare[EndpointOperationsResponse](
+		c, "RestartEndpoint", "POST", fmt.Sprintf("/projects/%s/endpoints/%s/restart", projectID, endpointID), nil,
+	)
+}
+
 func (c *Client) GetOperations(projectID string) (*Prepared[GetOperationsResponse], error) {
 	// https://api-docs.neon.tech/reference/listprojectoperations
 	return prepare[GetOperationsResponse](c, "GetOperations", "GET", fmt.Sprintf("/projects/%s/operations", projectID), nil)
 }
 
+func (c *Client) GetOperation(projectID string, operationID string) (*Prepared[GetOperationResponse], error) {
+	// https://api-docs.neon.tech/reference/getprojectoperation
+	return prepare[GetOperationResponse](
+		c, "GetOperation", "GET", fmt.Sprintf("/projects/%s/operations/%s", projectID, operationID), nil,
+	)
+}
+
+func (c *Client) CreateBranch(projectID string, req *CreateBranchRequest) (*Prepared[CreateBranchResponse], error) {
+	// https://api-docs.neon.tech/reference/createprojectbranch
+	return prepare[CreateBranchResponse](c, "CreateBranch", "POST", fmt.Sprintf("/projects/%s/branches", projectID), req)
+}
+
+func (c *Client) ListBranches(projectID string) (*Prepared[ListBranchesResponse], error) {
+	// https://api-docs.neon.tech/reference/listprojectbranches
+	return prepare[ListBranchesResponse](c, "ListBranches", "GET", fmt.Sprintf("/projects/%s/branches", projectID), nil)
+}
+
+func (c *Client) GetBranch(projectID string, branchID string) (*Prepared[GetBranchResponse], error) {
+	// https://api-docs.neon.tech/reference/getprojectbranch
+	return prepare[GetBranchResponse](
+		c, "GetBranch", "GET", fmt.Sprintf("/projects/%s/branches/%s", projectID, branchID), nil,
+	)
+}
+
+func (c *Client) DeleteBranch(projectID string, branchID string) (*Prepared[BranchOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/deleteprojectbranch
+	return prepare[BranchOperationsResponse](
+		c, "DeleteBranch", "DELETE", fmt.Sprintf("/projects/%s/branches/%s", projectID, branchID), nil,
+	)
+}
+
+func (c *Client) RestoreBranch(projectID string, branchID string, req *RestoreBranchRequest) (*Prepared[BranchOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/restoreprojectbranch
+	return prepare[BranchOperationsResponse](
+		c, "RestoreBranch", "POST", fmt.Sprintf("/projects/%s/branches/%s/restore", projectID, branchID), req,
+	)
+}
+
+func (c *Client) ListRoles(projectID string, branchID string) (*Prepared[ListRolesResponse], error) {
+	// https://api-docs.neon.tech/reference/listprojectbranchroles
+	return prepare[ListRolesResponse](
+		c, "ListRoles", "GET", fmt.Sprintf("/projects/%s/branches/%s/roles", projectID, branchID), nil,
+	)
+}
+
+func (c *Client) CreateRole(projectID string, branchID string, req *CreateRole) (*Prepared[RoleOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/createprojectbranchrole
+	return prepare[RoleOperationsResponse](
+		c, "CreateRole", "POST", fmt.Sprintf("/projects/%s/branches/%s/roles", projectID, branchID), &CreateRoleRequest{
+			Role: req,
+		},
+	)
+}
+
+// ResetRolePassword sets a new random password for the role, the password is returned in the response.
+func (c *Client) ResetRolePassword(projectID string, branchID string, roleName string) (*Prepared[RoleOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/resetprojectbranchrolepassword
+	return prepare[RoleOperationsResponse](
+		c, "ResetRolePassword", "POST",
+		fmt.Sprintf("/projects/%s/branches/%s/roles/%s/reset_password", projectID, branchID, url.PathEscape(roleName)), nil,
+	)
+}
+
+func (c *Client) ListDatabases(projectID string, branchID string) (*Prepared[ListDatabasesResponse], error) {
+	// https://api-docs.neon.tech/reference/listprojectbranchdatabases
+	return prepare[ListDatabasesResponse](
+		c, "ListDatabases", "GET", fmt.Sprintf("/projects/%s/branches/%s/databases", projectID, branchID), nil,
+	)
+}
+
+func (c *Client) CreateDatabase(projectID string, branchID string, req *CreateDatabase) (*Prepared[DatabaseOperationsResponse], error) {
+	// https://api-docs.neon.tech/reference/createprojectbranchdatabase
+	return prepare[DatabaseOperationsResponse](
+		c, "CreateDatabase", "POST", fmt.Sprintf("/projects/%s/branches/%s/databases", projectID, branchID), &CreateDatabaseRequest{
+			Database: req,
+		},
+	)
+}
+
 type Prepared[T any] struct {
 	cli       *Client
 	method    string
@@ -96,6 +296,7 @@ func (p *Prepared[T]) Query(projectID *uint, regionID uint, exitnode string) *mo
 		Driver:      "go-neonapi",
 		Method:      p.apiMethod,
 		Request:     string(p.body),
+		HTTPMode:    p.cli.httpClient.Mode,
 		QueryResult: models.QueryResult{},
 	}
 }
@@ -104,7 +305,78 @@ func (p *Prepared[T]) QueryNoArgs() *models.Query {
 	return p.Query(nil, 0, "")
 }
 
+// WithRetryPolicy returns a copy of the request, sent with the given retry policy.
+func (p *Prepared[T]) WithRetryPolicy(policy RetryPolicy) *Prepared[T] {
+	cp := *p
+	cp.cli = p.cli.WithRetryPolicy(policy)
+	return &cp
+}
+
+// RetryPolicy returns the retry policy of the request.
+func (p *Prepared[T]) RetryPolicy() RetryPolicy {
+	return p.cli.retry
+}
+
+// RetryDelay returns the delay before the next attempt, and false if the failed attempt
+// shouldn't be retried. Attempts are counted from 1.
+func (p *Prepared[T]) RetryDelay(attempt int, err error) (time.Duration, bool) {
+	return p.cli.retry.RetryDelay(p.method, attempt, err)
+}
+
+// Hooks are called for every attempt of Prepared.DoWithHooks, e.g. to save every attempt as a query.
+// An error returned by a hook stops the retries and is returned to the caller.
+type Hooks struct {
+	// Called before the attempt is sent. Attempts are counted from 1.
+	Before func(attempt int) error
+	// Called with the result of the attempt.
+	After func(attempt int, result *models.QueryResult) error
+}
+
+// Do sends the request, retrying according to the client retry policy. Returns the result of the last attempt.
 func (p *Prepared[T]) Do(ctx context.Context) (*T, *models.QueryResult, error) {
+	return p.DoWithHooks(ctx, Hooks{})
+}
+
+// DoWithHooks is Do, which calls the hooks for every attempt.
+func (p *Prepared[T]) DoWithHooks(ctx context.Context, hooks Hooks) (*T, *models.QueryResult, error) {
+	for attempt := 1; ; attempt++ {
+		if hooks.Before != nil {
+			if err := hooks.Before(attempt); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		resp, result, err := p.attempt(ctx)
+		if hooks.After != nil {
+			if hookErr := hooks.After(attempt, result); hookErr != nil {
+				return resp, result, errors.Join(err, hookErr)
+			}
+		}
+
+		delay, retry := p.RetryDelay(attempt, err)
+		if !retry {
+			return resp, result, err
+		}
+
+		log.Warn(
+			ctx,
+			"retrying API request",
+			zap.String("method", p.apiMethod),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, result, errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Makes a single attempt.
+func (p *Prepared[T]) attempt(ctx context.Context) (*T, *models.QueryResult, error) {
 	result := &models.QueryResult{
 		IsFinished: true,
 		Response:   "",
@@ -117,9 +389,8 @@ func (p *Prepared[T]) Do(ctx context.Context) (*T, *models.QueryResult, error) {
 
 	var responseObj T
 	err := p.do(ctx, &responseObj, result)
+	result.SetError(ctx, err)
 	if err != nil {
-		result.Error = err.Error()
-		result.IsFailed = true
 		return nil, result, err
 	}
 
@@ -140,8 +411,12 @@ func (p *Prepared[T]) do(ctx context.Context, responseObj any, result *models.Qu
 		reader = bytes.NewReader(p.body)
 	}
 
-	// TODO: set context
-	req, err := http.NewRequestWithContext(context.Background(), p.method, p.fullURL, reader)
+	traceCtx, trace := httpclient.WithTrace(ctx)
+	defer func() {
+		result.HTTPConnReused = trace.ConnReused
+	}()
+
+	req, err := http.NewRequestWithContext(traceCtx, p.method, p.fullURL, reader)
 	if err != nil {
 		return err
 	}
@@ -152,8 +427,7 @@ func (p *Prepared[T]) do(ctx context.Context, responseObj any, result *models.Qu
 	startedAt := time.Now()
 	result.StartedAt = &startedAt
 
-	// TODO: custom client
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.cli.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -178,7 +452,7 @@ func (p *Prepared[T]) do(ctx context.Context, responseObj any, result *models.Qu
 	)
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("got status code %d, body = %s", resp.StatusCode, body)
+		return newAPIError(resp, body, finishedAt)
 	}
 
 	err = json.Unmarshal(body, responseObj)
@@ -5,6 +5,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/petuhovskiy/neon-lights/internal/log"
 )
 
@@ -13,7 +15,7 @@ func testClient(t *testing.T) *Client {
 	if apiKey == "" {
 		t.Skip("NEON_API_KEY is not set")
 	}
-	return NewClient("console-stage.neon.build", apiKey)
+	return NewClient("console-stage.neon.build", apiKey, nil)
 }
 
 // Run with `export $(cat .env | xargs) && go test ./... -v -run TestCreateProject`
@@ -46,3 +48,33 @@ func TestCreateProject(t *testing.T) {
 	t.Logf("Project ID: %s", resp.Project.ID)
 	t.Logf("Result: %#+v", result)
 }
+
+func TestListProjects_url(t *testing.T) {
+	client := NewClient("console.neon.tech", "key", nil)
+
+	prep, err := client.ListProjects("", 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://console.neon.tech/api/v2/projects", prep.QueryNoArgs().Addr)
+
+	prep, err = client.ListProjects("cursor-1", 100, "test@node-")
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		"https://console.neon.tech/api/v2/projects?cursor=cursor-1&limit=100&search=test%40node-",
+		prep.QueryNoArgs().Addr,
+	)
+
+	prep, err = client.WithOrgID("org-abc-123").ListProjects("", 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://console.neon.tech/api/v2/projects?org_id=org-abc-123", prep.QueryNoArgs().Addr)
+}
+
+func TestCreateProject_orgID(t *testing.T) {
+	client := NewClient("console.neon.tech", "key", nil).WithOrgID("org-abc-123")
+
+	req := &CreateProject{Name: "test"}
+	prep, err := client.CreateProject(req)
+	assert.NoError(t, err)
+	assert.Contains(t, prep.QueryNoArgs().Request, `"org_id":"org-abc-123"`)
+	assert.Empty(t, req.OrgID, "request is not modified")
+}
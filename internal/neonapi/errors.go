@@ -0,0 +1,95 @@
+package neonapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Kinds of API errors, use errors.Is to check the returned error.
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrLocked        = errors.New("project has running operations")
+	ErrNotFound      = errors.New("not found")
+	ErrUnauthorized  = errors.New("unauthorized")
+)
+
+// APIError is returned when the API responds with a non-2xx status code.
+type APIError struct {
+	StatusCode int
+	// Fields of the error body, empty if the body is not a JSON error.
+	Code      string
+	Message   string
+	RequestID string
+	Body      string
+	// Parsed Retry-After header, 0 if not set.
+	RetryAfter time.Duration
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func newAPIError(resp *http.Response, body []byte, now time.Time) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), now),
+	}
+
+	var parsed errorBody
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		apiErr.Code = parsed.Code
+		apiErr.Message = parsed.Message
+		apiErr.RequestID = parsed.RequestID
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-Id")
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("got status code %d, body = %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf(
+		"got status code %d, code = %q, message = %q, request_id = %q",
+		e.StatusCode, e.Code, e.Message, e.RequestID,
+	)
+}
+
+// Error codes of the API error body that mean the account is out of quota.
+var quotaErrorCodes = []string{
+	"PROJECTS_LIMIT_EXCEEDED",
+	"BRANCHES_LIMIT_EXCEEDED",
+	"QUOTA_EXCEEDED",
+}
+
+// Kind returns one of the ErrXXX errors, or nil if the error is not classified.
+// Errors are classified by the status code and the error code, the message is not stable.
+func (e *APIError) Kind() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusLocked:
+		return ErrLocked
+	case e.StatusCode == http.StatusPaymentRequired,
+		// 429 is a rate limit, not a quota
+		e.StatusCode != http.StatusTooManyRequests && contains(quotaErrorCodes, e.Code):
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Is allows to match the error with errors.Is(err, ErrNotFound).
+func (e *APIError) Is(target error) bool {
+	kind := e.Kind()
+	return kind != nil && kind == target
+}
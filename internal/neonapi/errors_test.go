@@ -0,0 +1,51 @@
+package neonapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAPIError(statusCode int, body string) *APIError {
+	resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+	return newAPIError(resp, []byte(body), time.Now())
+}
+
+func TestAPIError_Kind(t *testing.T) {
+	err := testAPIError(http.StatusLocked, `{"code":"","message":"project already has running operations, scheduling of new ones is prohibited","request_id":"req-1"}`)
+	assert.Equal(t, "req-1", err.RequestID)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.ErrorIs(t, fmt.Errorf("update endpoint: %w", err), ErrLocked)
+	assert.False(t, errors.Is(err, ErrNotFound))
+
+	assert.ErrorIs(t, testAPIError(http.StatusNotFound, `{"message":"project not found"}`), ErrNotFound)
+	assert.ErrorIs(t, testAPIError(http.StatusUnauthorized, `{"message":"authentication required"}`), ErrUnauthorized)
+	assert.ErrorIs(t, testAPIError(http.StatusUnprocessableEntity, `{"code":"PROJECTS_LIMIT_EXCEEDED","message":"too many projects"}`), ErrQuotaExceeded)
+	assert.ErrorIs(t, testAPIError(http.StatusPaymentRequired, `{"message":"compute time quota exceeded"}`), ErrQuotaExceeded)
+
+	// messages are not classified
+	assert.Nil(t, testAPIError(http.StatusUnprocessableEntity, `{"message":"compute time quota exceeded"}`).Kind())
+	assert.Nil(t, testAPIError(http.StatusConflict, `{"message":"project already has running operations"}`).Kind())
+
+	rateLimit := testAPIError(http.StatusTooManyRequests, `{"code":"QUOTA_EXCEEDED","message":"rate limit exceeded"}`)
+	assert.Nil(t, rateLimit.Kind())
+
+	plain := testAPIError(http.StatusBadGateway, `<html>bad gateway</html>`)
+	assert.Nil(t, plain.Kind())
+	assert.Equal(t, "got status code 502, body = <html>bad gateway</html>", plain.Error())
+}
+
+func TestRetryPolicy_RetryDelay_locked(t *testing.T) {
+	p := DefaultRetryPolicy
+	_, ok := p.RetryDelay("POST", 1, testAPIError(http.StatusLocked, `{}`))
+	assert.True(t, ok)
+
+	// callers that wait for the operations themselves
+	p.RetryLocked = false
+	_, ok = p.RetryDelay("POST", 1, testAPIError(http.StatusLocked, `{}`))
+	assert.False(t, ok)
+}
@@ -37,11 +37,16 @@ type Project struct {
 	HistoryRetentionSeconds     int       `json:"history_retention_seconds"`
 	CreatedAt                   time.Time `json:"created_at"`
 	UpdatedAt                   time.Time `json:"updated_at"`
+	SyntheticStorageSize        int64     `json:"synthetic_storage_size"`
 	ConsumptionPeriodStart      time.Time `json:"consumption_period_start"`
 	ConsumptionPeriodEnd        time.Time `json:"consumption_period_end"`
 	OwnerID                     string    `json:"owner_id"`
 }
 
+type GetProjectResponse struct {
+	Project Project `json:"project"`
+}
+
 type ConnectionParameters struct {
 	Database   string `json:"database"`
 	Password   string `json:"password"`
@@ -86,20 +91,25 @@ type Operation struct {
 }
 
 type Branch struct {
-	ID                 string    `json:"id"`
-	ProjectID          string    `json:"project_id"`
-	Name               string    `json:"name"`
-	CurrentState       string    `json:"current_state"`
-	PendingState       string    `json:"pending_state"`
-	CreationSource     string    `json:"creation_source"`
-	Primary            bool      `json:"primary"`
-	CPUUsedSec         int       `json:"cpu_used_sec"`
-	ComputeTimeSeconds int       `json:"compute_time_seconds"`
-	ActiveTimeSeconds  int       `json:"active_time_seconds"`
-	WrittenDataBytes   int       `json:"written_data_bytes"`
-	DataTransferBytes  int       `json:"data_transfer_bytes"`
-	CreatedAt          time.Time `json:"created_at"`
-	UpdatedAt          time.Time `json:"updated_at"`
+	ID                 string     `json:"id"`
+	ProjectID          string     `json:"project_id"`
+	ParentID           string     `json:"parent_id"`
+	ParentLSN          string     `json:"parent_lsn"`
+	ParentTimestamp    *time.Time `json:"parent_timestamp"`
+	Name               string     `json:"name"`
+	Default            bool       `json:"default"`
+	CurrentState       string     `json:"current_state"`
+	PendingState       string     `json:"pending_state"`
+	CreationSource     string     `json:"creation_source"`
+	Primary            bool       `json:"primary"`
+	CPUUsedSec         int        `json:"cpu_used_sec"`
+	ComputeTimeSeconds int        `json:"compute_time_seconds"`
+	ActiveTimeSeconds  int        `json:"active_time_seconds"`
+	WrittenDataBytes   int        `json:"written_data_bytes"`
+	DataTransferBytes  int        `json:"data_transfer_bytes"`
+	LogicalSize        int64      `json:"logical_size"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 }
 
 type Settings struct {
@@ -136,6 +146,16 @@ type CreateProject struct {
 
 	PgVersion   int    `json:"pg_version"`
 	Provisioner string `json:"provisioner"`
+	// Optional, the project is created in the personal account if not set.
+	OrgID string `json:"org_id,omitempty"`
+
+	// Optional, default settings are used if not set.
+	DefaultEndpointSettings *DefaultEndpointSettings `json:"default_endpoint_settings,omitempty"`
+}
+
+type DefaultEndpointSettings struct {
+	AutoscalingLimitMinCu float64 `json:"autoscaling_limit_min_cu,omitempty"`
+	AutoscalingLimitMaxCu float64 `json:"autoscaling_limit_max_cu,omitempty"`
 }
 
 type CreateProjectBranch struct {
@@ -176,7 +196,11 @@ type UpdateEndpointRequest struct {
 }
 
 type UpdateEndpoint struct {
-	SuspendTimeoutSeconds *int `json:"suspend_timeout_seconds"`
+	SuspendTimeoutSeconds *int     `json:"suspend_timeout_seconds,omitempty"`
+	AutoscalingLimitMinCu *float64 `json:"autoscaling_limit_min_cu,omitempty"`
+	AutoscalingLimitMaxCu *float64 `json:"autoscaling_limit_max_cu,omitempty"`
+	PoolerEnabled         *bool    `json:"pooler_enabled,omitempty"`
+	PoolerMode            *string  `json:"pooler_mode,omitempty"`
 }
 
 type UpdateEndpointResponse struct {
@@ -189,6 +213,130 @@ type GetOperationsResponse struct {
 	Pagination Pagination  `json:"pagination"`
 }
 
+type GetOperationResponse struct {
+	Operation Operation `json:"operation"`
+}
+
+type ListProjectsResponse struct {
+	Projects   []Project          `json:"projects"`
+	Pagination ProjectsPagination `json:"pagination"`
+}
+
+// ProjectsPagination has a cursor for the next page, which is the ID of the last project.
+type ProjectsPagination struct {
+	Cursor string `json:"cursor"`
+}
+
+type ConnectionURIResponse struct {
+	URI string `json:"uri"`
+}
+
 type Pagination struct {
 	Cursor time.Time `json:"cursor"`
 }
+
+type CreateBranchRequest struct {
+	Branch    *CreateBranch          `json:"branch"`
+	Endpoints []CreateBranchEndpoint `json:"endpoints,omitempty"`
+}
+
+// CreateBranch describes the branch point. Without parent ID the default branch is used,
+// without LSN and timestamp the branch is created from the parent head.
+type CreateBranch struct {
+	Name            string     `json:"name,omitempty"`
+	ParentID        string     `json:"parent_id,omitempty"`
+	ParentLSN       string     `json:"parent_lsn,omitempty"`
+	ParentTimestamp *time.Time `json:"parent_timestamp,omitempty"`
+}
+
+type CreateBranchEndpoint struct {
+	Type string `json:"type"`
+}
+
+type CreateBranchResponse struct {
+	Branch         Branch          `json:"branch"`
+	Endpoints      []Endpoint      `json:"endpoints"`
+	Operations     []Operation     `json:"operations"`
+	Roles          []Role          `json:"roles"`
+	Databases      []Database      `json:"databases"`
+	ConnectionUris []ConnectionURI `json:"connection_uris"`
+}
+
+type ListBranchesResponse struct {
+	Branches []Branch `json:"branches"`
+}
+
+type GetBranchResponse struct {
+	Branch Branch `json:"branch"`
+}
+
+type BranchOperationsResponse struct {
+	Branch     Branch      `json:"branch"`
+	Operations []Operation `json:"operations"`
+}
+
+// RestoreBranchRequest restores the branch to the state of the source branch.
+// Restoring to the parent branch resets the branch to the latest parent state.
+type RestoreBranchRequest struct {
+	SourceBranchID  string     `json:"source_branch_id"`
+	SourceLSN       string     `json:"source_lsn,omitempty"`
+	SourceTimestamp *time.Time `json:"source_timestamp,omitempty"`
+}
+
+type EndpointOperationsResponse struct {
+	Endpoint   Endpoint    `json:"endpoint"`
+	Operations []Operation `json:"operations"`
+}
+
+type GetEndpointResponse struct {
+	Endpoint Endpoint `json:"endpoint"`
+}
+
+type ListEndpointsResponse struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+type CreateEndpointRequest struct {
+	Endpoint *CreateEndpoint `json:"endpoint"`
+}
+
+type CreateEndpoint struct {
+	BranchID string `json:"branch_id"`
+	// "read_write" or "read_only"
+	Type string `json:"type"`
+}
+
+type ListRolesResponse struct {
+	Roles []Role `json:"roles"`
+}
+
+type CreateRoleRequest struct {
+	Role *CreateRole `json:"role"`
+}
+
+type CreateRole struct {
+	Name string `json:"name"`
+}
+
+type RoleOperationsResponse struct {
+	Role       Role        `json:"role"`
+	Operations []Operation `json:"operations"`
+}
+
+type ListDatabasesResponse struct {
+	Databases []Database `json:"databases"`
+}
+
+type CreateDatabaseRequest struct {
+	Database *CreateDatabase `json:"database"`
+}
+
+type CreateDatabase struct {
+	Name      string `json:"name"`
+	OwnerName string `json:"owner_name"`
+}
+
+type DatabaseOperationsResponse struct {
+	Database   Database    `json:"database"`
+	Operations []Operation `json:"operations"`
+}
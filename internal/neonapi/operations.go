@@ -0,0 +1,147 @@
+package neonapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Operation statuses reported by the API.
+const (
+	OperationStatusScheduling = "scheduling"
+	OperationStatusRunning    = "running"
+	OperationStatusFinished   = "finished"
+	OperationStatusFailed     = "failed"
+	OperationStatusError      = "error"
+	OperationStatusCancelling = "cancelling"
+	OperationStatusCancelled  = "cancelled"
+	OperationStatusSkipped    = "skipped"
+)
+
+// Kinds of operation errors, use errors.Is to check the returned error.
+var (
+	ErrOperationFailed    = errors.New("operation failed")
+	ErrOperationCancelled = errors.New("operation cancelled")
+	ErrOperationTimeout   = errors.New("operation is not finished in time")
+)
+
+// OperationError is returned when an operation ends with a non-successful status.
+type OperationError struct {
+	Operation Operation
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf(
+		"operation %s (%s) is %s after %d failures",
+		e.Operation.ID, e.Operation.Action, e.Operation.Status, e.Operation.FailuresCount,
+	)
+}
+
+// Is allows to match the error with errors.Is(err, ErrOperationFailed).
+func (e *OperationError) Is(target error) bool {
+	switch e.Operation.Status {
+	case OperationStatusFailed, OperationStatusError:
+		return target == ErrOperationFailed
+	case OperationStatusCancelled:
+		return target == ErrOperationCancelled
+	}
+	return false
+}
+
+// Done returns true if the operation will not change its status anymore.
+func (op *Operation) Done() bool {
+	switch op.Status {
+	case OperationStatusFinished, OperationStatusSkipped, OperationStatusFailed, OperationStatusError, OperationStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Err returns *OperationError if the operation is done, but not successful.
+func (op *Operation) Err() error {
+	if !op.Done() || op.Status == OperationStatusFinished || op.Status == OperationStatusSkipped {
+		return nil
+	}
+	return &OperationError{Operation: *op}
+}
+
+// Duration is the end-to-end duration of the operation, as reported by the API.
+func (op *Operation) Duration() time.Duration {
+	return op.UpdatedAt.Sub(op.CreatedAt)
+}
+
+// OperationFetcher returns the current state of the operation, e.g. using GetOperation.
+type OperationFetcher func(ctx context.Context, operationID string) (*Operation, error)
+
+// OperationWaiter polls operations until they are done.
+type OperationWaiter struct {
+	// Wait is failed with ErrOperationTimeout after this duration.
+	MaxWait time.Duration
+	// Interval between polls, increased by 1.5x for every poll.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+var DefaultOperationWaiter = OperationWaiter{
+	MaxWait:     10 * time.Minute,
+	MinInterval: time.Second,
+	MaxInterval: 30 * time.Second,
+}
+
+// Wait polls the operations until all of them are done. Returns the last seen state of every
+// operation, in the same order, and an error if any of the operations is not successful.
+// Operations are not polled if they are already done.
+func (w *OperationWaiter) Wait(ctx context.Context, ops []Operation, fetch OperationFetcher) ([]Operation, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.MaxWait)
+	defer cancel()
+
+	res := make([]Operation, len(ops))
+	copy(res, ops)
+
+	interval := w.MinInterval
+	for {
+		pending := 0
+		for i := range res {
+			if res[i].Done() {
+				continue
+			}
+			op, err := fetch(ctx, res[i].ID)
+			if err != nil {
+				return res, w.ctxErr(ctx, fmt.Errorf("failed to get operation %s: %w", res[i].ID, err))
+			}
+			res[i] = *op
+			if !op.Done() {
+				pending++
+			}
+		}
+
+		if pending == 0 {
+			var errs []error
+			for i := range res {
+				if err := res[i].Err(); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			return res, errors.Join(errs...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, w.ctxErr(ctx, fmt.Errorf("%d operations are pending", pending))
+		case <-time.After(interval):
+		}
+		interval += interval / 2
+		if interval > w.MaxInterval {
+			interval = w.MaxInterval
+		}
+	}
+}
+
+// Adds ErrOperationTimeout if the error is caused by MaxWait.
+func (w *OperationWaiter) ctxErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %w", ErrOperationTimeout, w.MaxWait, err)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package neonapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperation_Err(t *testing.T) {
+	op := &Operation{ID: "op-1", Status: OperationStatusRunning}
+	assert.False(t, op.Done())
+	assert.NoError(t, op.Err())
+
+	op.Status = OperationStatusFinished
+	assert.True(t, op.Done())
+	assert.NoError(t, op.Err())
+
+	op.Status = OperationStatusFailed
+	assert.ErrorIs(t, op.Err(), ErrOperationFailed)
+	assert.NotErrorIs(t, op.Err(), ErrOperationCancelled)
+
+	op.Status = OperationStatusCancelled
+	assert.ErrorIs(t, op.Err(), ErrOperationCancelled)
+}
+
+func TestOperationWaiter_Wait(t *testing.T) {
+	w := OperationWaiter{MaxWait: time.Second, MinInterval: time.Millisecond, MaxInterval: time.Millisecond}
+
+	// every operation is finished after 3 polls
+	polls := map[string]int{}
+	fetch := func(ctx context.Context, id string) (*Operation, error) {
+		polls[id]++
+		status := OperationStatusRunning
+		if polls[id] >= 3 {
+			status = OperationStatusFinished
+			if id == "op-fail" {
+				status = OperationStatusFailed
+			}
+		}
+		return &Operation{ID: id, Status: status}, nil
+	}
+
+	ops, err := w.Wait(context.Background(), []Operation{
+		{ID: "op-1", Status: OperationStatusScheduling},
+		{ID: "op-2", Status: OperationStatusFinished},
+	}, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, OperationStatusFinished, ops[0].Status)
+	assert.Equal(t, 3, polls["op-1"])
+	assert.Equal(t, 0, polls["op-2"])
+
+	_, err = w.Wait(context.Background(), []Operation{{ID: "op-fail"}}, fetch)
+	assert.ErrorIs(t, err, ErrOperationFailed)
+
+	// never finished
+	w.MaxWait = 10 * time.Millisecond
+	_, err = w.Wait(context.Background(), []Operation{{ID: "op-stuck"}}, func(ctx context.Context, id string) (*Operation, error) {
+		return &Operation{ID: id, Status: OperationStatusRunning}, nil
+	})
+	assert.ErrorIs(t, err, ErrOperationTimeout)
+
+	fetchErr := errors.New("fetch failed")
+	_, err = w.Wait(context.Background(), []Operation{{ID: "op-1"}}, func(ctx context.Context, id string) (*Operation, error) {
+		return nil, fetchErr
+	})
+	assert.ErrorIs(t, err, fetchErr)
+}
@@ -0,0 +1,124 @@
+package neonapi
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides which failed requests are retried and how long to wait before the next attempt.
+type RetryPolicy struct {
+	// Total number of attempts, including the first one. 1 disables retries.
+	MaxAttempts int
+	// Status codes retried for all methods. The request was rejected before
+	// any changes were made, e.g. 429 Too Many Requests.
+	RetryStatusCodes []int
+	// Retry 423 Locked, the project has running operations. Disabled by the callers
+	// that wait for the operations before the next attempt.
+	RetryLocked bool
+	// Status codes and transport errors are retried only for these methods,
+	// because the request could have been executed.
+	IdempotentMethods []string
+	// Status codes retried for idempotent methods, e.g. 502 Bad Gateway.
+	IdempotentStatusCodes []int
+	// Backoff before the second attempt, doubled for every next attempt.
+	MinBackoff time.Duration
+	// Backoff and Retry-After are capped by MaxBackoff.
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	RetryStatusCodes: []int{
+		http.StatusTooManyRequests,
+	},
+	RetryLocked:       true,
+	IdempotentMethods: []string{"GET", "PATCH", "DELETE"},
+	IdempotentStatusCodes: []int{
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+	MinBackoff: time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+// NoRetries makes exactly one attempt.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// RetryDelay returns the delay before the next attempt, and false if the request
+// shouldn't be retried. Attempts are counted from 1.
+func (p *RetryPolicy) RetryDelay(method string, attempt int, err error) (time.Duration, bool) {
+	if err == nil || attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	idempotent := contains(p.IdempotentMethods, method)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		retryable := contains(p.RetryStatusCodes, apiErr.StatusCode) ||
+			(p.RetryLocked && errors.Is(apiErr, ErrLocked)) ||
+			(idempotent && contains(p.IdempotentStatusCodes, apiErr.StatusCode))
+		if !retryable {
+			return 0, false
+		}
+		if apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > p.MaxBackoff {
+				return p.MaxBackoff, true
+			}
+			return apiErr.RetryAfter, true
+		}
+		return p.backoff(attempt), true
+	}
+
+	// transport errors, the request could have reached the server
+	if !idempotent {
+		return 0, false
+	}
+	return p.backoff(attempt), true
+}
+
+// Exponential backoff with jitter, in [d/2, d).
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// Parses Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func contains[T comparable](list []T, item T) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package neonapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+func TestRetryPolicy_RetryDelay(t *testing.T) {
+	p := DefaultRetryPolicy
+
+	locked := &APIError{StatusCode: http.StatusLocked}
+	delay, ok := p.RetryDelay("POST", 1, locked)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, delay, p.MinBackoff/2)
+	assert.Less(t, delay, p.MinBackoff)
+
+	_, ok = p.RetryDelay("POST", p.MaxAttempts, locked)
+	assert.False(t, ok)
+
+	// create could have been executed
+	badGateway := &APIError{StatusCode: http.StatusBadGateway}
+	_, ok = p.RetryDelay("POST", 1, badGateway)
+	assert.False(t, ok)
+	_, ok = p.RetryDelay("DELETE", 1, badGateway)
+	assert.True(t, ok)
+
+	_, ok = p.RetryDelay("GET", 1, &APIError{StatusCode: http.StatusNotFound})
+	assert.False(t, ok)
+
+	_, ok = p.RetryDelay("GET", 1, errors.New("connection reset by peer"))
+	assert.True(t, ok)
+	_, ok = p.RetryDelay("POST", 1, errors.New("connection reset by peer"))
+	assert.False(t, ok)
+
+	delay, ok = p.RetryDelay("POST", 1, &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second})
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, delay)
+
+	delay, ok = p.RetryDelay("POST", 1, &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour})
+	assert.True(t, ok)
+	assert.Equal(t, p.MaxBackoff, delay)
+
+	_, ok = NoRetries.RetryDelay("GET", 1, badGateway)
+	assert.False(t, ok)
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 7*time.Second, parseRetryAfter("7", now))
+	assert.Equal(t, 10*time.Second, parseRetryAfter("Mon, 01 Jan 2024 00:00:10 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Sun, 31 Dec 2023 00:00:10 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestPrepared_Do_apiError(t *testing.T) {
+	_ = log.DefaultGlobals()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"message":"rate limit exceeded"}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient("unused", "key", nil)
+	client.baseURL = srv.URL
+	client.retry = NoRetries
+
+	prep, err := client.GetOperations("project-id")
+	require.NoError(t, err)
+
+	_, result, err := prep.Do(context.Background())
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, 3*time.Second, apiErr.RetryAfter)
+	assert.Equal(t, models.QueryFailed, result.State)
+
+	// the default policy waits for Retry-After
+	policy := DefaultRetryPolicy
+	delay, ok := policy.RetryDelay("GET", 1, err)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+}
+
+func TestPrepared_DoWithHooks_retries(t *testing.T) {
+	_ = log.DefaultGlobals()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"operations":[]}`))
+	}))
+	defer srv.Close()
+
+	client := NewClientWithURL(srv.URL, "key", nil).WithRetryPolicy(RetryPolicy{
+		MaxAttempts:           3,
+		IdempotentMethods:     []string{"GET"},
+		IdempotentStatusCodes: []int{http.StatusServiceUnavailable},
+		MinBackoff:            time.Millisecond,
+		MaxBackoff:            time.Millisecond,
+	})
+	prep, err := client.GetOperations("project-id")
+	require.NoError(t, err)
+
+	var before []int
+	var states []models.QueryState
+	resp, result, err := prep.DoWithHooks(context.Background(), Hooks{
+		Before: func(attempt int) error {
+			before = append(before, attempt)
+			return nil
+		},
+		After: func(attempt int, result *models.QueryResult) error {
+			states = append(states, result.State)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, models.QuerySucceeded, result.State)
+	assert.Equal(t, []int{1, 2, 3}, before)
+	assert.Equal(t, []models.QueryState{models.QueryFailed, models.QueryFailed, models.QuerySucceeded}, states)
+
+	// hook errors stop the retries
+	requests.Store(0)
+	hookErr := errors.New("failed to save")
+	_, _, err = prep.DoWithHooks(context.Background(), Hooks{
+		After: func(attempt int, result *models.QueryResult) error { return hookErr },
+	})
+	assert.ErrorIs(t, err, hookErr)
+	assert.Equal(t, int32(1), requests.Load())
+}
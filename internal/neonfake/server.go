@@ -0,0 +1,871 @@
+// Package neonfake is an in-memory fake of the Neon control plane API, used in tests.
+// It implements projects, branches, endpoints, roles, databases and operations.
+// Operations are finished asynchronously, after Options.OperationDelay, and the project
+// is locked until then.
+package neonfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+)
+
+// Options of the fake server, zero values are valid.
+type Options struct {
+	// Operations are finished after this delay.
+	OperationDelay time.Duration
+	// Every request is delayed by this duration.
+	Latency time.Duration
+	// Creating more projects fails with a quota error, 0 means no limit.
+	MaxProjects int
+}
+
+const passwordPrefix = "fake-password-"
+
+type Server struct {
+	// URL is the API base URL, pass it to neonapi.NewClientWithURL.
+	URL string
+
+	opts   Options
+	server *httptest.Server
+
+	mu       sync.Mutex
+	seq      int
+	projects map[string]*project
+	// Statuses of the next failed requests.
+	failNext []int
+	// Number of the next operations that will fail.
+	failOps int
+}
+
+type project struct {
+	Project    neonapi.Project
+	Branches   map[string]*neonapi.Branch
+	Endpoints  map[string]*neonapi.Endpoint
+	Operations []*operation
+	// Role name => password, roles are shared by all branches.
+	Passwords map[string]string
+	// Database name => owner role name.
+	Databases map[string]string
+	Deleted   bool
+	// Consumption is accrued up to this time.
+	accruedAt time.Time
+}
+
+type operation struct {
+	neonapi.Operation
+	doneAt time.Time
+	failed bool
+	// Called when the operation is finished successfully.
+	apply func()
+}
+
+func NewServer(opts Options) *Server {
+	s := &Server{
+		opts:     opts,
+		projects: make(map[string]*project),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/api/v2"
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// FailNext makes the next n requests fail with the given status code.
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failNext = append(s.failNext, status)
+	}
+}
+
+// FailOperations makes the next n created operations end with the failed status.
+func (s *Server) FailOperations(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failOps += n
+}
+
+// AddProject creates a project without operations, e.g. to simulate a project
+// created by another process. Returns the project ID.
+func (s *Server) AddProject(name string, regionID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.createProject(&neonapi.CreateProject{Name: name, RegionID: regionID})
+	for _, op := range p.Operations {
+		s.finish(op, op.CreatedAt)
+	}
+	return p.Project.ID
+}
+
+// Project returns the project, false if it doesn't exist or is deleted.
+func (s *Server) Project(id string) (neonapi.Project, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.projects[id]
+	if !ok || p.Deleted {
+		return neonapi.Project{}, false
+	}
+	return p.Project, true
+}
+
+// Password returns the current password of the project role.
+func (s *Server) Password(projectID string, roleName string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.projects[projectID]
+	if !ok || p.Deleted {
+		return "", false
+	}
+	password, ok := p.Passwords[roleName]
+	return password, ok
+}
+
+// ProjectIDs returns IDs of all existing projects, sorted.
+func (s *Server) ProjectIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.projectIDs()
+}
+
+func (s *Server) projectIDs() []string {
+	var ids []string
+	for id, p := range s.projects {
+		if !p.Deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Server) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s-fake-%06d", prefix, s.seq)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Latency > 0 {
+		time.Sleep(s.opts.Latency)
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeError(w, http.StatusUnauthorized, "", "authentication required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.failNext) > 0 {
+		status := s.failNext[0]
+		s.failNext = s.failNext[1:]
+		writeError(w, status, "", "injected error")
+		return
+	}
+
+	s.refresh(time.Now())
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v2"), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "projects" {
+		writeError(w, http.StatusNotFound, "", "not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listProjects(w, r)
+		case http.MethodPost:
+			s.handleCreateProject(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		}
+		return
+	}
+
+	p, ok := s.projects[parts[1]]
+	if !ok || p.Deleted {
+		writeError(w, http.StatusNotFound, "", "project not found")
+		return
+	}
+
+	// project is locked while operations are running, deleting is always allowed
+	mutating := r.Method != http.MethodGet && !(len(parts) == 2 && r.Method == http.MethodDelete)
+	if mutating && p.locked() {
+		writeError(w, http.StatusLocked, "", "project already has running operations, scheduling of new ones is prohibited")
+		return
+	}
+
+	s.route(w, r, p, parts[2:])
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request, p *project, parts []string) {
+	route := r.Method + " " + strings.Join(routePattern(parts), "/")
+	switch route {
+	case "GET ":
+		writeJSON(w, http.StatusOK, map[string]any{"project": p.Project})
+	case "DELETE ":
+		p.Deleted = true
+		writeJSON(w, http.StatusOK, map[string]any{"project": p.Project})
+	case "GET operations":
+		s.listOperations(w, p)
+	case "GET operations/*":
+		s.getOperation(w, p, parts[1])
+	case "GET connection_uri":
+		s.connectionURI(w, r, p)
+	case "GET branches":
+		writeJSON(w, http.StatusOK, neonapi.ListBranchesResponse{Branches: sortedValues(p.Branches)})
+	case "POST branches":
+		s.createBranch(w, r, p)
+	case "GET branches/*", "DELETE branches/*", "POST branches/*/restore":
+		s.branch(w, r, p, parts)
+	case "GET branches/*/roles", "POST branches/*/roles", "POST branches/*/roles/*/reset_password":
+		s.roles(w, r, p, parts)
+	case "GET branches/*/databases", "POST branches/*/databases":
+		s.databases(w, r, p, parts)
+	case "GET endpoints":
+		writeJSON(w, http.StatusOK, neonapi.ListEndpointsResponse{Endpoints: sortedValues(p.Endpoints)})
+	case "POST endpoints":
+		s.createEndpoint(w, r, p)
+	case "GET endpoints/*", "PATCH endpoints/*", "POST endpoints/*/start",
+		"POST endpoints/*/suspend", "POST endpoints/*/restart":
+		s.endpoint(w, r, p, parts)
+	default:
+		writeError(w, http.StatusNotFound, "", "not found: "+route)
+	}
+}
+
+// Replaces IDs in the path with "*".
+func routePattern(parts []string) []string {
+	pattern := make([]string, len(parts))
+	for i, part := range parts {
+		if i%2 == 1 {
+			part = "*"
+		}
+		pattern[i] = part
+	}
+	return pattern
+}
+
+func (s *Server) listProjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cursor := query.Get("cursor")
+	search := query.Get("search")
+	limit := 10
+	if l := query.Get("limit"); l != "" {
+		if _, err := fmt.Sscanf(l, "%d", &limit); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "", "invalid limit")
+			return
+		}
+	}
+
+	resp := neonapi.ListProjectsResponse{Projects: []neonapi.Project{}}
+	for _, id := range s.projectIDs() {
+		if id <= cursor {
+			continue
+		}
+		p := s.projects[id].Project
+		if search != "" && !strings.Contains(p.Name, search) && !strings.Contains(p.ID, search) {
+			continue
+		}
+		resp.Projects = append(resp.Projects, p)
+		resp.Pagination.Cursor = p.ID
+		if len(resp.Projects) == limit {
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCreateProject(w http.ResponseWriter, r *http.Request) {
+	var req neonapi.CreateProjectRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Project == nil {
+		writeError(w, http.StatusBadRequest, "", "project is required")
+		return
+	}
+	if s.opts.MaxProjects > 0 && len(s.projectIDs()) >= s.opts.MaxProjects {
+		writeError(w, http.StatusUnprocessableEntity, "PROJECTS_LIMIT_EXCEEDED", "projects limit exceeded")
+		return
+	}
+
+	p := s.createProject(req.Project)
+	branch := p.mainBranch()
+	var endpoints []neonapi.Endpoint
+	for _, endpoint := range p.Endpoints {
+		endpoints = append(endpoints, *endpoint)
+	}
+
+	roleName := req.Project.Branch.RoleName
+	if roleName == "" {
+		roleName = "fake_owner"
+	}
+	p.Passwords[roleName] = passwordPrefix + p.Project.ID
+	p.Databases["neondb"] = roleName
+
+	writeJSON(w, http.StatusCreated, neonapi.CreateProjectResponse{
+		Project:        p.Project,
+		ConnectionUris: []neonapi.ConnectionURI{{ConnectionURI: p.connstr(endpoints[0].Host, roleName, "neondb")}},
+		Roles:          []neonapi.Role{{BranchID: branch.ID, Name: roleName, Password: p.Passwords[roleName]}},
+		Databases:      []neonapi.Database{{BranchID: branch.ID, Name: "neondb", OwnerName: roleName}},
+		Operations:     p.operations(),
+		Branch:         *branch,
+		Endpoints:      endpoints,
+	})
+}
+
+func (s *Server) createProject(req *neonapi.CreateProject) *project {
+	now := time.Now().UTC()
+	pgVersion := req.PgVersion
+	if pgVersion == 0 {
+		pgVersion = 15
+	}
+	provisioner := req.Provisioner
+	if provisioner == "" {
+		provisioner = "k8s-pod"
+	}
+
+	p := &project{
+		Project: neonapi.Project{
+			ID:          s.nextID("proj"),
+			Name:        req.Name,
+			RegionID:    req.RegionID,
+			PgVersion:   pgVersion,
+			Provisioner: provisioner,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		},
+		Branches:  make(map[string]*neonapi.Branch),
+		Endpoints: make(map[string]*neonapi.Endpoint),
+		Passwords: make(map[string]string),
+		Databases: make(map[string]string),
+		accruedAt: now,
+	}
+	s.projects[p.Project.ID] = p
+
+	branch := &neonapi.Branch{
+		ID:        s.nextID("br"),
+		ProjectID: p.Project.ID,
+		Name:      "main",
+		Default:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	p.Branches[branch.ID] = branch
+	s.addOperation(p, branch.ID, "", "create_timeline", nil)
+
+	endpoint := s.newEndpoint(p, branch.ID, "read_write")
+	if settings := req.DefaultEndpointSettings; settings != nil {
+		endpoint.AutoscalingLimitMinCu = settings.AutoscalingLimitMinCu
+		endpoint.AutoscalingLimitMaxCu = settings.AutoscalingLimitMaxCu
+	}
+	return p
+}
+
+// Creates an endpoint and the operation that starts it.
+func (s *Server) newEndpoint(p *project, branchID string, endpointType string) *neonapi.Endpoint {
+	now := time.Now().UTC()
+	endpoint := &neonapi.Endpoint{
+		ID:                    s.nextID("ep"),
+		ProjectID:             p.Project.ID,
+		BranchID:              branchID,
+		RegionID:              p.Project.RegionID,
+		Type:                  endpointType,
+		CurrentState:          "idle",
+		PendingState:          "active",
+		AutoscalingLimitMinCu: 0.25,
+		AutoscalingLimitMaxCu: 0.25,
+		Provisioner:           p.Project.Provisioner,
+		CreatedAt:             now,
+		UpdatedAt:             now,
+	}
+	endpoint.Host = endpoint.ID + ".fake.neon.test"
+	p.Endpoints[endpoint.ID] = endpoint
+	s.addOperation(p, branchID, endpoint.ID, "start_compute", func() {
+		endpoint.CurrentState = "active"
+		endpoint.PendingState = ""
+	})
+	return endpoint
+}
+
+func (s *Server) addOperation(p *project, branchID string, endpointID string, action string, apply func()) *operation {
+	now := time.Now().UTC()
+	op := &operation{
+		Operation: neonapi.Operation{
+			ID:         s.nextID("op"),
+			ProjectID:  p.Project.ID,
+			BranchID:   branchID,
+			EndpointID: endpointID,
+			Action:     action,
+			Status:     neonapi.OperationStatusRunning,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		doneAt: now.Add(s.opts.OperationDelay),
+		apply:  apply,
+	}
+	if s.failOps > 0 {
+		s.failOps--
+		op.failed = true
+	}
+	p.Operations = append(p.Operations, op)
+	if s.opts.OperationDelay <= 0 {
+		s.finish(op, now)
+	}
+	return op
+}
+
+// Finishes operations that are due and accrues consumption.
+func (s *Server) refresh(now time.Time) {
+	for _, p := range s.projects {
+		for _, op := range p.Operations {
+			if !op.Done() && !now.Before(op.doneAt) {
+				s.finish(op, op.doneAt)
+			}
+		}
+		p.accrue(now)
+	}
+}
+
+// Every active endpoint adds compute time to its branch and the project, in whole seconds.
+func (p *project) accrue(now time.Time) {
+	seconds := int(now.Sub(p.accruedAt) / time.Second)
+	if seconds <= 0 {
+		return
+	}
+	p.accruedAt = p.accruedAt.Add(time.Duration(seconds) * time.Second)
+
+	for _, endpoint := range p.Endpoints {
+		if endpoint.CurrentState != "active" {
+			continue
+		}
+		p.Project.ComputeTimeSeconds += seconds
+		p.Project.ActiveTimeSeconds += seconds
+		if branch, ok := p.Branches[endpoint.BranchID]; ok {
+			branch.ComputeTimeSeconds += seconds
+			branch.ActiveTimeSeconds += seconds
+		}
+	}
+}
+
+func (s *Server) finish(op *operation, at time.Time) {
+	op.UpdatedAt = at
+	if op.failed {
+		op.Status = neonapi.OperationStatusFailed
+		op.FailuresCount = 1
+		return
+	}
+	op.Status = neonapi.OperationStatusFinished
+	if op.apply != nil {
+		op.apply()
+	}
+}
+
+func (p *project) locked() bool {
+	for _, op := range p.Operations {
+		if !op.Done() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *project) operations() []neonapi.Operation {
+	ops := make([]neonapi.Operation, 0, len(p.Operations))
+	for _, op := range p.Operations {
+		ops = append(ops, op.Operation)
+	}
+	return ops
+}
+
+// Returns operations created after the given number of operations.
+func (p *project) operationsSince(n int) []neonapi.Operation {
+	return p.operations()[n:]
+}
+
+func (p *project) mainBranch() *neonapi.Branch {
+	for _, branch := range p.Branches {
+		if branch.Default {
+			return branch
+		}
+	}
+	return nil
+}
+
+func (p *project) connstr(host string, roleName string, databaseName string) string {
+	return fmt.Sprintf("postgres://%s:%s@%s/%s", roleName, p.Passwords[roleName], host, databaseName)
+}
+
+func (s *Server) listOperations(w http.ResponseWriter, p *project) {
+	ops := p.operations()
+	// newest first
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].CreatedAt.After(ops[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, neonapi.GetOperationsResponse{Operations: ops})
+}
+
+func (s *Server) getOperation(w http.ResponseWriter, p *project, id string) {
+	for _, op := range p.Operations {
+		if op.ID == id {
+			writeJSON(w, http.StatusOK, neonapi.GetOperationResponse{Operation: op.Operation})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "", "operation not found")
+}
+
+func (s *Server) connectionURI(w http.ResponseWriter, r *http.Request, p *project) {
+	roleName := r.URL.Query().Get("role_name")
+	if _, ok := p.Passwords[roleName]; !ok {
+		writeError(w, http.StatusNotFound, "", "role not found")
+		return
+	}
+
+	var host string
+	for _, endpoint := range p.Endpoints {
+		if endpoint.BranchID == p.mainBranch().ID && endpoint.Type == "read_write" {
+			host = endpoint.Host
+		}
+	}
+	writeJSON(w, http.StatusOK, neonapi.ConnectionURIResponse{
+		URI: p.connstr(host, roleName, r.URL.Query().Get("database_name")),
+	})
+}
+
+func (s *Server) createBranch(w http.ResponseWriter, r *http.Request, p *project) {
+	var req neonapi.CreateBranchRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Branch == nil {
+		req.Branch = &neonapi.CreateBranch{}
+	}
+
+	parentID := req.Branch.ParentID
+	if parentID == "" {
+		parentID = p.mainBranch().ID
+	}
+	if _, ok := p.Branches[parentID]; !ok {
+		writeError(w, http.StatusNotFound, "", "parent branch not found")
+		return
+	}
+
+	now := time.Now().UTC()
+	opsBefore := len(p.Operations)
+	branch := &neonapi.Branch{
+		ID:              s.nextID("br"),
+		ProjectID:       p.Project.ID,
+		ParentID:        parentID,
+		ParentLSN:       req.Branch.ParentLSN,
+		ParentTimestamp: req.Branch.ParentTimestamp,
+		Name:            req.Branch.Name,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if branch.Name == "" {
+		branch.Name = branch.ID
+	}
+	if branch.ParentLSN == "" {
+		branch.ParentLSN = fmt.Sprintf("0/%X", s.seq)
+	}
+	p.Branches[branch.ID] = branch
+	s.addOperation(p, branch.ID, "", "create_branch", nil)
+
+	resp := neonapi.CreateBranchResponse{Branch: *branch}
+	for _, e := range req.Endpoints {
+		endpoint := s.newEndpoint(p, branch.ID, e.Type)
+		resp.Endpoints = append(resp.Endpoints, *endpoint)
+		for roleName := range p.Passwords {
+			resp.ConnectionUris = append(resp.ConnectionUris, neonapi.ConnectionURI{
+				ConnectionURI: p.connstr(endpoint.Host, roleName, "neondb"),
+			})
+		}
+	}
+	resp.Operations = p.operationsSince(opsBefore)
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) branch(w http.ResponseWriter, r *http.Request, p *project, parts []string) {
+	branch, ok := p.Branches[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "", "branch not found")
+		return
+	}
+
+	opsBefore := len(p.Operations)
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, neonapi.GetBranchResponse{Branch: *branch})
+		return
+	case r.Method == http.MethodDelete:
+		if branch.Default {
+			writeError(w, http.StatusUnprocessableEntity, "", "default branch can't be deleted")
+			return
+		}
+		s.addOperation(p, branch.ID, "", "delete_timeline", func() {
+			delete(p.Branches, branch.ID)
+			for id, endpoint := range p.Endpoints {
+				if endpoint.BranchID == branch.ID {
+					delete(p.Endpoints, id)
+				}
+			}
+		})
+	default:
+		var req neonapi.RestoreBranchRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if _, ok := p.Branches[req.SourceBranchID]; !ok {
+			writeError(w, http.StatusNotFound, "", "source branch not found")
+			return
+		}
+		s.addOperation(p, branch.ID, "", "restore_branch", nil)
+	}
+
+	writeJSON(w, http.StatusOK, neonapi.BranchOperationsResponse{
+		Branch:     *branch,
+		Operations: p.operationsSince(opsBefore),
+	})
+}
+
+func (s *Server) roles(w http.ResponseWriter, r *http.Request, p *project, parts []string) {
+	branchID := parts[1]
+	if _, ok := p.Branches[branchID]; !ok {
+		writeError(w, http.StatusNotFound, "", "branch not found")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var roles []neonapi.Role
+		for _, name := range sortedKeys(p.Passwords) {
+			roles = append(roles, neonapi.Role{BranchID: branchID, Name: name})
+		}
+		writeJSON(w, http.StatusOK, neonapi.ListRolesResponse{Roles: roles})
+		return
+	}
+
+	var roleName string
+	status := http.StatusOK
+	if len(parts) == 3 {
+		var req neonapi.CreateRoleRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Role == nil || req.Role.Name == "" {
+			writeError(w, http.StatusBadRequest, "", "role name is required")
+			return
+		}
+		roleName = req.Role.Name
+		if _, ok := p.Passwords[roleName]; ok {
+			writeError(w, http.StatusConflict, "", "role already exists")
+			return
+		}
+		status = http.StatusCreated
+	} else {
+		roleName = parts[3]
+		if _, ok := p.Passwords[roleName]; !ok {
+			writeError(w, http.StatusNotFound, "", "role not found")
+			return
+		}
+	}
+
+	// every reset generates a new password
+	s.seq++
+	p.Passwords[roleName] = fmt.Sprintf("%s%s-%d", passwordPrefix, p.Project.ID, s.seq)
+
+	opsBefore := len(p.Operations)
+	s.addOperation(p, branchID, "", "apply_config", nil)
+	writeJSON(w, status, neonapi.RoleOperationsResponse{
+		Role:       neonapi.Role{BranchID: branchID, Name: roleName, Password: p.Passwords[roleName]},
+		Operations: p.operationsSince(opsBefore),
+	})
+}
+
+func (s *Server) databases(w http.ResponseWriter, r *http.Request, p *project, parts []string) {
+	branchID := parts[1]
+	if _, ok := p.Branches[branchID]; !ok {
+		writeError(w, http.StatusNotFound, "", "branch not found")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var databases []neonapi.Database
+		for _, name := range sortedKeys(p.Databases) {
+			databases = append(databases, neonapi.Database{BranchID: branchID, Name: name, OwnerName: p.Databases[name]})
+		}
+		writeJSON(w, http.StatusOK, neonapi.ListDatabasesResponse{Databases: databases})
+		return
+	}
+
+	var req neonapi.CreateDatabaseRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Database == nil || req.Database.Name == "" {
+		writeError(w, http.StatusBadRequest, "", "database name is required")
+		return
+	}
+	if _, ok := p.Databases[req.Database.Name]; ok {
+		writeError(w, http.StatusConflict, "", "database already exists")
+		return
+	}
+	if _, ok := p.Passwords[req.Database.OwnerName]; !ok {
+		writeError(w, http.StatusNotFound, "", "owner role not found")
+		return
+	}
+	p.Databases[req.Database.Name] = req.Database.OwnerName
+
+	opsBefore := len(p.Operations)
+	s.addOperation(p, branchID, "", "apply_config", nil)
+	writeJSON(w, http.StatusCreated, neonapi.DatabaseOperationsResponse{
+		Database:   neonapi.Database{BranchID: branchID, Name: req.Database.Name, OwnerName: req.Database.OwnerName},
+		Operations: p.operationsSince(opsBefore),
+	})
+}
+
+func (s *Server) createEndpoint(w http.ResponseWriter, r *http.Request, p *project) {
+	var req neonapi.CreateEndpointRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Endpoint == nil {
+		writeError(w, http.StatusBadRequest, "", "endpoint is required")
+		return
+	}
+	if _, ok := p.Branches[req.Endpoint.BranchID]; !ok {
+		writeError(w, http.StatusNotFound, "", "branch not found")
+		return
+	}
+
+	opsBefore := len(p.Operations)
+	endpoint := s.newEndpoint(p, req.Endpoint.BranchID, req.Endpoint.Type)
+	writeJSON(w, http.StatusCreated, neonapi.EndpointOperationsResponse{
+		Endpoint:   *endpoint,
+		Operations: p.operationsSince(opsBefore),
+	})
+}
+
+func (s *Server) endpoint(w http.ResponseWriter, r *http.Request, p *project, parts []string) {
+	endpoint, ok := p.Endpoints[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "", "endpoint not found")
+		return
+	}
+
+	opsBefore := len(p.Operations)
+	setState := func(state string) func() {
+		return func() {
+			endpoint.CurrentState = state
+			endpoint.PendingState = ""
+		}
+	}
+
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, neonapi.GetEndpointResponse{Endpoint: *endpoint})
+		return
+	case r.Method == http.MethodPatch:
+		var req neonapi.UpdateEndpointRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Endpoint == nil {
+			writeError(w, http.StatusBadRequest, "", "endpoint is required")
+			return
+		}
+		if req.Endpoint.SuspendTimeoutSeconds != nil {
+			endpoint.SuspendTimeoutSeconds = *req.Endpoint.SuspendTimeoutSeconds
+		}
+		if req.Endpoint.AutoscalingLimitMinCu != nil {
+			endpoint.AutoscalingLimitMinCu = *req.Endpoint.AutoscalingLimitMinCu
+		}
+		if req.Endpoint.AutoscalingLimitMaxCu != nil {
+			endpoint.AutoscalingLimitMaxCu = *req.Endpoint.AutoscalingLimitMaxCu
+		}
+		if req.Endpoint.PoolerEnabled != nil {
+			endpoint.PoolerEnabled = *req.Endpoint.PoolerEnabled
+		}
+		if req.Endpoint.PoolerMode != nil {
+			endpoint.PoolerMode = *req.Endpoint.PoolerMode
+		}
+		s.addOperation(p, endpoint.BranchID, endpoint.ID, "apply_config", nil)
+		resp := *endpoint
+		writeJSON(w, http.StatusOK, neonapi.UpdateEndpointResponse{
+			Endpoint:   &resp,
+			Operations: p.operationsSince(opsBefore),
+		})
+		return
+	case action == "start":
+		endpoint.PendingState = "active"
+		s.addOperation(p, endpoint.BranchID, endpoint.ID, "start_compute", setState("active"))
+	case action == "suspend":
+		endpoint.PendingState = "idle"
+		s.addOperation(p, endpoint.BranchID, endpoint.ID, "suspend_compute", setState("idle"))
+	case action == "restart":
+		endpoint.PendingState = "active"
+		s.addOperation(p, endpoint.BranchID, endpoint.ID, "suspend_compute", nil)
+		s.addOperation(p, endpoint.BranchID, endpoint.ID, "start_compute", setState("active"))
+	}
+
+	writeJSON(w, http.StatusOK, neonapi.EndpointOperationsResponse{
+		Endpoint:   *endpoint,
+		Operations: p.operationsSince(opsBefore),
+	})
+}
+
+func sortedValues[T any](m map[string]*T) []T {
+	res := make([]T, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		res = append(res, *m[k])
+	}
+	return res
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "", "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]string{
+		"code":       code,
+		"message":    message,
+		"request_id": fmt.Sprintf("fake-%d", time.Now().UnixNano()),
+	})
+}
@@ -0,0 +1,189 @@
+package neonfake
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+)
+
+// Client without retries, so that every injected failure is seen by the test.
+func newTestClient(s *Server) *neonapi.Client {
+	return neonapi.NewClientWithURL(s.URL, "key", nil).WithRetryPolicy(neonapi.NoRetries)
+}
+
+// do makes a single request attempt.
+func do[T any](prep *neonapi.Prepared[T], err error) (*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := prep.Do(context.Background())
+	return resp, err
+}
+
+func TestServer_projectLifecycle(t *testing.T) {
+	s := NewServer(Options{OperationDelay: 50 * time.Millisecond})
+	defer s.Close()
+	client := newTestClient(s)
+
+	created, err := do(client.CreateProject(&neonapi.CreateProject{
+		Name:     "test@node-1",
+		RegionID: "aws-test-1",
+		Branch:   neonapi.CreateProjectBranch{RoleName: "testodrome"},
+	}))
+	require.NoError(t, err)
+	require.Len(t, created.Endpoints, 1)
+	require.Len(t, created.ConnectionUris, 1)
+	assert.Contains(t, created.ConnectionUris[0].ConnectionURI, created.Endpoints[0].Host)
+	assert.Len(t, created.Operations, 2)
+
+	projectID := created.Project.ID
+	endpointID := created.Endpoints[0].ID
+
+	// locked until operations are finished
+	timeout := 10
+	_, err = do(client.UpdateEndpoint(projectID, endpointID, &neonapi.UpdateEndpoint{SuspendTimeoutSeconds: &timeout}))
+	assert.ErrorIs(t, err, neonapi.ErrLocked)
+
+	waiter := neonapi.OperationWaiter{MaxWait: time.Second, MinInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond}
+	ops, err := waiter.Wait(context.Background(), created.Operations, func(ctx context.Context, id string) (*neonapi.Operation, error) {
+		resp, err := do(client.GetOperation(projectID, id))
+		if err != nil {
+			return nil, err
+		}
+		return &resp.Operation, nil
+	})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, ops[0].Duration(), 50*time.Millisecond)
+
+	endpoint, err := do(client.GetEndpoint(projectID, endpointID))
+	require.NoError(t, err)
+	assert.Equal(t, "active", endpoint.Endpoint.CurrentState)
+
+	updated, err := do(client.UpdateEndpoint(projectID, endpointID, &neonapi.UpdateEndpoint{SuspendTimeoutSeconds: &timeout}))
+	require.NoError(t, err)
+	assert.Equal(t, 10, updated.Endpoint.SuspendTimeoutSeconds)
+
+	_, err = do(client.DeleteProject(projectID))
+	require.NoError(t, err)
+	_, ok := s.Project(projectID)
+	assert.False(t, ok)
+
+	_, err = do(client.DeleteProject(projectID))
+	assert.ErrorIs(t, err, neonapi.ErrNotFound)
+}
+
+func TestServer_listProjects(t *testing.T) {
+	s := NewServer(Options{})
+	defer s.Close()
+	client := newTestClient(s)
+
+	for i := 0; i < 5; i++ {
+		s.AddProject("test@node-x", "aws-test-1")
+	}
+	s.AddProject("other", "aws-test-1")
+
+	var ids []string
+	cursor := ""
+	for {
+		resp, err := do(client.ListProjects(cursor, 2, "test@node-"))
+		require.NoError(t, err)
+		for _, p := range resp.Projects {
+			ids = append(ids, p.ID)
+		}
+		if len(resp.Projects) < 2 {
+			break
+		}
+		cursor = resp.Pagination.Cursor
+	}
+	assert.Len(t, ids, 5)
+}
+
+func TestServer_errors(t *testing.T) {
+	s := NewServer(Options{MaxProjects: 1})
+	defer s.Close()
+	client := newTestClient(s)
+
+	s.AddProject("first", "aws-test-1")
+	_, err := do(client.CreateProject(&neonapi.CreateProject{Name: "second", RegionID: "aws-test-1"}))
+	assert.ErrorIs(t, err, neonapi.ErrQuotaExceeded)
+
+	s.FailNext(1, http.StatusServiceUnavailable)
+	_, err = do(client.ListProjects("", 0, ""))
+	var apiErr *neonapi.APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+
+	_, err = do(client.ListProjects("", 0, ""))
+	assert.NoError(t, err)
+
+	unauthorized := neonapi.NewClientWithURL(s.URL, "", nil)
+	_, err = do(unauthorized.ListProjects("", 0, ""))
+	assert.ErrorIs(t, err, neonapi.ErrUnauthorized)
+}
+
+func TestServer_failedOperations(t *testing.T) {
+	s := NewServer(Options{})
+	defer s.Close()
+	client := newTestClient(s)
+
+	projectID := s.AddProject("test", "aws-test-1")
+	branches, err := do(client.ListBranches(projectID))
+	require.NoError(t, err)
+	require.Len(t, branches.Branches, 1)
+
+	s.FailOperations(1)
+	created, err := do(client.CreateBranch(projectID, &neonapi.CreateBranchRequest{
+		Branch:    &neonapi.CreateBranch{},
+		Endpoints: []neonapi.CreateBranchEndpoint{{Type: "read_write"}},
+	}))
+	require.NoError(t, err)
+	require.Len(t, created.Operations, 2)
+	assert.ErrorIs(t, created.Operations[0].Err(), neonapi.ErrOperationFailed)
+	assert.NoError(t, created.Operations[1].Err())
+}
+
+func TestServer_rolesAndDatabases(t *testing.T) {
+	s := NewServer(Options{})
+	defer s.Close()
+	client := newTestClient(s)
+
+	created, err := do(client.CreateProject(&neonapi.CreateProject{
+		Name:   "test",
+		Branch: neonapi.CreateProjectBranch{RoleName: "testodrome"},
+	}))
+	require.NoError(t, err)
+	projectID := created.Project.ID
+	branchID := created.Branch.ID
+
+	oldPassword, ok := s.Password(projectID, "testodrome")
+	require.True(t, ok)
+	reset, err := do(client.ResetRolePassword(projectID, branchID, "testodrome"))
+	require.NoError(t, err)
+	assert.NotEqual(t, oldPassword, reset.Role.Password)
+	newPassword, _ := s.Password(projectID, "testodrome")
+	assert.Equal(t, newPassword, reset.Role.Password)
+
+	_, err = do(client.ResetRolePassword(projectID, branchID, "missing"))
+	assert.ErrorIs(t, err, neonapi.ErrNotFound)
+
+	role, err := do(client.CreateRole(projectID, branchID, &neonapi.CreateRole{Name: "reader"}))
+	require.NoError(t, err)
+	assert.NotEmpty(t, role.Role.Password)
+
+	_, err = do(client.CreateDatabase(projectID, branchID, &neonapi.CreateDatabase{Name: "other", OwnerName: "reader"}))
+	require.NoError(t, err)
+
+	roles, err := do(client.ListRoles(projectID, branchID))
+	require.NoError(t, err)
+	assert.Len(t, roles.Roles, 2)
+	databases, err := do(client.ListDatabases(projectID, branchID))
+	require.NoError(t, err)
+	assert.Len(t, databases.Databases, 2)
+}
@@ -11,6 +11,16 @@ const (
 	ActQueryProject  Act = "query_project"
 	ActChangeMode    Act = "change_mode"
 	ActTest          Act = "test"
+
+	ActCheckCertificates  Act = "check_certificates"
+	ActCreateBranch       Act = "create_branch"
+	ActDeleteBranch       Act = "delete_branch"
+	ActControlEndpoint    Act = "control_endpoint"
+	ActUpdateAutoscaling  Act = "update_autoscaling"
+	ActReconcileProjects  Act = "reconcile_projects"
+	ActCollectConsumption Act = "collect_consumption"
+	ActRotatePassword     Act = "rotate_password"
+	ActRecoverProjects    Act = "recover_projects"
 )
 
 // Rule describes a rule to be run. Can be serialized and deserialized to/from JSON.
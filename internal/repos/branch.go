@@ -0,0 +1,70 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+type BranchRepo struct {
+	db *gorm.DB
+}
+
+func NewBranchRepo(db *gorm.DB) *BranchRepo {
+	return &BranchRepo{
+		db: db,
+	}
+}
+
+func (r *BranchRepo) Create(branch *models.Branch) error {
+	return r.db.Create(branch).Error
+}
+
+func (r *BranchRepo) Delete(branch *models.Branch) error {
+	return r.db.Delete(branch).Error
+}
+
+// DeleteByProject deletes all branches of the project, used when the project is deleted.
+func (r *BranchRepo) DeleteByProject(projectID uint) error {
+	return r.db.Where("project_id = ?", projectID).Delete(&models.Branch{}).Error
+}
+
+// FindByProject returns all branches of the project, oldest first.
+func (r *BranchRepo) FindByProject(projectID uint) ([]models.Branch, error) {
+	var branches []models.Branch
+	err := r.db.
+		Where("project_id = ?", projectID).
+		Order("created_at ASC").
+		Find(&branches).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return branches, nil
+}
+
+// FindRandomByProject returns a random branch of the project, or nil if there are no branches.
+func (r *BranchRepo) FindRandomByProject(projectID uint) (*models.Branch, error) {
+	var branches []models.Branch
+	err := r.db.
+		Where("project_id = ?", projectID).
+		Order("RANDOM()").
+		Limit(1).
+		Find(&branches).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(branches) == 0 {
+		return nil, nil
+	}
+	return &branches[0], nil
+}
+
+func (r *BranchRepo) UpdateLastResetAt(branch *models.Branch) error {
+	return r.db.Model(branch).UpdateColumn("last_reset_at", branch.LastResetAt).Error
+}
+
+func (r *BranchRepo) UpdateConnectionString(branch *models.Branch, connstr string) error {
+	return r.db.Model(branch).UpdateColumn("connection_string", connstr).Error
+}
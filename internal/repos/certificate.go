@@ -0,0 +1,118 @@
+package repos
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+// Observations of the same certificate are written not more often than this.
+const certificateObserveInterval = time.Minute
+
+type CertificateRepo struct {
+	db *gorm.DB
+
+	mu sync.Mutex
+	// host+fingerprint => last write time
+	lastObserved map[string]time.Time
+}
+
+func NewCertificateRepo(db *gorm.DB) *CertificateRepo {
+	return &CertificateRepo{
+		db:           db,
+		lastObserved: make(map[string]time.Time),
+	}
+}
+
+// Observe saves the leaf certificate from the TLS info, or updates its last seen time.
+func (r *CertificateRepo) Observe(host string, info *models.TLSInfo, seenAt time.Time) error {
+	leaf := info.Leaf()
+	if leaf == nil || host == "" {
+		return nil
+	}
+
+	key := host + "/" + leaf.Fingerprint
+	r.mu.Lock()
+	lastObserved := r.lastObserved[key]
+	r.mu.Unlock()
+	if seenAt.Sub(lastObserved) < certificateObserveInterval {
+		return nil
+	}
+
+	cert := models.Certificate{
+		Host:        host,
+		Fingerprint: leaf.Fingerprint,
+		Subject:     leaf.Subject,
+		Issuer:      leaf.Issuer,
+		SANs:        leaf.SANs,
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		TLSVersion:  info.Version,
+		CipherSuite: info.CipherSuite,
+		FirstSeenAt: seenAt,
+		LastSeenAt:  seenAt,
+	}
+	err := r.db.
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "host"}, {Name: "fingerprint"}},
+			DoUpdates: clause.AssignmentColumns([]string{"updated_at", "last_seen_at", "tls_version", "cipher_suite"}),
+		}).
+		Create(&cert).
+		Error
+	if err != nil {
+		return err
+	}
+
+	// only after the write, so that a failed write is retried with the next query
+	r.mu.Lock()
+	if seenAt.After(r.lastObserved[key]) {
+		r.lastObserved[key] = seenAt
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// MarkExpiryReported saves that the expiry of the certificate was reported.
+func (r *CertificateRepo) MarkExpiryReported(cert *models.Certificate, at time.Time) error {
+	cert.ExpiryReportedAt = &at
+	return r.db.Model(cert).Update("expiry_reported_at", at).Error
+}
+
+// MarkChangeReported saves that the unexpected change to this certificate was reported.
+func (r *CertificateRepo) MarkChangeReported(cert *models.Certificate, at time.Time) error {
+	cert.ChangeReportedAt = &at
+	return r.db.Model(cert).Update("change_reported_at", at).Error
+}
+
+// FindSeenSince returns certificates seen after the given time, ordered by host and first seen time.
+func (r *CertificateRepo) FindSeenSince(since time.Time) ([]models.Certificate, error) {
+	var certs []models.Certificate
+	err := r.db.
+		Where("last_seen_at > ?", since).
+		Order("host ASC, first_seen_at ASC").
+		Find(&certs).
+		Error
+	return certs, err
+}
+
+// FindPrevious returns the certificate for the host that was first seen right before the given one.
+func (r *CertificateRepo) FindPrevious(cert *models.Certificate) (*models.Certificate, error) {
+	var certs []models.Certificate
+	err := r.db.
+		Where("host = ? AND first_seen_at < ? AND id <> ?", cert.Host, cert.FirstSeenAt, cert.ID).
+		Order("first_seen_at DESC").
+		Limit(1).
+		Find(&certs).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	return &certs[0], nil
+}
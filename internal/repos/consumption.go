@@ -0,0 +1,43 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+type ConsumptionRepo struct {
+	db *gorm.DB
+}
+
+func NewConsumptionRepo(db *gorm.DB) *ConsumptionRepo {
+	return &ConsumptionRepo{
+		db: db,
+	}
+}
+
+// Create saves all snapshots in a single insert.
+func (r *ConsumptionRepo) Create(snapshots []models.ConsumptionSnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return r.db.Create(&snapshots).Error
+}
+
+// FindLastProjectSnapshot returns the last snapshot of the project totals, or nil if there are none.
+func (r *ConsumptionRepo) FindLastProjectSnapshot(projectID uint) (*models.ConsumptionSnapshot, error) {
+	var snapshots []models.ConsumptionSnapshot
+	err := r.db.
+		Where("project_id = ? AND branch_id = ''", projectID).
+		Order("created_at DESC").
+		Limit(1).
+		Find(&snapshots).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, nil
+	}
+	return &snapshots[0], nil
+}
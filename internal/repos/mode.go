@@ -0,0 +1,50 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+type ModeRepo struct {
+	db *gorm.DB
+}
+
+func NewModeRepo(db *gorm.DB) *ModeRepo {
+	return &ModeRepo{
+		db: db,
+	}
+}
+
+// Get returns the mode definition, or nil if the mode is not defined.
+func (r *ModeRepo) Get(name string) (*models.ProjectMode, error) {
+	var modes []models.ProjectMode
+	err := r.db.
+		Where("name = ?", name).
+		Limit(1).
+		Find(&modes).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(modes) == 0 {
+		return nil, nil
+	}
+	return &modes[0], nil
+}
+
+func (r *ModeRepo) All() ([]models.ProjectMode, error) {
+	var modes []models.ProjectMode
+	err := r.db.
+		Order("name").
+		Find(&modes).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return modes, nil
+}
+
+func (r *ModeRepo) Save(mode *models.ProjectMode) error {
+	return r.db.Save(mode).Error
+}
@@ -1,6 +1,8 @@
 package repos
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 
 	"github.com/petuhovskiy/neon-lights/internal/models"
@@ -17,12 +19,14 @@ func NewProjectRepo(db *gorm.DB) *ProjectRepo {
 }
 
 // FindLastCreatedProject returns the last created project in the region.
-// May return deleted projects.
+// May return deleted projects and projects that are being created. Failed attempts that
+// haven't created a project in Neon are skipped.
 func (r *ProjectRepo) FindLastCreatedProject(regionID uint) (*models.Project, error) {
 	var projects []models.Project
 	err := r.db.
 		Unscoped().
 		Where("region_id = ?", regionID).
+		Where("state <> ? OR project_id <> ''", models.ProjectFailed).
 		Order("created_at DESC").
 		Limit(1).
 		Find(&projects).
@@ -52,10 +56,135 @@ func (r *ProjectRepo) FindAllByRegion(regionID uint) ([]models.Project, error) {
 	return projects, nil
 }
 
+// FindAllByExitnode returns projects created by the exitnode, including deleted ones.
+func (r *ProjectRepo) FindAllByExitnode(exitnode string) ([]models.Project, error) {
+	var projects []models.Project
+	err := r.db.
+		Unscoped().
+		Where("created_by_exitnode = ?", exitnode).
+		Find(&projects).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// FindByExitnode returns live projects created by the exitnode.
+func (r *ProjectRepo) FindByExitnode(exitnode string) ([]models.Project, error) {
+	var projects []models.Project
+	err := r.db.
+		Where("created_by_exitnode = ?", exitnode).
+		Find(&projects).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// FindDeletedByProjectIDs returns deleted projects of the exitnode with the given provider IDs.
+func (r *ProjectRepo) FindDeletedByProjectIDs(exitnode string, projectIDs []string) ([]models.Project, error) {
+	if len(projectIDs) == 0 {
+		return nil, nil
+	}
+	var projects []models.Project
+	err := r.db.
+		Unscoped().
+		Where("created_by_exitnode = ?", exitnode).
+		Where("deleted_at IS NOT NULL").
+		Where("project_id IN ?", projectIDs).
+		Find(&projects).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// FindByStates returns projects of the exitnode in one of the states, which were not updated
+// since updatedBefore. Filters can use the joined regions table.
+func (r *ProjectRepo) FindByStates(exitnode string, states []string, updatedBefore time.Time, filters []Filter) ([]models.Project, error) {
+	var projects []models.Project
+
+	db := r.db
+	db = db.Joins("LEFT JOIN regions ON regions.id = projects.region_id")
+	db = db.Where("projects.created_by_exitnode = ?", exitnode)
+	db = db.Where("projects.state IN ?", states)
+	db = db.Where("projects.updated_at < ?", updatedBefore)
+	for _, filter := range filters {
+		db = filter.Apply(db)
+	}
+
+	err := db.
+		Order("projects.id").
+		Find(&projects).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// Save updates all fields of the project.
+func (r *ProjectRepo) Save(project *models.Project) error {
+	return r.db.Save(project).Error
+}
+
+// UpdateState changes the lifecycle state of the project, updated_at is changed too.
+func (r *ProjectRepo) UpdateState(project *models.Project, state string) error {
+	err := r.db.Model(project).Update("state", state).Error
+	if err != nil {
+		return err
+	}
+	project.State = state
+	return nil
+}
+
+// Delete marks the project as deleted and soft-deletes it.
 func (r *ProjectRepo) Delete(project *models.Project) error {
-	return r.db.Delete(project).Error
+	return r.softDelete(project, models.ProjectDeleted)
+}
+
+// Discard soft-deletes the project that was never created in Neon, the failed state is kept.
+func (r *ProjectRepo) Discard(project *models.Project) error {
+	return r.softDelete(project, models.ProjectFailed)
+}
+
+// MarkDeleting changes the state to deleting and saves the reason of the deletion.
+func (r *ProjectRepo) MarkDeleting(project *models.Project, comment string) error {
+	err := r.db.Model(project).Updates(map[string]any{
+		"state":            models.ProjectDeleting,
+		"deletion_comment": comment,
+	}).Error
+	if err != nil {
+		return err
+	}
+	project.State = models.ProjectDeleting
+	project.DeletionComment = comment
+	return nil
+}
+
+// Soft-deletes the project with the state, DeletionComment is saved too.
+func (r *ProjectRepo) softDelete(project *models.Project, state string) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(project).Updates(map[string]any{
+			"state":            state,
+			"deletion_comment": project.DeletionComment,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(project).Error
+	})
+	if err != nil {
+		return err
+	}
+	project.State = state
+	return nil
 }
 
+// FindRandomProjects returns random ready projects, matching the filters. Negative n means no limit.
 func (r *ProjectRepo) FindRandomProjects(filters []Filter, n int) ([]models.Project, error) {
 	// TODO: optimize this, https://stackoverflow.com/questions/8674718/best-way-to-select-random-rows-postgresql
 
@@ -63,6 +192,7 @@ func (r *ProjectRepo) FindRandomProjects(filters []Filter, n int) ([]models.Proj
 
 	db := r.db
 	db = db.Joins("LEFT JOIN regions ON regions.id = projects.region_id")
+	db = db.Where("projects.state = ?", models.ProjectReady)
 	for _, filter := range filters {
 		db = filter.Apply(db)
 	}
@@ -78,7 +208,27 @@ func (r *ProjectRepo) FindRandomProjects(filters []Filter, n int) ([]models.Proj
 	return projects, nil
 }
 
+func (r *ProjectRepo) UpdateAutoscaling(project *models.Project, minCu, maxCu float64) error {
+	return r.db.Model(project).UpdateColumns(map[string]any{
+		"autoscaling_min_cu": minCu,
+		"autoscaling_max_cu": maxCu,
+	}).Error
+}
+
+// UpdateEndpointSettings saves the settings of the default endpoint from the project fields.
+func (r *ProjectRepo) UpdateEndpointSettings(project *models.Project) error {
+	return r.db.Model(project).UpdateColumns(map[string]any{
+		"suspend_timeout_seconds": project.SuspendTimeoutSeconds,
+		"autoscaling_min_cu":      project.AutoscalingMinCu,
+		"autoscaling_max_cu":      project.AutoscalingMaxCu,
+	}).Error
+}
+
 func (r *ProjectRepo) UpdateMode(project *models.Project, newMode string) error {
 	_ = project.CurrentMode
 	return r.db.Model(project).UpdateColumn("current_mode", newMode).Error
 }
+
+func (r *ProjectRepo) UpdateConnectionString(project *models.Project, connstr string) error {
+	return r.db.Model(project).UpdateColumn("connection_string", connstr).Error
+}
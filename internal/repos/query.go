@@ -1,24 +1,41 @@
 package repos
 
 import (
+	"context"
+
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 
+	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
 )
 
 type QueryRepo struct {
-	db *gorm.DB
+	db           *gorm.DB
+	certificates *CertificateRepo
 }
 
-func NewQueryRepo(db *gorm.DB) *QueryRepo {
+func NewQueryRepo(db *gorm.DB, certificates *CertificateRepo) *QueryRepo {
 	return &QueryRepo{
-		db: db,
+		db:           db,
+		certificates: certificates,
 	}
 }
 
-// Save query to the database.
+// Save query to the database. TLS certificates from the query meta are saved too, failure to save
+// a certificate is only logged, because the query itself is saved.
 func (r *QueryRepo) Save(query *models.Query) error {
-	return r.db.Save(query).Error
+	if err := r.db.Save(query).Error; err != nil {
+		return err
+	}
+
+	if query.Meta != nil && query.Meta.TLS != nil {
+		err := r.certificates.Observe(query.Meta.Host, query.Meta.TLS, query.CreatedAt)
+		if err != nil {
+			log.Error(context.Background(), "failed to save certificate", zap.String("host", query.Meta.Host), zap.Error(err))
+		}
+	}
+	return nil
 }
 
 // Update result fields after the query was finished.
@@ -7,6 +7,8 @@ type QuerySaverArgs struct {
 	RegionID    *uint
 	Exitnode    *string
 	ProjectMode *string
+	ConnVariant *string
+	BranchID    *uint
 }
 
 func (a *QuerySaverArgs) Apply(q *models.Query) {
@@ -22,6 +24,12 @@ func (a *QuerySaverArgs) Apply(q *models.Query) {
 	if q.ProjectMode == "" && a.ProjectMode != nil {
 		q.ProjectMode = *a.ProjectMode
 	}
+	if q.ConnVariant == "" && a.ConnVariant != nil {
+		q.ConnVariant = *a.ConnVariant
+	}
+	if q.BranchID == nil {
+		q.BranchID = a.BranchID
+	}
 }
 
 // QuerySaver modifies and saves queries.
@@ -45,3 +53,27 @@ func (s *QuerySaver) Save(query *models.Query) error {
 func (s *QuerySaver) FinishSaveResult(query *models.Query, upd *models.QueryResult) error {
 	return s.repo.FinishSaveResult(query, upd)
 }
+
+// With returns a saver with additional args. Args that are set override the current ones.
+func (s *QuerySaver) With(args QuerySaverArgs) *QuerySaver {
+	merged := s.args
+	if args.ProjectID != nil {
+		merged.ProjectID = args.ProjectID
+	}
+	if args.RegionID != nil {
+		merged.RegionID = args.RegionID
+	}
+	if args.Exitnode != nil {
+		merged.Exitnode = args.Exitnode
+	}
+	if args.ProjectMode != nil {
+		merged.ProjectMode = args.ProjectMode
+	}
+	if args.ConnVariant != nil {
+		merged.ConnVariant = args.ConnVariant
+	}
+	if args.BranchID != nil {
+		merged.BranchID = args.BranchID
+	}
+	return NewQuerySaver(s.repo, merged)
+}
@@ -0,0 +1,61 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+type ReplicaRepo struct {
+	db *gorm.DB
+}
+
+func NewReplicaRepo(db *gorm.DB) *ReplicaRepo {
+	return &ReplicaRepo{
+		db: db,
+	}
+}
+
+func (r *ReplicaRepo) Create(replica *models.ReadReplica) error {
+	return r.db.Create(replica).Error
+}
+
+// DeleteByProject deletes all replicas of the project, used when the project is deleted.
+func (r *ReplicaRepo) DeleteByProject(projectID uint) error {
+	return r.db.Where("project_id = ?", projectID).Delete(&models.ReadReplica{}).Error
+}
+
+// FindRandomByProject returns a random replica of the project, or nil if there are no replicas.
+func (r *ReplicaRepo) FindRandomByProject(projectID uint) (*models.ReadReplica, error) {
+	var replicas []models.ReadReplica
+	err := r.db.
+		Where("project_id = ?", projectID).
+		Order("RANDOM()").
+		Limit(1).
+		Find(&replicas).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(replicas) == 0 {
+		return nil, nil
+	}
+	return &replicas[0], nil
+}
+
+// FindByProject returns all replicas of the project.
+func (r *ReplicaRepo) FindByProject(projectID uint) ([]models.ReadReplica, error) {
+	var replicas []models.ReadReplica
+	err := r.db.
+		Where("project_id = ?", projectID).
+		Find(&replicas).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+func (r *ReplicaRepo) UpdateConnectionString(replica *models.ReadReplica, connstr string) error {
+	return r.db.Model(replica).UpdateColumn("connection_string", connstr).Error
+}
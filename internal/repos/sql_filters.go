@@ -3,6 +3,7 @@ package repos
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"gorm.io/gorm"
 
@@ -29,6 +30,56 @@ func FilterByRegionProvider(provider string) WhereFilter {
 	}
 }
 
+// FilterByRegionProviders is FilterByRegionProvider for several providers.
+func FilterByRegionProviders(providers []string) WhereFilter {
+	if len(providers) == 1 {
+		return FilterByRegionProvider(providers[0])
+	}
+	return WhereFilter{
+		SQL:  "regions.provider IN ?",
+		Args: []any{providers},
+	}
+}
+
+// FilterExcludeModes skips projects in the given modes.
+func FilterExcludeModes(modes []string) WhereFilter {
+	return WhereFilter{
+		SQL:  "projects.current_mode NOT IN ?",
+		Args: []any{modes},
+	}
+}
+
+// FilterIdleProjects selects projects created before the time, without database queries since then.
+func FilterIdleProjects(since time.Time) WhereFilter {
+	return WhereFilter{
+		SQL: `projects.created_at < ? AND NOT EXISTS (
+			SELECT 1 FROM queries
+			WHERE queries.project_id = projects.id AND queries.kind IN ? AND queries.created_at >= ?
+		)`,
+		Args: []any{since, []models.QueryDestination{models.QueryDB, models.QueryRelay}, since},
+	}
+}
+
+// FilterNoConsumptionSince selects projects without a consumption snapshot of the project totals since the time.
+func FilterNoConsumptionSince(since time.Time) WhereFilter {
+	return WhereFilter{
+		SQL: `NOT EXISTS (
+			SELECT 1 FROM consumption_snapshots
+			WHERE consumption_snapshots.project_id = projects.id AND consumption_snapshots.branch_id = ''
+				AND consumption_snapshots.created_at >= ?
+		)`,
+		Args: []any{since},
+	}
+}
+
+// FilterCreatedBefore selects projects created before the time.
+func FilterCreatedBefore(t time.Time) WhereFilter {
+	return WhereFilter{
+		SQL:  "projects.created_at < ?",
+		Args: []any{t},
+	}
+}
+
 func FilterByRegionID(id uint) WhereFilter {
 	return WhereFilter{
 		SQL:  "regions.id = ?",
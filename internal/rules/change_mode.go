@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
 
 	"go.uber.org/zap"
 
@@ -12,15 +11,22 @@ import (
 	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
 	"github.com/petuhovskiy/neon-lights/internal/rdesc"
 	"github.com/petuhovskiy/neon-lights/internal/repos"
 )
 
+// Rule to switch a random project to a new mode. Endpoint settings of the mode definition
+// (see models.ProjectMode) are applied first, the new mode is saved after all operations are finished.
 type ChangeMode struct {
 	args           ChangeModeArgs
 	projectFilters []repos.Filter
 	projectRepo    *repos.ProjectRepo
+	modeRepo       *repos.ModeRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
 	register       *bgjobs.Register
+	exitnode       string
 	projectLocker  *bgjobs.ProjectLocker
 	queryProject   *QueryProject
 }
@@ -58,7 +64,11 @@ func NewChangeMode(a *app.App, j json.RawMessage) (*ChangeMode, error) {
 		args:           args,
 		projectFilters: projectFilters,
 		projectRepo:    a.Repo.Project,
+		modeRepo:       a.Repo.Mode,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
 		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
 		projectLocker:  a.ProjectLocker,
 		queryProject:   queryProject,
 	}, nil
@@ -83,7 +93,7 @@ func (r *ChangeMode) startExecuteProject(ctx context.Context, project models.Pro
 	ctx = log.With(ctx, zap.Uint("projectID", project.ID))
 	ctx = log.With(ctx, zap.String("newMode", newMode))
 
-	r.register.Go(func() {
+	r.register.Go(ctx, func() {
 		err := r.executeForProject(ctx, project, newMode)
 		if err != nil {
 			log.Error(ctx, "failed to execute project", zap.Error(err))
@@ -93,12 +103,29 @@ func (r *ChangeMode) startExecuteProject(ctx context.Context, project models.Pro
 
 // Execute a random query for a single project.
 func (r *ChangeMode) executeForProject(ctx context.Context, project models.Project, newMode string) error {
+	mode, err := r.modeRepo.Get(newMode)
+	if err != nil {
+		return fmt.Errorf("failed to get mode: %w", err)
+	}
+	if mode == nil {
+		log.Warn(ctx, "mode is not defined, changing only the label")
+	}
+
 	projectLock := r.projectLocker.Get(project.ID)
 
-	// start with querying a project
-	err := r.queryProject.executeForProject(ctx, project)
+	// start with querying a project, if the scenario is allowed in the current mode
+	currentMode, err := r.modeRepo.Get(project.CurrentMode)
 	if err != nil {
-		return fmt.Errorf("failed to query project before changing mode: %w", err)
+		return fmt.Errorf("failed to get current mode: %w", err)
+	}
+	scenario := r.queryProject.args.Scenario
+	if currentMode != nil && !currentMode.AllowsScenario(scenario) {
+		log.Info(ctx, "scenario is not allowed in the current mode, skipping the query", zap.String("scenario", scenario))
+	} else {
+		err = r.queryProject.executeForProject(ctx, project)
+		if err != nil {
+			return fmt.Errorf("failed to query project before changing mode: %w", err)
+		}
 	}
 
 	// try to take a lock
@@ -108,16 +135,70 @@ func (r *ChangeMode) executeForProject(ctx context.Context, project models.Proje
 	}
 	defer unlock()
 
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
 	// project lock is taken now
 	log.Info(ctx, "updating project mode", zap.String("prevMode", project.CurrentMode))
 
-	err = r.projectRepo.UpdateMode(&project, newMode)
+	if mode != nil && mode.HasEndpointSettings() {
+		if err := r.applySettings(ctx, &project, mode); err != nil {
+			return fmt.Errorf("failed to apply mode settings: %w", err)
+		}
+	}
+
+	// the mode is published only after the settings are applied, queries don't see the project
+	// until the exclusive lock is released
+	return r.projectRepo.UpdateMode(&project, newMode)
+}
+
+// Updates the default endpoint with the mode settings and waits for the operations.
+func (r *ChangeMode) applySettings(ctx context.Context, project *models.Project, mode *models.ProjectMode) error {
+	endpointID, err := projectEndpointID(project)
+	if err != nil {
+		return err
+	}
+
+	neonClient, err := r.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	prep, err := neonClient.UpdateEndpoint(project.ProjectID, endpointID, &neonapi.UpdateEndpoint{
+		SuspendTimeoutSeconds: mode.SuspendTimeoutSeconds,
+		AutoscalingLimitMinCu: mode.AutoscalingMinCu,
+		AutoscalingLimitMaxCu: mode.AutoscalingMaxCu,
+		PoolerEnabled:         mode.PoolerEnabled,
+		PoolerMode:            mode.PoolerMode,
+	})
 	if err != nil {
 		return err
 	}
 
-	// TODO: race condition with query project is possible
-	time.Sleep(time.Second)
+	saver := repos.NewQuerySaver(r.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &r.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	log.Info(ctx, "applying mode settings", zap.String("endpointID", endpointID))
+	resp, err := queryAPIWhenUnlocked(ctx, neonClient, prep, saver, project.ProjectID)
+	if err != nil {
+		return err
+	}
+	if err := waitOperations(ctx, neonClient, saver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
 
+	if resp.Endpoint != nil {
+		project.SuspendTimeoutSeconds = resp.Endpoint.SuspendTimeoutSeconds
+		project.AutoscalingMinCu = resp.Endpoint.AutoscalingLimitMinCu
+		project.AutoscalingMaxCu = resp.Endpoint.AutoscalingLimitMaxCu
+		if err := r.projectRepo.UpdateEndpointSettings(project); err != nil {
+			return fmt.Errorf("failed to save endpoint settings: %w", err)
+		}
+	}
 	return nil
 }
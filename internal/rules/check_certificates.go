@@ -0,0 +1,147 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to flag certificates that are close to expiry or were changed unexpectedly. Every problem
+// is saved as a failed check once. Certificates are collected by drivers, see models.Certificate.
+type CheckCertificates struct {
+	args            CheckCertificatesArgs
+	certificateRepo *repos.CertificateRepo
+	queryRepo       *repos.QueryRepo
+	exitnode        string
+}
+
+type CheckCertificatesArgs struct {
+	// Certificates expiring sooner than this are flagged.
+	ExpiryWarning rdesc.Duration
+	// Only certificates seen during this period are checked.
+	SeenWithin rdesc.Duration
+	// New certificate is expected only when the previous one expires sooner than this.
+	RenewBefore rdesc.Duration
+}
+
+const day = 24 * time.Hour
+
+// Methods of the failed checks.
+const (
+	checkCertificateExpiry = "certificate_expiry"
+	checkCertificateChange = "certificate_change"
+)
+
+var defaultCheckCertificatesArgs = CheckCertificatesArgs{
+	ExpiryWarning: rdesc.Duration{Duration: 14 * day},
+	SeenWithin:    rdesc.Duration{Duration: day},
+	RenewBefore:   rdesc.Duration{Duration: 30 * day},
+}
+
+func NewCheckCertificates(a *app.App, j json.RawMessage) (*CheckCertificates, error) {
+	args := defaultCheckCertificatesArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	return &CheckCertificates{
+		args:            args,
+		certificateRepo: a.Repo.Certificate,
+		queryRepo:       a.Repo.Query,
+		exitnode:        a.Config.Exitnode,
+	}, nil
+}
+
+func (r *CheckCertificates) Execute(ctx context.Context) error {
+	now := time.Now()
+	certs, err := r.certificateRepo.FindSeenSince(now.Add(-r.args.SeenWithin.Duration))
+	if err != nil {
+		return fmt.Errorf("failed to find certificates: %w", err)
+	}
+
+	saver := repos.NewQuerySaver(r.queryRepo, repos.QuerySaverArgs{
+		Exitnode: &r.exitnode,
+	})
+
+	for i := range certs {
+		cert := &certs[i]
+
+		var prev *models.Certificate
+		if cert.FirstSeenAt.After(now.Add(-r.args.SeenWithin.Duration)) {
+			prev, err = r.certificateRepo.FindPrevious(cert)
+			if err != nil {
+				return fmt.Errorf("failed to find previous certificate: %w", err)
+			}
+		}
+
+		for _, problem := range r.certificateProblems(cert, prev, now) {
+			log.Warn(ctx, "certificate problem", zap.String("host", cert.Host), zap.Error(problem.Err))
+			if err := problem.save(ctx, saver); err != nil {
+				return err
+			}
+			if err := r.markReported(cert, problem.Method, now); err != nil {
+				return fmt.Errorf("failed to mark certificate problem as reported: %w", err)
+			}
+		}
+	}
+
+	log.Info(ctx, "checked certificates", zap.Int("count", len(certs)))
+	return nil
+}
+
+func (r *CheckCertificates) markReported(cert *models.Certificate, method string, now time.Time) error {
+	switch method {
+	case checkCertificateExpiry:
+		return r.certificateRepo.MarkExpiryReported(cert, now)
+	case checkCertificateChange:
+		return r.certificateRepo.MarkChangeReported(cert, now)
+	}
+	return nil
+}
+
+// Returns failed checks for the certificate, skipping already reported problems.
+// prev is the certificate seen for the host before this one.
+func (r *CheckCertificates) certificateProblems(cert *models.Certificate, prev *models.Certificate, now time.Time) []checkQuery {
+	var problems []checkQuery
+
+	left := cert.NotAfter.Sub(now)
+	if left < r.args.ExpiryWarning.Duration && cert.ExpiryReportedAt == nil {
+		problems = append(problems, checkQuery{
+			Method:  checkCertificateExpiry,
+			Addr:    cert.Host,
+			Request: cert.Fingerprint,
+			Err:     fmt.Errorf("certificate expires in %s, at %s", left.Round(time.Minute), cert.NotAfter),
+		})
+	}
+
+	if prev == nil || cert.ChangeReportedAt != nil {
+		return problems
+	}
+
+	var changeErr error
+	if prev.Issuer != cert.Issuer {
+		changeErr = fmt.Errorf("certificate issuer changed from %q to %q", prev.Issuer, cert.Issuer)
+	} else if left := prev.NotAfter.Sub(cert.FirstSeenAt); left > r.args.RenewBefore.Duration {
+		changeErr = fmt.Errorf("certificate changed while the previous one was valid for %s", left.Round(time.Minute))
+	}
+
+	if changeErr != nil {
+		problems = append(problems, checkQuery{
+			Method:  checkCertificateChange,
+			Addr:    cert.Host,
+			Request: fmt.Sprintf("%s => %s", prev.Fingerprint, cert.Fingerprint),
+			Err:     changeErr,
+		})
+	}
+	return problems
+}
@@ -0,0 +1,59 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+)
+
+func TestCheckCertificates_certificateProblems(t *testing.T) {
+	r := &CheckCertificates{args: defaultCheckCertificatesArgs}
+	now := time.Now()
+
+	cert := &models.Certificate{
+		Host:        "ep-abc-xyz-123.eu-west-1.aws.neon.build",
+		Fingerprint: "new",
+		Issuer:      "CN=R3",
+		NotAfter:    now.Add(60 * day),
+		FirstSeenAt: now.Add(-time.Hour),
+	}
+	assert.Empty(t, r.certificateProblems(cert, nil, now))
+
+	// renewed shortly before expiry
+	prev := &models.Certificate{
+		Fingerprint: "old",
+		Issuer:      "CN=R3",
+		NotAfter:    now.Add(20 * day),
+	}
+	assert.Empty(t, r.certificateProblems(cert, prev, now))
+
+	// replaced long before expiry
+	prev.NotAfter = now.Add(80 * day)
+	problems := r.certificateProblems(cert, prev, now)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "certificate_change", problems[0].Method)
+
+	// issuer changed
+	prev.NotAfter = now.Add(20 * day)
+	prev.Issuer = "CN=E1"
+	problems = r.certificateProblems(cert, prev, now)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "old => new", problems[0].Request)
+
+	// already reported
+	reportedAt := now.Add(-time.Hour)
+	cert.ChangeReportedAt = &reportedAt
+	assert.Empty(t, r.certificateProblems(cert, prev, now))
+
+	// close to expiry
+	cert.NotAfter = now.Add(3 * day)
+	problems = r.certificateProblems(cert, nil, now)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "certificate_expiry", problems[0].Method)
+
+	cert.ExpiryReportedAt = &reportedAt
+	assert.Empty(t, r.certificateProblems(cert, nil, now))
+}
@@ -0,0 +1,290 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to save snapshots of the consumption metrics of all ready projects and their branches, a project
+// is collected again after Interval, so that every project has an evenly spaced series of snapshots.
+// Snapshots have the endpoint state, to check that idle projects don't accrue compute time: if the project
+// was idle at the previous and the current collection, the check is saved.
+type CollectConsumption struct {
+	args            CollectConsumptionArgs
+	projectFilters  []repos.Filter
+	projectRepo     *repos.ProjectRepo
+	consumptionRepo *repos.ConsumptionRepo
+	queryRepo       *repos.QueryRepo
+	neonAccounts    *app.NeonAccounts
+	register        *bgjobs.Register
+	exitnode        string
+	projectLocker   *bgjobs.ProjectLocker
+	running         atomic.Bool
+}
+
+type CollectConsumptionArgs struct {
+	// Min interval between snapshots of the same project. Default is 1 hour.
+	Interval rdesc.Duration
+	// Max number of projects collected per execution, 0 means all projects.
+	MaxProjects      uint
+	RawProjectFilter string
+	// If true, only the project totals are saved.
+	SkipBranches bool
+}
+
+var defaultConsumptionInterval = rdesc.Duration{Duration: time.Hour}
+
+func NewCollectConsumption(a *app.App, j json.RawMessage) (*CollectConsumption, error) {
+	var args CollectConsumptionArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.Interval.Duration == 0 {
+		args.Interval = defaultConsumptionInterval
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &CollectConsumption{
+		args:            args,
+		projectFilters:  projectFilters,
+		projectRepo:     a.Repo.Project,
+		consumptionRepo: a.Repo.Consumption,
+		queryRepo:       a.Repo.Query,
+		neonAccounts:    a.NeonAccounts,
+		register:        a.Register,
+		exitnode:        a.Config.Exitnode,
+		projectLocker:   a.ProjectLocker,
+	}, nil
+}
+
+func (c *CollectConsumption) Execute(ctx context.Context) error {
+	if !c.running.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	c.register.Go(ctx, func() {
+		defer c.running.Store(false)
+		if err := c.collect(ctx); err != nil {
+			log.Error(ctx, "failed to collect consumption", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+// Collects projects without a snapshot for Interval one by one.
+func (c *CollectConsumption) collect(ctx context.Context) error {
+	filters := append([]repos.Filter{repos.FilterNoConsumptionSince(time.Now().Add(-c.args.Interval.Duration))}, c.projectFilters...)
+	limit := -1
+	if c.args.MaxProjects > 0 {
+		limit = int(c.args.MaxProjects)
+	}
+	projects, err := c.projectRepo.FindRandomProjects(filters, limit)
+	if err != nil {
+		return fmt.Errorf("failed to find projects: %w", err)
+	}
+
+	for i := range projects {
+		project := &projects[i]
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID))
+		if err := c.executeForProject(ctx, project); err != nil {
+			log.Error(ctx, "failed to collect project consumption", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (c *CollectConsumption) executeForProject(ctx context.Context, project *models.Project) error {
+	// shared lock, so that the project is not deleted concurrently
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TrySharedLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	prep, err := neonClient.GetProject(project.ProjectID)
+	if err != nil {
+		return err
+	}
+	projectResp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return err
+	}
+
+	endpointsPrep, err := neonClient.ListEndpoints(project.ProjectID)
+	if err != nil {
+		return err
+	}
+	endpointsResp, err := queryAPI(ctx, endpointsPrep, saver)
+	if err != nil {
+		return err
+	}
+
+	var branches []neonapi.Branch
+	if !c.args.SkipBranches {
+		branchesPrep, err := neonClient.ListBranches(project.ProjectID)
+		if err != nil {
+			return err
+		}
+		branchesResp, err := queryAPI(ctx, branchesPrep, saver)
+		if err != nil {
+			return err
+		}
+		branches = branchesResp.Branches
+	}
+
+	prev, err := c.consumptionRepo.FindLastProjectSnapshot(project.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find the last snapshot: %w", err)
+	}
+
+	snapshots := consumptionSnapshots(project, c.exitnode, &projectResp.Project, branches, endpointsResp.Endpoints)
+	if err := c.consumptionRepo.Create(snapshots); err != nil {
+		return fmt.Errorf("failed to save consumption snapshots: %w", err)
+	}
+
+	cur := &snapshots[0]
+	if checked, err := checkIdleAccrual(prev, cur); checked {
+		check := checkQuery{
+			Method:  "consumption_idle",
+			Addr:    project.ProjectID,
+			Request: fmt.Sprintf(`{"since": %q}`, prev.CreatedAt.UTC().Format(time.RFC3339)),
+			Response: fmt.Sprintf(
+				`{"compute_time_seconds": %d, "active_time_seconds": %d}`,
+				cur.ComputeTimeSeconds-prev.ComputeTimeSeconds,
+				cur.ActiveTimeSeconds-prev.ActiveTimeSeconds,
+			),
+			StartedAt: prev.CreatedAt,
+			Err:       err,
+		}
+		if err != nil {
+			log.Warn(ctx, "idle project accrues compute time", zap.Error(err))
+		}
+		if err := check.save(ctx, saver); err != nil {
+			return err
+		}
+	}
+
+	log.Info(
+		ctx,
+		"collected consumption",
+		zap.Int("computeTimeSeconds", projectResp.Project.ComputeTimeSeconds),
+		zap.Int("branches", len(branches)),
+	)
+	return nil
+}
+
+// Returns the project totals snapshot first, followed by a snapshot for every branch.
+func consumptionSnapshots(
+	project *models.Project,
+	exitnode string,
+	neonProject *neonapi.Project,
+	branches []neonapi.Branch,
+	endpoints []neonapi.Endpoint,
+) []models.ConsumptionSnapshot {
+	// state of the read-write endpoint of every branch
+	branchStates := make(map[string]string)
+	projectState := ""
+	for _, endpoint := range endpoints {
+		if endpoint.Type == "read_write" {
+			branchStates[endpoint.BranchID] = endpoint.CurrentState
+		}
+		if endpoint.ID == project.EndpointID {
+			projectState = endpoint.CurrentState
+		}
+	}
+	if projectState == "" {
+		projectState = branchStates[project.MainBranchID]
+	}
+
+	var periodStart *time.Time
+	if !neonProject.ConsumptionPeriodStart.IsZero() {
+		periodStart = &neonProject.ConsumptionPeriodStart
+	}
+
+	snapshots := []models.ConsumptionSnapshot{{
+		ProjectID:              project.ID,
+		Exitnode:               exitnode,
+		EndpointState:          projectState,
+		ComputeTimeSeconds:     int64(neonProject.ComputeTimeSeconds),
+		ActiveTimeSeconds:      int64(neonProject.ActiveTimeSeconds),
+		CPUUsedSec:             int64(neonProject.CPUUsedSec),
+		WrittenDataBytes:       int64(neonProject.WrittenDataBytes),
+		DataTransferBytes:      int64(neonProject.DataTransferBytes),
+		DataStorageBytesHour:   int64(neonProject.DataStorageBytesHour),
+		SyntheticStorageSize:   neonProject.SyntheticStorageSize,
+		LogicalSizeLimitBytes:  neonProject.BranchLogicalSizeLimitBytes,
+		ConsumptionPeriodStart: periodStart,
+	}}
+
+	for _, branch := range branches {
+		snapshots = append(snapshots, models.ConsumptionSnapshot{
+			ProjectID:          project.ID,
+			BranchID:           branch.ID,
+			Exitnode:           exitnode,
+			EndpointState:      branchStates[branch.ID],
+			ComputeTimeSeconds: int64(branch.ComputeTimeSeconds),
+			ActiveTimeSeconds:  int64(branch.ActiveTimeSeconds),
+			CPUUsedSec:         int64(branch.CPUUsedSec),
+			WrittenDataBytes:   int64(branch.WrittenDataBytes),
+			DataTransferBytes:  int64(branch.DataTransferBytes),
+			LogicalSize:        branch.LogicalSize,
+		})
+	}
+	return snapshots
+}
+
+// Compares the project totals of two snapshots, taken while the project was idle. The project must not
+// accrue compute time without being active in between. Returns false if the snapshots can't be compared.
+func checkIdleAccrual(prev, cur *models.ConsumptionSnapshot) (bool, error) {
+	if prev == nil || prev.EndpointState != endpointIdle || cur.EndpointState != endpointIdle {
+		return false, nil
+	}
+	// a new consumption period resets the metrics
+	if cur.ComputeTimeSeconds < prev.ComputeTimeSeconds || cur.ActiveTimeSeconds < prev.ActiveTimeSeconds {
+		return false, nil
+	}
+
+	compute := cur.ComputeTimeSeconds - prev.ComputeTimeSeconds
+	active := cur.ActiveTimeSeconds - prev.ActiveTimeSeconds
+	if compute > 0 && active == 0 {
+		return true, fmt.Errorf("accrued %d seconds of compute time while idle", compute)
+	}
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+)
+
+func Test_consumptionSnapshots(t *testing.T) {
+	project := &models.Project{
+		Model:        gorm.Model{ID: 7},
+		MainBranchID: "br-main",
+	}
+	neonProject := &neonapi.Project{
+		ComputeTimeSeconds:   100,
+		ActiveTimeSeconds:    90,
+		SyntheticStorageSize: 1 << 20,
+	}
+	branches := []neonapi.Branch{
+		{ID: "br-main", ComputeTimeSeconds: 60, LogicalSize: 1024},
+		{ID: "br-child", ComputeTimeSeconds: 40},
+	}
+	endpoints := []neonapi.Endpoint{
+		{ID: "ep-main", BranchID: "br-main", Type: "read_write", CurrentState: "idle"},
+		{ID: "ep-replica", BranchID: "br-main", Type: "read_only", CurrentState: "active"},
+		{ID: "ep-child", BranchID: "br-child", Type: "read_write", CurrentState: "active"},
+	}
+
+	snapshots := consumptionSnapshots(project, "node", neonProject, branches, endpoints)
+	require.Len(t, snapshots, 3)
+
+	// without the endpoint ID the default branch state is used
+	assert.Equal(t, "", snapshots[0].BranchID)
+	assert.Equal(t, "idle", snapshots[0].EndpointState)
+	assert.Equal(t, int64(100), snapshots[0].ComputeTimeSeconds)
+	assert.Equal(t, int64(1<<20), snapshots[0].SyntheticStorageSize)
+	assert.Nil(t, snapshots[0].ConsumptionPeriodStart)
+
+	assert.Equal(t, "br-main", snapshots[1].BranchID)
+	assert.Equal(t, "idle", snapshots[1].EndpointState)
+	assert.Equal(t, int64(1024), snapshots[1].LogicalSize)
+
+	assert.Equal(t, "br-child", snapshots[2].BranchID)
+	assert.Equal(t, "active", snapshots[2].EndpointState)
+	for _, snapshot := range snapshots {
+		assert.Equal(t, uint(7), snapshot.ProjectID)
+		assert.Equal(t, "node", snapshot.Exitnode)
+	}
+
+	project.EndpointID = "ep-replica"
+	snapshots = consumptionSnapshots(project, "node", neonProject, nil, endpoints)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "active", snapshots[0].EndpointState)
+}
+
+func Test_checkIdleAccrual(t *testing.T) {
+	prev := &models.ConsumptionSnapshot{EndpointState: "idle", ComputeTimeSeconds: 100, ActiveTimeSeconds: 90}
+
+	checked, err := checkIdleAccrual(nil, prev)
+	assert.False(t, checked)
+	assert.NoError(t, err)
+
+	// still idle, nothing accrued
+	checked, err = checkIdleAccrual(prev, &models.ConsumptionSnapshot{EndpointState: "idle", ComputeTimeSeconds: 100, ActiveTimeSeconds: 90})
+	assert.True(t, checked)
+	assert.NoError(t, err)
+
+	// idle project still accrues consumption
+	checked, err = checkIdleAccrual(prev, &models.ConsumptionSnapshot{EndpointState: "idle", ComputeTimeSeconds: 130, ActiveTimeSeconds: 90})
+	assert.True(t, checked)
+	assert.Error(t, err)
+
+	// was active in between
+	checked, err = checkIdleAccrual(prev, &models.ConsumptionSnapshot{EndpointState: "idle", ComputeTimeSeconds: 130, ActiveTimeSeconds: 120})
+	assert.True(t, checked)
+	assert.NoError(t, err)
+
+	// active now
+	checked, _ = checkIdleAccrual(prev, &models.ConsumptionSnapshot{EndpointState: "active", ComputeTimeSeconds: 130, ActiveTimeSeconds: 90})
+	assert.False(t, checked)
+
+	// new consumption period
+	checked, _ = checkIdleAccrual(prev, &models.ConsumptionSnapshot{EndpointState: "idle", ComputeTimeSeconds: 10})
+	assert.False(t, checked)
+}
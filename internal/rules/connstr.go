@@ -0,0 +1,150 @@
+package rules
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+const (
+	// Endpoint ID is passed only in the hostname, clients need SNI support.
+	EndpointIDHost = ""
+	// Endpoint ID is passed in `options=endpoint%3D<id>`, for clients without SNI.
+	EndpointIDOptions = "options"
+	// Endpoint ID is passed in the password, `endpoint=<id>;<password>`.
+	EndpointIDPassword = "password"
+)
+
+// ConnVariant describes how the connection string is built. Empty fields leave
+// the connection string unchanged.
+type ConnVariant struct {
+	// Name is saved to the queries, to compare variants.
+	Name string
+	// One of EndpointIDHost, EndpointIDOptions or EndpointIDPassword.
+	EndpointID string
+	// sslmode parameter, e.g. "require" or "verify-full".
+	SSLMode string
+	// channel_binding parameter, e.g. "require".
+	ChannelBinding string
+	// Database to connect to.
+	Database string
+	// Role and password to connect with. Password is used only if Role is set.
+	Role     string
+	Password string
+}
+
+var defaultConnVariants = rdesc.Wrand[ConnVariant]{
+	{Weight: 1, Item: ConnVariant{Name: "default"}},
+}
+
+// Returns the endpoint ID from the connection string host, e.g. "ep-abc-xyz-123" for
+// "ep-abc-xyz-123-pooler.eu-west-1.aws.neon.build".
+func endpointIDFromHost(host string) (string, error) {
+	label, _, found := strings.Cut(host, ".")
+	if !found || !strings.HasPrefix(label, "ep-") {
+		return "", fmt.Errorf("failed to find endpoint id in host %q", host)
+	}
+	return strings.TrimSuffix(label, "-pooler"), nil
+}
+
+// Returns the endpoint ID of the project, parsing it from the connection string for old projects.
+func projectEndpointID(project *models.Project) (string, error) {
+	if project.EndpointID != "" {
+		return project.EndpointID, nil
+	}
+	u, err := url.Parse(project.ConnectionString)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connstr: %w", err)
+	}
+	return endpointIDFromHost(u.Hostname())
+}
+
+// Returns the connection string with a different host, e.g. for another endpoint of the same branch.
+func replaceHost(connstr string, host string) (string, error) {
+	u, err := url.Parse(connstr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connstr: %w", err)
+	}
+	if port := u.Port(); port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+	return u.String(), nil
+}
+
+// Returns the connection string with a different password, e.g. after the password reset.
+func replacePassword(connstr string, password string) (string, error) {
+	u, err := url.Parse(connstr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connstr: %w", err)
+	}
+	if u.User == nil {
+		return "", fmt.Errorf("connstr has no role")
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// Returns the role name from the connection string.
+func connstrRole(connstr string) (string, error) {
+	u, err := url.Parse(connstr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connstr: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", fmt.Errorf("connstr has no role")
+	}
+	return u.User.Username(), nil
+}
+
+// Builds the connection string according to the variant.
+func applyConnVariant(connstr string, variant ConnVariant) (string, error) {
+	u, err := url.Parse(connstr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connstr: %w", err)
+	}
+
+	query := u.Query()
+
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	if variant.Role != "" {
+		username = variant.Role
+		password = variant.Password
+	}
+
+	switch variant.EndpointID {
+	case EndpointIDHost:
+	case EndpointIDOptions:
+		endpointID, err := endpointIDFromHost(u.Hostname())
+		if err != nil {
+			return "", err
+		}
+		query.Set("options", "endpoint="+endpointID)
+	case EndpointIDPassword:
+		endpointID, err := endpointIDFromHost(u.Hostname())
+		if err != nil {
+			return "", err
+		}
+		password = fmt.Sprintf("endpoint=%s;%s", endpointID, password)
+	default:
+		return "", fmt.Errorf("unknown endpoint id variant %q", variant.EndpointID)
+	}
+	u.User = url.UserPassword(username, password)
+
+	if variant.SSLMode != "" {
+		query.Set("sslmode", variant.SSLMode)
+	}
+	if variant.ChannelBinding != "" {
+		query.Set("channel_binding", variant.ChannelBinding)
+	}
+	if variant.Database != "" {
+		u.Path = "/" + variant.Database
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,283 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Endpoint actions, see ControlEndpointArgs.
+const (
+	EndpointStart   = "start"
+	EndpointSuspend = "suspend"
+	EndpointRestart = "restart"
+)
+
+// Endpoint states reported by the API.
+const (
+	endpointActive = "active"
+	endpointIdle   = "idle"
+)
+
+// Rule to start, suspend or restart the compute of a random project. The API call is saved
+// as usual, and the time until the endpoint reports the target state is saved as a check.
+type ControlEndpoint struct {
+	args           ControlEndpointArgs
+	projectFilters []repos.Filter
+	projectRepo    *repos.ProjectRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
+	register       *bgjobs.Register
+	exitnode       string
+	projectLocker  *bgjobs.ProjectLocker
+}
+
+type ControlEndpointArgs struct {
+	// One of EndpointStart, EndpointSuspend or EndpointRestart. Default is suspend or restart.
+	Action            rdesc.Wrand[string]
+	MaxRandomProjects uint
+	RawProjectFilter  string
+	// Check is failed if the endpoint doesn't reach the target state in time. Default is 5 minutes.
+	WaitTimeout rdesc.Duration
+	// Interval between endpoint state requests. Default is 1 second.
+	PollInterval rdesc.Duration
+}
+
+var defaultEndpointActions = rdesc.Wrand[string]{
+	{Weight: 1, Item: EndpointSuspend},
+	{Weight: 1, Item: EndpointRestart},
+}
+
+func NewControlEndpoint(a *app.App, j json.RawMessage) (*ControlEndpoint, error) {
+	var args ControlEndpointArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.Action == nil {
+		args.Action = defaultEndpointActions
+	}
+	if args.WaitTimeout.Duration == 0 {
+		args.WaitTimeout = rdesc.Duration{Duration: 5 * time.Minute}
+	}
+	if args.PollInterval.Duration == 0 {
+		args.PollInterval = rdesc.Duration{Duration: time.Second}
+	}
+
+	for _, action := range args.Action {
+		if _, ok := endpointTargetState(action.Item); !ok {
+			return nil, fmt.Errorf("unknown endpoint action: %s", action.Item)
+		}
+	}
+	if args.MaxRandomProjects < 1 {
+		args.MaxRandomProjects = 1
+	}
+	if args.PollInterval.Duration <= 0 {
+		return nil, fmt.Errorf("PollInterval must be positive")
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &ControlEndpoint{
+		args:           args,
+		projectFilters: projectFilters,
+		projectRepo:    a.Repo.Project,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
+		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
+		projectLocker:  a.ProjectLocker,
+	}, nil
+}
+
+// Returns the state the endpoint should reach after the action.
+func endpointTargetState(action string) (string, bool) {
+	switch action {
+	case EndpointStart, EndpointRestart:
+		return endpointActive, true
+	case EndpointSuspend:
+		return endpointIdle, true
+	}
+	return "", false
+}
+
+func (c *ControlEndpoint) Execute(ctx context.Context) error {
+	projects, err := c.projectRepo.FindRandomProjects(c.projectFilters, int(c.args.MaxRandomProjects))
+	if err != nil {
+		return fmt.Errorf("failed to find random projects: %w", err)
+	}
+
+	for _, project := range projects {
+		project := project
+		action := c.args.Action.Pick()
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID), zap.String("action", action))
+		c.register.Go(ctx, func() {
+			if err := c.executeForProject(ctx, &project, action); err != nil {
+				log.Error(ctx, "failed to control endpoint", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+func (c *ControlEndpoint) executeForProject(ctx context.Context, project *models.Project, action string) error {
+	// exclusive lock, queries would change the endpoint state
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	endpointID, err := projectEndpointID(project)
+	if err != nil {
+		return err
+	}
+	ctx = log.With(ctx, zap.String("endpointID", endpointID))
+
+	var prep *neonapi.Prepared[neonapi.EndpointOperationsResponse]
+	switch action {
+	case EndpointStart:
+		prep, err = neonClient.StartEndpoint(project.ProjectID, endpointID)
+	case EndpointSuspend:
+		prep, err = neonClient.SuspendEndpoint(project.ProjectID, endpointID)
+	case EndpointRestart:
+		prep, err = neonClient.RestartEndpoint(project.ProjectID, endpointID)
+	}
+	if err != nil {
+		return err
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	startedAt := time.Now()
+	log.Info(ctx, "controlling endpoint")
+	resp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return err
+	}
+	// the endpoint can be active before the restart, only the operations tell that it happened
+	if action == EndpointRestart && len(resp.Operations) == 0 {
+		return fmt.Errorf("restart returned no operations")
+	}
+	if err := waitOperations(ctx, neonClient, saver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+
+	targetState, _ := endpointTargetState(action)
+	state, polls, err := c.waitForState(ctx, neonClient, saver, project.ProjectID, endpointID, targetState)
+
+	check := checkQuery{
+		Method:    "endpoint_" + action,
+		Addr:      endpointID,
+		Request:   targetState,
+		Response:  fmt.Sprintf(`{"state": %q, "polls": %d}`, state, polls),
+		StartedAt: startedAt,
+		Err:       err,
+	}
+	if saveErr := check.save(ctx, saver); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
+
+// Polls the endpoint until it reaches the target state. Returns the last seen state and the number of polls.
+// Only the last poll is saved as an API query, the whole wait is saved as a single check by the caller.
+func (c *ControlEndpoint) waitForState(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	projectID string,
+	endpointID string,
+	targetState string,
+) (string, int, error) {
+	prep, err := neonClient.GetEndpoint(projectID, endpointID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	state, polls, result, err := c.pollState(ctx, prep, targetState)
+	if result == nil {
+		return state, polls, err
+	}
+
+	query := prep.QueryNoArgs()
+	if saveErr := saver.Save(query); saveErr != nil {
+		return state, polls, errors.Join(err, fmt.Errorf("failed to persist query: %w", saveErr))
+	}
+	if saveErr := saver.FinishSaveResult(query, result); saveErr != nil {
+		return state, polls, errors.Join(err, fmt.Errorf("failed to persist query result: %w", saveErr))
+	}
+	return state, polls, err
+}
+
+// Polls the endpoint without saving the queries. Returns the result of the last poll.
+func (c *ControlEndpoint) pollState(
+	ctx context.Context,
+	prep *neonapi.Prepared[neonapi.GetEndpointResponse],
+	targetState string,
+) (string, int, *models.QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.args.WaitTimeout.Duration)
+	defer cancel()
+
+	var state string
+	var lastResult *models.QueryResult
+	var lastErr error
+	for polls := 1; ; polls++ {
+		resp, result, err := prep.Do(ctx)
+		if result != nil {
+			lastResult = result
+		}
+		if err != nil {
+			log.Warn(ctx, "failed to get endpoint", zap.Error(err))
+			lastErr = err
+		} else {
+			lastErr = nil
+			state = resp.Endpoint.CurrentState
+			if state == targetState && resp.Endpoint.PendingState == "" {
+				return state, polls, lastResult, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("endpoint is %q, expected %q: %w", state, targetState, ctx.Err())
+			if lastErr != nil {
+				err = errors.Join(err, lastErr)
+			}
+			return state, polls, lastResult, err
+		case <-time.After(c.args.PollInterval.Duration):
+		}
+	}
+}
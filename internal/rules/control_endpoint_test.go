@@ -0,0 +1,26 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+)
+
+func TestNewControlEndpoint_defaults(t *testing.T) {
+	a := &app.App{Config: &conf.App{}, Repo: &app.Repos{}}
+
+	c, err := NewControlEndpoint(a, json.RawMessage(`{"Action": [{"Weight": 1, "Item": "start"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, EndpointStart, c.args.Action[0].Item)
+
+	// args of other rules don't change the defaults
+	c, err = NewControlEndpoint(a, json.RawMessage(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, EndpointSuspend, c.args.Action[0].Item)
+	assert.Equal(t, EndpointRestart, c.args.Action[1].Item)
+}
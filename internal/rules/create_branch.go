@@ -0,0 +1,341 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to create branches in random projects, until every project has BranchesN branches.
+// Branches are queried by query_project with the "branch" target.
+type CreateBranch struct {
+	args           CreateBranchArgs
+	projectFilters []repos.Filter
+	projectRepo    *repos.ProjectRepo
+	branchRepo     *repos.BranchRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
+	driverRegistry *drivers.Registry
+	register       *bgjobs.Register
+	exitnode       string
+	projectLocker  *bgjobs.ProjectLocker
+}
+
+type CreateBranchArgs struct {
+	// Target number of branches in a project, not counting the default branch.
+	BranchesN         int
+	MaxRandomProjects uint
+	RawProjectFilter  string
+	// Branch point, one of models.BranchFromXXX.
+	ParentPoint rdesc.Wrand[string]
+	// How far in the past the branch point is, for models.BranchFromTimestamp.
+	// Clamped to the project creation time.
+	TimestampAgo rdesc.Wrand[rdesc.Duration]
+	// Driver to read the current LSN of the parent, for models.BranchFromLSN. Default is pgx-conn.
+	// The driver must support drivers.CapRowsResponse.
+	LSNDriver drivers.Name
+	// Probability to reset a random branch to its parent, when the project already has enough branches.
+	ResetProbability float64
+}
+
+// pg_lsn is cast to text, it's not a type known to every driver.
+const currentLSNQuery = `SELECT pg_current_wal_lsn()::text`
+
+var defaultParentPoint = rdesc.Wrand[string]{
+	{Weight: 2, Item: models.BranchFromHead},
+	{Weight: 1, Item: models.BranchFromTimestamp},
+	{Weight: 1, Item: models.BranchFromLSN},
+}
+
+// Timestamp branch points are at least this long after the project creation,
+// the API rejects timestamps before the start of the project history.
+const branchTimestampMargin = time.Minute
+
+var defaultTimestampAgo = rdesc.Wrand[rdesc.Duration]{
+	{Weight: 1, Item: rdesc.Duration{Duration: time.Minute}},
+	{Weight: 1, Item: rdesc.Duration{Duration: time.Hour}},
+}
+
+func NewCreateBranch(a *app.App, j json.RawMessage) (*CreateBranch, error) {
+	var args CreateBranchArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.BranchesN < 0 {
+		return nil, fmt.Errorf("BranchesN cant be negative")
+	}
+	if args.MaxRandomProjects < 1 {
+		args.MaxRandomProjects = 1
+	}
+	if args.ParentPoint == nil {
+		args.ParentPoint = defaultParentPoint
+	}
+	if args.TimestampAgo == nil {
+		args.TimestampAgo = defaultTimestampAgo
+	}
+	if args.LSNDriver == "" {
+		args.LSNDriver = drivers.PgxConn
+	}
+	reg, ok := a.Drivers.Get(args.LSNDriver)
+	if !ok {
+		return nil, fmt.Errorf("unknown driver: %s", args.LSNDriver)
+	}
+	// LSN is parsed from the rows of the response
+	if !reg.Supports(drivers.Params{}, drivers.CapRowsResponse) {
+		return nil, fmt.Errorf("driver %s doesn't support %s", args.LSNDriver, drivers.CapRowsResponse)
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &CreateBranch{
+		args:           args,
+		projectFilters: projectFilters,
+		projectRepo:    a.Repo.Project,
+		branchRepo:     a.Repo.Branch,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
+		driverRegistry: a.Drivers,
+		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
+		projectLocker:  a.ProjectLocker,
+	}, nil
+}
+
+func (c *CreateBranch) Execute(ctx context.Context) error {
+	projects, err := c.projectRepo.FindRandomProjects(c.projectFilters, int(c.args.MaxRandomProjects))
+	if err != nil {
+		return fmt.Errorf("failed to find random projects: %w", err)
+	}
+
+	for _, project := range projects {
+		project := project
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID))
+		c.register.Go(ctx, func() {
+			if err := c.executeForProject(ctx, &project); err != nil {
+				log.Error(ctx, "failed to create branch", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+func (c *CreateBranch) executeForProject(ctx context.Context, project *models.Project) error {
+	// shared lock, so that the project is not deleted concurrently
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TrySharedLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	branches, err := c.branchRepo.FindByProject(project.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find branches: %w", err)
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	if len(branches) >= c.args.BranchesN {
+		if len(branches) > 0 && rand.Float64() < c.args.ResetProbability {
+			return c.resetBranch(ctx, neonClient, saver, project, &branches[rand.Intn(len(branches))])
+		}
+		return nil
+	}
+
+	return c.createBranch(ctx, neonClient, saver, project)
+}
+
+// Picks the branch point. Timestamp is clamped to the project history, LSN is the current
+// LSN of the parent. Head is used if the project is too young for a timestamp.
+func (c *CreateBranch) branchPoint(
+	ctx context.Context,
+	saver drivers.QuerySaver,
+	project *models.Project,
+) (string, *neonapi.CreateBranch, error) {
+	req := &neonapi.CreateBranch{
+		ParentID: project.MainBranchID,
+	}
+
+	point := c.args.ParentPoint.Pick()
+	switch point {
+	case models.BranchFromTimestamp:
+		now := time.Now()
+		ts := now.Add(-c.args.TimestampAgo.Pick().Duration)
+		if earliest := project.CreatedAt.Add(branchTimestampMargin); ts.Before(earliest) {
+			ts = earliest
+		}
+		if ts.After(now) {
+			point = models.BranchFromHead
+			break
+		}
+		ts = ts.UTC()
+		req.ParentTimestamp = &ts
+	case models.BranchFromLSN:
+		lsn, err := c.currentLSN(ctx, saver, project)
+		if err != nil {
+			return point, nil, fmt.Errorf("failed to get current LSN: %w", err)
+		}
+		req.ParentLSN = lsn
+	}
+	return point, req, nil
+}
+
+// Returns the current WAL LSN of the default branch.
+func (c *CreateBranch) currentLSN(ctx context.Context, saver drivers.QuerySaver, project *models.Project) (string, error) {
+	driver, err := c.driverRegistry.New(ctx, c.args.LSNDriver, drivers.Params{
+		Connstr: project.ConnectionString,
+		Saver:   saver,
+	})
+	if err != nil {
+		return "", err
+	}
+	if cc, ok := driver.(drivers.CloseableDriver); ok {
+		defer cc.Close(ctx)
+	}
+
+	query, err := driver.Query(ctx, drivers.SingleQuery{Query: currentLSNQuery})
+	if err != nil {
+		return "", err
+	}
+
+	var rows [][]string
+	if err := json.Unmarshal([]byte(query.Response), &rows); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 || rows[0][0] == "" {
+		return "", fmt.Errorf("expected a single LSN, got %s", query.Response)
+	}
+	return rows[0][0], nil
+}
+
+func (c *CreateBranch) createBranch(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+) error {
+	point, branchReq, err := c.branchPoint(ctx, saver, project)
+	ctx = log.With(ctx, zap.String("parentPoint", point))
+	if err != nil {
+		return err
+	}
+
+	prep, err := neonClient.CreateBranch(project.ProjectID, &neonapi.CreateBranchRequest{
+		Branch:    branchReq,
+		Endpoints: []neonapi.CreateBranchEndpoint{{Type: "read_write"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info(ctx, "creating branch")
+	resp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return err
+	}
+
+	dbBranch := models.Branch{
+		ProjectID:         project.ID,
+		BranchID:          resp.Branch.ID,
+		ParentBranchID:    resp.Branch.ParentID,
+		Name:              resp.Branch.Name,
+		ParentPoint:       point,
+		ParentLSN:         resp.Branch.ParentLSN,
+		ParentTimestamp:   resp.Branch.ParentTimestamp,
+		CreatedByExitnode: c.exitnode,
+	}
+	if len(resp.Endpoints) == 1 {
+		dbBranch.EndpointID = resp.Endpoints[0].ID
+	} else {
+		log.Warn(ctx, "branch has invalid number of endpoints", zap.Any("endpoints", resp.Endpoints))
+	}
+	if len(resp.ConnectionUris) == 1 {
+		dbBranch.ConnectionString = resp.ConnectionUris[0].ConnectionURI
+	} else {
+		log.Warn(ctx, "branch has invalid number of connection strings")
+	}
+
+	err = c.branchRepo.Create(&dbBranch)
+	if err != nil {
+		return fmt.Errorf("failed to create branch in the database: %w", err)
+	}
+
+	// branch is saved before waiting, so that it's deleted even if the operations fail
+	branchSaver := saver.With(repos.QuerySaverArgs{BranchID: &dbBranch.ID})
+	if err := waitOperations(ctx, neonClient, branchSaver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+
+	log.Info(ctx, "branch created", zap.String("branchID", dbBranch.BranchID))
+	return nil
+}
+
+// Resets the branch to the latest state of its parent.
+func (c *CreateBranch) resetBranch(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+	branch *models.Branch,
+) error {
+	ctx = log.With(ctx, zap.String("branchID", branch.BranchID))
+	if branch.ParentBranchID == "" {
+		log.Warn(ctx, "branch has no parent, can't reset")
+		return nil
+	}
+
+	prep, err := neonClient.RestoreBranch(project.ProjectID, branch.BranchID, &neonapi.RestoreBranchRequest{
+		SourceBranchID: branch.ParentBranchID,
+	})
+	if err != nil {
+		return err
+	}
+
+	branchSaver := saver.With(repos.QuerySaverArgs{BranchID: &branch.ID})
+
+	log.Info(ctx, "resetting branch to parent")
+	resp, err := queryAPI(ctx, prep, branchSaver)
+	if err != nil {
+		return err
+	}
+	if err := waitOperations(ctx, neonClient, branchSaver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	branch.LastResetAt = &now
+	return c.branchRepo.UpdateLastResetAt(branch)
+}
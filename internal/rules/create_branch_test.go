@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+// Driver that returns the same response to every query.
+type staticDriver struct {
+	response string
+}
+
+func (d *staticDriver) Query(ctx context.Context, req drivers.SingleQuery) (*models.Query, error) {
+	query := &models.Query{Request: req.Query}
+	query.Response = d.response
+	return query, nil
+}
+
+func TestNewCreateBranch_lsnDriver(t *testing.T) {
+	registry := drivers.NewRegistry()
+	registry.Register(drivers.Registration{Name: "rows", Capabilities: drivers.Capabilities{drivers.CapRowsResponse}})
+	registry.Register(drivers.Registration{Name: "plain"})
+	a := &app.App{Config: &conf.App{}, Repo: &app.Repos{}, Drivers: registry}
+
+	_, err := NewCreateBranch(a, json.RawMessage(`{"LSNDriver": "rows"}`))
+	assert.NoError(t, err)
+
+	// LSN can't be parsed without rows in the response
+	_, err = NewCreateBranch(a, json.RawMessage(`{"LSNDriver": "plain"}`))
+	assert.Error(t, err)
+
+	_, err = NewCreateBranch(a, json.RawMessage(`{"LSNDriver": "unknown"}`))
+	assert.Error(t, err)
+}
+
+func TestCreateBranch_branchPoint(t *testing.T) {
+	registry := drivers.NewRegistry()
+	registry.Register(drivers.Registration{
+		Name: "test",
+		New: func(ctx context.Context, params drivers.Params) (drivers.Driver, error) {
+			return &staticDriver{response: `[["0/1F4E2A8"]]`}, nil
+		},
+	})
+
+	project := &models.Project{
+		Model:        gorm.Model{CreatedAt: time.Now().Add(-2 * time.Hour)},
+		MainBranchID: "br-main-123",
+	}
+	c := &CreateBranch{
+		args: CreateBranchArgs{
+			TimestampAgo: rdesc.Wrand[rdesc.Duration]{{Weight: 1, Item: rdesc.Duration{Duration: time.Hour}}},
+			LSNDriver:    "test",
+		},
+		driverRegistry: registry,
+	}
+	ctx := context.Background()
+	saver := &fakeQuerySaver{}
+
+	c.args.ParentPoint = rdesc.Wrand[string]{{Weight: 1, Item: models.BranchFromHead}}
+	point, req, err := c.branchPoint(ctx, saver, project)
+	require.NoError(t, err)
+	assert.Equal(t, models.BranchFromHead, point)
+	assert.Equal(t, "br-main-123", req.ParentID)
+	assert.Empty(t, req.ParentLSN)
+	assert.Nil(t, req.ParentTimestamp)
+
+	c.args.ParentPoint = rdesc.Wrand[string]{{Weight: 1, Item: models.BranchFromTimestamp}}
+	point, req, err = c.branchPoint(ctx, saver, project)
+	require.NoError(t, err)
+	assert.Equal(t, models.BranchFromTimestamp, point)
+	require.NotNil(t, req.ParentTimestamp)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), *req.ParentTimestamp, time.Minute)
+
+	// clamped to the project creation time
+	project.CreatedAt = time.Now().Add(-10 * time.Minute)
+	point, req, err = c.branchPoint(ctx, saver, project)
+	require.NoError(t, err)
+	assert.Equal(t, models.BranchFromTimestamp, point)
+	require.NotNil(t, req.ParentTimestamp)
+	assert.WithinDuration(t, project.CreatedAt.Add(branchTimestampMargin), *req.ParentTimestamp, time.Second)
+
+	// too young for a timestamp, falls back to head
+	project.CreatedAt = time.Now()
+	point, req, err = c.branchPoint(ctx, saver, project)
+	require.NoError(t, err)
+	assert.Equal(t, models.BranchFromHead, point)
+	assert.Nil(t, req.ParentTimestamp)
+
+	c.args.ParentPoint = rdesc.Wrand[string]{{Weight: 1, Item: models.BranchFromLSN}}
+	point, req, err = c.branchPoint(ctx, saver, project)
+	require.NoError(t, err)
+	assert.Equal(t, models.BranchFromLSN, point)
+	assert.Equal(t, "0/1F4E2A8", req.ParentLSN)
+}
+
+func TestCreateBranch_currentLSN_invalidResponse(t *testing.T) {
+	registry := drivers.NewRegistry()
+	registry.Register(drivers.Registration{
+		Name: "test",
+		New: func(ctx context.Context, params drivers.Params) (drivers.Driver, error) {
+			return &staticDriver{response: `[]`}, nil
+		},
+	})
+
+	c := &CreateBranch{
+		args:           CreateBranchArgs{LSNDriver: "test"},
+		driverRegistry: registry,
+	}
+	_, err := c.currentLSN(context.Background(), &fakeQuerySaver{}, &models.Project{})
+	assert.Error(t, err)
+}
@@ -3,7 +3,10 @@ package rules
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -26,11 +29,18 @@ type CreateProject struct {
 	regionFilters []repos.Filter
 	regionRepo    *repos.RegionRepo
 	projectRepo   *repos.ProjectRepo
+	modeRepo      *repos.ModeRepo
+	configurator  *projectConfigurator
 	queryRepo     *repos.QueryRepo
 	sequence      *repos.Sequence
-	neonClient    *neonapi.Client
+	neonAccounts  *app.NeonAccounts
 	config        *conf.App
 	register      *bgjobs.Register
+	projectLocker *bgjobs.ProjectLocker
+
+	// Projects are not created in the account until this time, set after a quota error.
+	pausedMu    sync.Mutex
+	pausedUntil map[string]time.Time
 }
 
 type CreateProjectArgs struct {
@@ -38,7 +48,37 @@ type CreateProjectArgs struct {
 	PgVersion      rdesc.Wrand[int]
 	Provisioner    rdesc.Wrand[string]
 	SuspendTimeout rdesc.Wrand[int]
-	Mode           rdesc.Wrand[string]
+	// Endpoint settings of the mode definition (see models.ProjectMode) override SuspendTimeout and Autoscaling.
+	Mode rdesc.Wrand[string]
+	// Creation is paused for this duration after a quota error. Default is 1 hour.
+	QuotaPause *rdesc.Duration
+	// Number of read-only endpoints created on the default branch. Default is 0.
+	ReadReplicas rdesc.Wrand[int]
+	// Compute size of the default endpoint. Zero limits mean the default size.
+	Autoscaling rdesc.Wrand[AutoscalingLimits]
+}
+
+// AutoscalingLimits are endpoint compute limits, in compute units.
+type AutoscalingLimits struct {
+	MinCu float64
+	MaxCu float64
+}
+
+func (l AutoscalingLimits) validate() error {
+	if l.MinCu < 0 || l.MaxCu < 0 {
+		return fmt.Errorf("autoscaling limits cant be negative: %+v", l)
+	}
+	if (l.MinCu == 0) != (l.MaxCu == 0) {
+		return fmt.Errorf("autoscaling limits must be set together: %+v", l)
+	}
+	if l.MinCu > l.MaxCu {
+		return fmt.Errorf("MinCu is greater than MaxCu: %+v", l)
+	}
+	return nil
+}
+
+func (l AutoscalingLimits) isDefault() bool {
+	return l.MinCu == 0 && l.MaxCu == 0
 }
 
 var defaultPgVersion = rdesc.Wrand[int]{
@@ -64,6 +104,16 @@ var defaultProjectMode = rdesc.Wrand[string]{
 	{Weight: 1, Item: ""},
 }
 
+var defaultReadReplicas = rdesc.Wrand[int]{
+	{Weight: 1, Item: 0},
+}
+
+var defaultAutoscaling = rdesc.Wrand[AutoscalingLimits]{
+	{Weight: 1, Item: AutoscalingLimits{}},
+}
+
+var defaultQuotaPause = rdesc.Duration{Duration: time.Hour}
+
 func NewCreateProject(a *app.App, j json.RawMessage) (*CreateProject, error) {
 	var args CreateProjectArgs
 	err := json.Unmarshal(j, &args)
@@ -83,6 +133,20 @@ func NewCreateProject(a *app.App, j json.RawMessage) (*CreateProject, error) {
 	if args.Mode == nil {
 		args.Mode = defaultProjectMode
 	}
+	if args.QuotaPause == nil {
+		args.QuotaPause = &defaultQuotaPause
+	}
+	if args.ReadReplicas == nil {
+		args.ReadReplicas = defaultReadReplicas
+	}
+	if args.Autoscaling == nil {
+		args.Autoscaling = defaultAutoscaling
+	}
+	for _, limits := range args.Autoscaling {
+		if err := limits.Item.validate(); err != nil {
+			return nil, err
+		}
+	}
 
 	return &CreateProject{
 		interval:      args.Interval.Duration,
@@ -90,11 +154,15 @@ func NewCreateProject(a *app.App, j json.RawMessage) (*CreateProject, error) {
 		regionFilters: a.RegionFilters,
 		regionRepo:    a.Repo.Region,
 		projectRepo:   a.Repo.Project,
+		modeRepo:      a.Repo.Mode,
+		configurator:  newProjectConfigurator(a),
 		queryRepo:     a.Repo.Query,
 		sequence:      a.Repo.SeqExitnodeProject,
-		neonClient:    a.NeonClient,
+		neonAccounts:  a.NeonAccounts,
 		config:        a.Config,
 		register:      a.Register,
+		projectLocker: a.ProjectLocker,
+		pausedUntil:   make(map[string]time.Time),
 	}, nil
 }
 
@@ -106,7 +174,7 @@ func (c *CreateProject) Execute(ctx context.Context) error {
 
 	for _, region := range regions {
 		region := region
-		c.register.Go(func() { c.executeForRegion(ctx, region) })
+		c.register.Go(ctx, func() { c.executeForRegion(ctx, region) })
 	}
 	return nil
 }
@@ -123,8 +191,22 @@ func (c *CreateProject) executeForRegion(ctx context.Context, region models.Regi
 	}
 
 	if project == nil || time.Since(project.CreatedAt) > c.interval {
+		account := c.neonAccounts.Pick(region, func(account *app.NeonAccount) bool {
+			return !c.paused(account.Name).IsZero()
+		})
+		if account == nil {
+			log.Info(ctx, "no neon accounts to create a project, all are paused or don't serve the region")
+			return
+		}
+		ctx := log.With(ctx, zap.String("neonAccount", account.Name))
+
 		log.Info(ctx, "creating project")
-		err := c.createProject(ctx, region)
+		err := c.createProject(ctx, account, region)
+		if errors.Is(err, neonapi.ErrQuotaExceeded) {
+			c.pause(account.Name, c.args.QuotaPause.Duration)
+			log.Warn(ctx, "quota exceeded, pausing project creation", zap.Duration("pause", c.args.QuotaPause.Duration), zap.Error(err))
+			return
+		}
 		if err != nil {
 			log.Error(ctx, "failed to create project", zap.Error(err))
 			return
@@ -132,8 +214,54 @@ func (c *CreateProject) executeForRegion(ctx context.Context, region models.Regi
 	}
 }
 
-// Create a project in the given region.
-func (c *CreateProject) createProject(ctx context.Context, region models.Region) error {
+// Returns the time until creation in the account is paused, or zero time if it's not paused.
+func (c *CreateProject) paused(account string) time.Time {
+	c.pausedMu.Lock()
+	defer c.pausedMu.Unlock()
+	until := c.pausedUntil[account]
+	if time.Now().After(until) {
+		return time.Time{}
+	}
+	return until
+}
+
+func (c *CreateProject) pause(account string, d time.Duration) {
+	c.pausedMu.Lock()
+	defer c.pausedMu.Unlock()
+	if until := time.Now().Add(d); until.After(c.pausedUntil[account]) {
+		c.pausedUntil[account] = until
+	}
+}
+
+// Role created in every project, database is created by default.
+const (
+	projectRoleName     = "testodrome"
+	projectDatabaseName = "neondb"
+)
+
+// Names of the projects created by the exitnode start with this prefix.
+func projectNamePrefix(exitnode string) string {
+	return fmt.Sprintf("test@%s-", exitnode)
+}
+
+// Returns true if the project was created by the exitnode, i.e. the name is test@<exitnode>-<seq>.
+// The prefix alone is not enough, "test@eu-west-7" was created by "eu-west", not by "eu".
+func isExitnodeProjectName(name string, exitnode string) bool {
+	seq, found := strings.CutPrefix(name, projectNamePrefix(exitnode))
+	if !found || seq == "" {
+		return false
+	}
+	for _, r := range seq {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Create a project in the given region, the project is owned by the account. The project row is
+// written first and its state is updated before every step, see models.ProjectCreating.
+func (c *CreateProject) createProject(ctx context.Context, account *app.NeonAccount, region models.Region) error {
 	projectSeqID, err := c.sequence.Next()
 	if err != nil {
 		return err
@@ -147,18 +275,64 @@ func (c *CreateProject) createProject(ctx context.Context, region models.Region)
 	suspendTimeout := c.args.SuspendTimeout.Pick()
 
 	createRequest := &neonapi.CreateProject{
-		Name:        fmt.Sprintf("test@%s-%d", c.config.Exitnode, projectSeqID),
-		Branch:      neonapi.CreateProjectBranch{RoleName: "testodrome"},
+		Name:        fmt.Sprintf("%s%d", projectNamePrefix(c.config.Exitnode), projectSeqID),
+		Branch:      neonapi.CreateProjectBranch{RoleName: projectRoleName},
 		RegionID:    region.DatabaseRegion,
 		PgVersion:   c.args.PgVersion.Pick(),
 		Provisioner: provisioner,
 	}
 
-	prep, err := c.neonClient.CreateProject(createRequest)
+	limits := c.args.Autoscaling.Pick()
+	if !limits.isDefault() {
+		createRequest.DefaultEndpointSettings = &neonapi.DefaultEndpointSettings{
+			AutoscalingLimitMinCu: limits.MinCu,
+			AutoscalingLimitMaxCu: limits.MaxCu,
+		}
+	}
+
+	modeName := c.args.Mode.Pick()
+	mode, err := c.modeRepo.Get(modeName)
+	if err != nil {
+		return fmt.Errorf("failed to get mode: %w", err)
+	}
+	if mode != nil && mode.SuspendTimeoutSeconds != nil {
+		// saved as the requested timeout, so that the resumed creation keeps it
+		suspendTimeout = *mode.SuspendTimeoutSeconds
+	}
+
+	prep, err := account.Client.CreateProject(createRequest)
 	if err != nil {
 		return err
 	}
 
+	// requested settings are saved, so that the creation can be resumed after a crash
+	dbProject := models.Project{
+		RegionID:              region.ID,
+		Name:                  createRequest.Name,
+		CreatedByExitnode:     c.config.Exitnode,
+		NeonAccount:           account.Name,
+		PgVersion:             createRequest.PgVersion,
+		Provisioner:           createRequest.Provisioner,
+		SuspendTimeoutSeconds: suspendTimeout,
+		AutoscalingMinCu:      limits.MinCu,
+		AutoscalingMaxCu:      limits.MaxCu,
+		CurrentMode:           modeName,
+		ReadReplicas:          c.args.ReadReplicas.Pick(),
+		State:                 models.ProjectCreating,
+	}
+	err = c.projectRepo.Create(&dbProject)
+	if err != nil {
+		return fmt.Errorf("failed to create project in the database: %w", err)
+	}
+	ctx = log.With(ctx, zap.Uint("dbProjectID", dbProject.ID))
+
+	// the project is not ready yet, the lock keeps recover_projects away
+	unlock := c.projectLocker.Get(dbProject.ID).TryExclusiveLock()
+	if unlock == nil {
+		return fmt.Errorf("failed to lock new project")
+	}
+	defer unlock()
+
 	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
 		ProjectID:   nil,
 		RegionID:    &region.ID,
@@ -168,117 +342,204 @@ func (c *CreateProject) createProject(ctx context.Context, region models.Region)
 
 	project, err := queryAPI(ctx, prep, saver)
 	if err != nil {
-		return err
+		return c.failCreation(ctx, &dbProject, err)
 	}
 
 	ctx = log.With(ctx, zap.String("projectID", project.Project.ID))
 
-	if err2 := c.postCreate(ctx, saver, project, suspendTimeout); err2 != nil {
-		log.Error(ctx, "failed post create", zap.Error(err2))
-		return err2
-	}
-
-	var connstr string
+	dbProject.ProjectID = project.Project.ID
+	dbProject.MainBranchID = project.Branch.ID
+	dbProject.PgVersion = project.Project.PgVersion
+	dbProject.Provisioner = project.Project.Provisioner
 	if len(project.ConnectionUris) == 1 {
-		connstr = project.ConnectionUris[0].ConnectionURI
+		dbProject.ConnectionString = project.ConnectionUris[0].ConnectionURI
 	} else {
 		log.Warn(ctx, "project has invalid number of connection strings")
 	}
+	var endpoint *neonapi.Endpoint
+	if len(project.Endpoints) == 1 {
+		endpoint = &project.Endpoints[0]
+		dbProject.EndpointID = endpoint.ID
+		// actual limits, the default ones are also saved
+		dbProject.AutoscalingMinCu = endpoint.AutoscalingLimitMinCu
+		dbProject.AutoscalingMaxCu = endpoint.AutoscalingLimitMaxCu
+	} else {
+		log.Warn(ctx, "project has invalid number of endpoints", zap.Any("endpoints", project.Endpoints))
+	}
+	dbProject.State = models.ProjectConfiguring
+	if err := c.projectRepo.Save(&dbProject); err != nil {
+		return fmt.Errorf("failed to save created project: %w", err)
+	}
 
-	mode := c.args.Mode.Pick()
-
-	dbProject := models.Project{
-		RegionID:              region.ID,
-		Name:                  project.Project.Name,
-		ProjectID:             project.Project.ID,
-		ConnectionString:      connstr,
-		CreatedByExitnode:     c.config.Exitnode,
-		PgVersion:             project.Project.PgVersion,
-		Provisioner:           project.Project.Provisioner,
-		SuspendTimeoutSeconds: suspendTimeout,
-		CurrentMode:           mode,
+	if err := c.configurator.applySettings(ctx, account.Client, saver, &dbProject, endpoint, project.Operations); err != nil {
+		log.Error(ctx, "failed post create", zap.Error(err))
+		return c.failCreation(ctx, &dbProject, err)
 	}
+	return c.configurator.finish(ctx, account.Client, saver, &dbProject)
+}
 
-	err = c.projectRepo.Create(&dbProject)
-	if err != nil {
-		return fmt.Errorf("failed to create project in the database: %w", err)
+// Marks the project as failed and returns the creation error. The project is left for delete_project
+// if it exists in Neon, otherwise the row is soft-deleted right away.
+func (c *CreateProject) failCreation(ctx context.Context, dbProject *models.Project, err error) error {
+	var stateErr error
+	if dbProject.ProjectID == "" {
+		dbProject.DeletionComment = fmt.Sprintf("create_project: %v", err)
+		stateErr = c.projectRepo.Discard(dbProject)
+	} else {
+		stateErr = c.projectRepo.UpdateState(dbProject, models.ProjectFailed)
+	}
+	if stateErr != nil {
+		log.Error(ctx, "failed to mark project as failed", zap.Error(stateErr))
 	}
+	return err
+}
 
-	return nil
+// Applies the requested settings to a project created in Neon and marks it as ready. Used by create_project,
+// and by recover_projects to resume an interrupted creation.
+type projectConfigurator struct {
+	projectRepo *repos.ProjectRepo
+	modeRepo    *repos.ModeRepo
+	replicaRepo *repos.ReplicaRepo
+	exitnode    string
+}
+
+func newProjectConfigurator(a *app.App) *projectConfigurator {
+	return &projectConfigurator{
+		projectRepo: a.Repo.Project,
+		modeRepo:    a.Repo.Mode,
+		replicaRepo: a.Repo.Replica,
+		exitnode:    a.Config.Exitnode,
+	}
 }
 
-func (c *CreateProject) postCreate(
+// Applies the endpoint settings of the mode (if defined), the requested suspend timeout and autoscaling
+// limits to the default endpoint, and saves the actual settings. ops are the operations of the creation.
+func (p *projectConfigurator) applySettings(
 	ctx context.Context,
+	neonClient *neonapi.Client,
 	saver *repos.QuerySaver,
-	project *neonapi.CreateProjectResponse,
-	suspendTimeout int,
+	dbProject *models.Project,
+	endpoint *neonapi.Endpoint,
+	ops []neonapi.Operation,
 ) error {
-	if len(project.Endpoints) != 1 {
-		log.Warn(ctx, "project has invalid number of endpoints", zap.Any("endpoints", project.Endpoints))
+	// wait until all operations are finished, otherwise we will get an error:
+	// `project already has running operations, scheduling of new ones is prohibited`
+	if err := waitOperations(ctx, neonClient, saver, dbProject.ProjectID, ops); err != nil {
+		return err
+	}
+	if endpoint == nil {
 		return nil
 	}
-	endpoint := project.Endpoints[0]
 
-	if suspendTimeout == endpoint.SuspendTimeoutSeconds {
-		return nil
+	mode, err := p.modeRepo.Get(dbProject.CurrentMode)
+	if err != nil {
+		return fmt.Errorf("failed to get mode: %w", err)
 	}
 
-	// wait until all operations are finished, otherwise we will get an error:
-	// `project already has running operations, scheduling of new ones is prohibited`
-	if err := c.waitAllOperations(ctx, saver, project); err != nil {
-		return err
+	update := &neonapi.UpdateEndpoint{}
+	if mode != nil {
+		update.AutoscalingLimitMinCu = mode.AutoscalingMinCu
+		update.AutoscalingLimitMaxCu = mode.AutoscalingMaxCu
+		update.PoolerEnabled = mode.PoolerEnabled
+		update.PoolerMode = mode.PoolerMode
+	}
+	if update.AutoscalingLimitMinCu == nil && update.AutoscalingLimitMaxCu == nil && dbProject.AutoscalingMaxCu != 0 &&
+		(dbProject.AutoscalingMinCu != endpoint.AutoscalingLimitMinCu || dbProject.AutoscalingMaxCu != endpoint.AutoscalingLimitMaxCu) {
+		update.AutoscalingLimitMinCu = &dbProject.AutoscalingMinCu
+		update.AutoscalingLimitMaxCu = &dbProject.AutoscalingMaxCu
+	}
+	if dbProject.SuspendTimeoutSeconds != endpoint.SuspendTimeoutSeconds {
+		suspendTimeout := dbProject.SuspendTimeoutSeconds
+		update.SuspendTimeoutSeconds = &suspendTimeout
 	}
 
-	log.Info(ctx, "updating suspend timeout", zap.Int("old", endpoint.SuspendTimeoutSeconds), zap.Int("new", suspendTimeout))
-	prep, err := c.neonClient.UpdateEndpoint(project.Project.ID, endpoint.ID, &neonapi.UpdateEndpoint{
-		SuspendTimeoutSeconds: &suspendTimeout,
-	})
-	if err != nil {
-		return err
+	if *update != (neonapi.UpdateEndpoint{}) {
+		log.Info(ctx, "updating endpoint settings", zap.Int("oldSuspendTimeout", endpoint.SuspendTimeoutSeconds), zap.Any("update", update))
+		prep, err := neonClient.UpdateEndpoint(dbProject.ProjectID, endpoint.ID, update)
+		if err != nil {
+			return err
+		}
+		resp, err := queryAPIWhenUnlocked(ctx, neonClient, prep, saver, dbProject.ProjectID)
+		if err != nil {
+			return err
+		}
+		if err := waitOperations(ctx, neonClient, saver, dbProject.ProjectID, resp.Operations); err != nil {
+			return err
+		}
+		endpoint = resp.Endpoint
 	}
 
-	_, err = queryAPI(ctx, prep, saver)
-	return err
+	dbProject.SuspendTimeoutSeconds = endpoint.SuspendTimeoutSeconds
+	dbProject.AutoscalingMinCu = endpoint.AutoscalingLimitMinCu
+	dbProject.AutoscalingMaxCu = endpoint.AutoscalingLimitMaxCu
+	if err := p.projectRepo.UpdateEndpointSettings(dbProject); err != nil {
+		return fmt.Errorf("failed to save endpoint settings: %w", err)
+	}
+	return nil
 }
 
-func (c *CreateProject) waitAllOperations(ctx context.Context, saver *repos.QuerySaver, project *neonapi.CreateProjectResponse) error {
-	// project.Operations has a list of running operations, but it's not convenient to poll them one by one
-	prep, err := c.neonClient.GetOperations(project.Project.ID)
-	if err != nil {
-		return err
+// Marks the project as ready and creates the requested read replicas.
+func (p *projectConfigurator) finish(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	dbProject *models.Project,
+) error {
+	if err := p.projectRepo.UpdateState(dbProject, models.ProjectReady); err != nil {
+		return fmt.Errorf("failed to update project state: %w", err)
 	}
 
-	const startInterval = 2 * time.Second
-	const maxInterval = 60 * time.Second
+	if dbProject.ReadReplicas > 0 {
+		projectSaver := saver.With(repos.QuerySaverArgs{ProjectID: &dbProject.ID, ProjectMode: &dbProject.CurrentMode})
+		if err := p.createReplicas(ctx, neonClient, projectSaver, dbProject, dbProject.ReadReplicas); err != nil {
+			return fmt.Errorf("failed to create read replicas: %w", err)
+		}
+	}
+	return nil
+}
 
-	sleepInterval := startInterval
+// Creates read-only endpoints on the default branch of the created project.
+func (p *projectConfigurator) createReplicas(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	dbProject *models.Project,
+	n int,
+) error {
+	prep, err := neonClient.CreateEndpoint(dbProject.ProjectID, &neonapi.CreateEndpoint{
+		BranchID: dbProject.MainBranchID,
+		Type:     "read_only",
+	})
+	if err != nil {
+		return err
+	}
 
-	for {
-		ops, err := queryAPI(ctx, prep, saver)
+	projectID := dbProject.ProjectID
+	for i := 0; i < n; i++ {
+		log.Info(ctx, "creating read replica")
+		resp, err := queryAPIWhenUnlocked(ctx, neonClient, prep, saver, projectID)
 		if err != nil {
 			return err
 		}
-
-		allFinished := true
-
-		for _, op := range ops.Operations {
-			if op.Status != "finished" {
-				log.Debug(ctx, "operation not finished", zap.Any("operation", op))
-				allFinished = false
-				break
-			}
+		if err := waitOperations(ctx, neonClient, saver, projectID, resp.Operations); err != nil {
+			return err
 		}
 
-		if allFinished {
-			break
+		connstr, err := replaceHost(dbProject.ConnectionString, resp.Endpoint.Host)
+		if err != nil {
+			return err
 		}
 
-		time.Sleep(sleepInterval)
-		sleepInterval += sleepInterval / 2
-		if sleepInterval > maxInterval {
-			sleepInterval = maxInterval
+		replica := models.ReadReplica{
+			ProjectID:         dbProject.ID,
+			EndpointID:        resp.Endpoint.ID,
+			ConnectionString:  connstr,
+			CreatedByExitnode: p.exitnode,
 		}
+		if err := p.replicaRepo.Create(&replica); err != nil {
+			return fmt.Errorf("failed to create replica in the database: %w", err)
+		}
+		log.Info(ctx, "read replica created", zap.String("endpointID", replica.EndpointID))
 	}
-
 	return nil
 }
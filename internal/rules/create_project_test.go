@@ -0,0 +1,46 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateProject_pause(t *testing.T) {
+	c := &CreateProject{pausedUntil: make(map[string]time.Time)}
+	assert.True(t, c.paused("a").IsZero())
+
+	c.pause("a", time.Hour)
+	until := c.paused("a")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), until, time.Minute)
+	// other accounts are not paused
+	assert.True(t, c.paused("b").IsZero())
+
+	// shorter pause doesn't shorten the current one
+	c.pause("a", time.Second)
+	assert.Equal(t, until, c.paused("a"))
+
+	c.pausedUntil["a"] = time.Now().Add(-time.Second)
+	assert.True(t, c.paused("a").IsZero())
+}
+
+func TestAutoscalingLimits_validate(t *testing.T) {
+	assert.NoError(t, AutoscalingLimits{}.validate())
+	assert.NoError(t, AutoscalingLimits{MinCu: 0.25, MaxCu: 2}.validate())
+	assert.NoError(t, AutoscalingLimits{MinCu: 1, MaxCu: 1}.validate())
+
+	assert.Error(t, AutoscalingLimits{MinCu: 2, MaxCu: 1}.validate())
+	assert.Error(t, AutoscalingLimits{MaxCu: 1}.validate())
+	assert.Error(t, AutoscalingLimits{MinCu: -1, MaxCu: 1}.validate())
+}
+
+func Test_isExitnodeProjectName(t *testing.T) {
+	assert.True(t, isExitnodeProjectName("test@eu-7", "eu"))
+	assert.True(t, isExitnodeProjectName("test@eu-west-7", "eu-west"))
+
+	assert.False(t, isExitnodeProjectName("test@eu-west-7", "eu"))
+	assert.False(t, isExitnodeProjectName("test@eu-", "eu"))
+	assert.False(t, isExitnodeProjectName("test@eu-7a", "eu"))
+	assert.False(t, isExitnodeProjectName("other@eu-7", "eu"))
+}
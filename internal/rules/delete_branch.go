@@ -0,0 +1,168 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to delete the oldest branches in random projects, when there are more than BranchesN branches.
+type DeleteBranch struct {
+	args           DeleteBranchArgs
+	projectFilters []repos.Filter
+	projectRepo    *repos.ProjectRepo
+	branchRepo     *repos.BranchRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
+	register       *bgjobs.Register
+	exitnode       string
+	projectLocker  *bgjobs.ProjectLocker
+}
+
+type DeleteBranchArgs struct {
+	// Target number of branches in a project. Oldest branches are deleted if there are more.
+	BranchesN         int
+	MaxRandomProjects uint
+	RawProjectFilter  string
+}
+
+// Only projects with branches are selected.
+var projectHasBranches = repos.RawFilter(
+	"EXISTS (SELECT 1 FROM branches WHERE branches.project_id = projects.id AND branches.deleted_at IS NULL)",
+)
+
+func NewDeleteBranch(a *app.App, j json.RawMessage) (*DeleteBranch, error) {
+	var args DeleteBranchArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.BranchesN < 0 {
+		return nil, fmt.Errorf("BranchesN cant be negative")
+	}
+	if args.MaxRandomProjects < 1 {
+		args.MaxRandomProjects = 1
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	projectFilters = append(projectFilters, projectHasBranches)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &DeleteBranch{
+		args:           args,
+		projectFilters: projectFilters,
+		projectRepo:    a.Repo.Project,
+		branchRepo:     a.Repo.Branch,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
+		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
+		projectLocker:  a.ProjectLocker,
+	}, nil
+}
+
+func (c *DeleteBranch) Execute(ctx context.Context) error {
+	projects, err := c.projectRepo.FindRandomProjects(c.projectFilters, int(c.args.MaxRandomProjects))
+	if err != nil {
+		return fmt.Errorf("failed to find random projects: %w", err)
+	}
+
+	for _, project := range projects {
+		project := project
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID))
+		c.register.Go(ctx, func() {
+			if err := c.executeForProject(ctx, &project); err != nil {
+				log.Error(ctx, "failed to delete branches", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+func (c *DeleteBranch) executeForProject(ctx context.Context, project *models.Project) error {
+	// exclusive lock, so that deleted branches are not queried
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	branches, err := c.branchRepo.FindByProject(project.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find branches: %w", err)
+	}
+	if len(branches) <= c.args.BranchesN {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	// oldest first
+	for i := range branches[:len(branches)-c.args.BranchesN] {
+		if err := c.deleteBranch(ctx, neonClient, saver, project, &branches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DeleteBranch) deleteBranch(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+	branch *models.Branch,
+) error {
+	ctx = log.With(ctx, zap.String("branchID", branch.BranchID))
+
+	prep, err := neonClient.DeleteBranch(project.ProjectID, branch.BranchID)
+	if err != nil {
+		return err
+	}
+
+	branchSaver := saver.With(repos.QuerySaverArgs{BranchID: &branch.ID})
+
+	log.Info(ctx, "deleting branch")
+	resp, err := queryAPI(ctx, prep, branchSaver)
+	if errors.Is(err, neonapi.ErrNotFound) {
+		log.Warn(ctx, "branch not found, treating as already deleted", zap.Error(err))
+		return c.branchRepo.Delete(branch)
+	}
+	if err != nil {
+		return err
+	}
+	if err := waitOperations(ctx, neonClient, branchSaver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+
+	return c.branchRepo.Delete(branch)
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -14,32 +16,60 @@ import (
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
 	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
 	"github.com/petuhovskiy/neon-lights/internal/repos"
 )
 
-// Rule to delete random projects when there are too many projects with the similar configuration (matrix).
+// Rule to delete projects selected by the deletion policies, e.g. when there are too many projects with
+// the similar configuration (matrix). The reason of every deletion is saved to Project.DeletionComment.
 type DeleteProject struct {
 	args           DeleteProjectArgs
 	projectFilters []repos.Filter
 	projectRepo    *repos.ProjectRepo
+	deleter        *projectDeleter
 	queryRepo      *repos.QueryRepo
-	neonClient     *neonapi.Client
+	neonAccounts   *app.NeonAccounts
 	register       *bgjobs.Register
 	exitnode       string
 	projectLocker  *bgjobs.ProjectLocker
 }
 
+// Deletion policies, every policy selects projects for deletion.
+const (
+	// Delete the middle-aged project, if there are more than ProjectsN projects with the same Matrix.
+	DeletePolicyMatrix = "matrix"
+	// Delete projects older than MaxAge.
+	DeletePolicyAge = "age"
+	// Delete projects of this exitnode that failed to be created or deleted, and are still in this
+	// state after StuckFor. This is the only rule that deletes failed projects, projects in
+	// intermediate states are left to recover_projects, which knows how to finish interrupted steps.
+	DeletePolicyFailed = "failed"
+	// Delete projects that were not queried for MaxIdle.
+	DeletePolicyIdle = "idle"
+)
+
 type DeleteProjectArgs struct {
+	// Policies are applied in order, until MaxDeletions projects are deleted. Default is DeletePolicyMatrix.
+	Policies []string
+	// Max number of projects deleted per execution, by all policies. Default is 1.
+	MaxDeletions int
 	// Target number of projects. Project will be deleted if there are more than this number of projects.
 	ProjectsN         int
 	SkipFailedQueries *SkipFailedQueries
 	// Matrix is a list of project fields to compare. Used to determine similar projects that can be deleted.
 	Matrix           []string
 	RawProjectFilter string
+	// Used by DeletePolicyAge.
+	MaxAge rdesc.Duration
+	// Used by DeletePolicyFailed. Default is 1 hour.
+	StuckFor rdesc.Duration
+	// Used by DeletePolicyIdle.
+	MaxIdle rdesc.Duration
 }
 
 type SkipFailedQueries struct {
 	// If true, projects with last failed or unfinished queries will not be deleted.
+	// Not applied to DeletePolicyFailed.
 	Enabled bool
 	// Number of last queries to check.
 	QueriesN int
@@ -55,8 +85,14 @@ var defaultMatrix = []string{
 	"projects.pg_version",
 	"projects.provisioner",
 	"projects.suspend_timeout_seconds",
+	"projects.autoscaling_min_cu",
+	"projects.autoscaling_max_cu",
 }
 
+var defaultDeletePolicies = []string{DeletePolicyMatrix}
+
+var defaultStuckFor = rdesc.Duration{Duration: time.Hour}
+
 func NewDeleteProject(a *app.App, j json.RawMessage) (*DeleteProject, error) {
 	var args DeleteProjectArgs
 	err := json.Unmarshal(j, &args)
@@ -76,6 +112,31 @@ func NewDeleteProject(a *app.App, j json.RawMessage) (*DeleteProject, error) {
 		args.Matrix = defaultMatrix
 	}
 
+	if args.Policies == nil {
+		args.Policies = defaultDeletePolicies
+	}
+	if args.MaxDeletions < 1 {
+		args.MaxDeletions = 1
+	}
+	if args.StuckFor.Duration == 0 {
+		args.StuckFor = defaultStuckFor
+	}
+	for _, policy := range args.Policies {
+		switch policy {
+		case DeletePolicyMatrix, DeletePolicyFailed:
+		case DeletePolicyAge:
+			if args.MaxAge.Duration <= 0 {
+				return nil, fmt.Errorf("MaxAge must be set for the %s policy", policy)
+			}
+		case DeletePolicyIdle:
+			if args.MaxIdle.Duration <= 0 {
+				return nil, fmt.Errorf("MaxIdle must be set for the %s policy", policy)
+			}
+		default:
+			return nil, fmt.Errorf("unknown deletion policy: %s", policy)
+		}
+	}
+
 	var projectFilters []repos.Filter
 	projectFilters = append(projectFilters, a.RegionFilters...)
 	if args.RawProjectFilter != "" {
@@ -86,25 +147,104 @@ func NewDeleteProject(a *app.App, j json.RawMessage) (*DeleteProject, error) {
 		args:           args,
 		projectFilters: projectFilters,
 		projectRepo:    a.Repo.Project,
+		deleter:        newProjectDeleter(a),
 		queryRepo:      a.Repo.Query,
-		neonClient:     a.NeonClient,
+		neonAccounts:   a.NeonAccounts,
 		register:       a.Register,
 		exitnode:       a.Config.Exitnode,
 		projectLocker:  a.ProjectLocker,
 	}, nil
 }
 
+// Project selected by a policy.
+type deletionCandidate struct {
+	project models.Project
+	policy  string
+	// Saved to Project.DeletionComment.
+	comment string
+}
+
 func (c *DeleteProject) Execute(ctx context.Context) error {
-	// selecting random project to get a random matrix
-	project, err := c.randomProject()
-	if err != nil {
-		return err
-	}
-	if project == nil {
-		return nil
+	var errs []error
+	deleted := 0
+	for _, policy := range c.args.Policies {
+		if deleted >= c.args.MaxDeletions {
+			break
+		}
+
+		candidates, err := c.selectProjects(ctx, policy, c.args.MaxDeletions-deleted)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy %s: %w", policy, err))
+			continue
+		}
+
+		for i := range candidates {
+			candidate := &candidates[i]
+			ctx := log.With(ctx, zap.Uint("projectID", candidate.project.ID), zap.String("policy", policy))
+			log.Info(ctx, "selected project for deletion", zap.String("comment", candidate.comment))
+
+			if err := c.deleteProject(ctx, candidate); err != nil {
+				errs = append(errs, fmt.Errorf("project %d: %w", candidate.project.ID, err))
+				continue
+			}
+			deleted++
+		}
 	}
+	return errors.Join(errs...)
+}
+
+// Returns up to n projects selected by the policy.
+func (c *DeleteProject) selectProjects(ctx context.Context, policy string, n int) ([]deletionCandidate, error) {
+	var candidates []deletionCandidate
+	switch policy {
+	case DeletePolicyMatrix:
+		project, err := c.randomProject()
+		if err != nil || project == nil {
+			return nil, err
+		}
+		candidate, err := c.selectFromMatrix(ctx, project, c.args.Matrix)
+		if err != nil || candidate == nil {
+			return nil, err
+		}
+		candidates = append(candidates, *candidate)
 
-	return c.executeForMatrix(ctx, project, c.args.Matrix)
+	case DeletePolicyAge:
+		filters := append([]repos.Filter{repos.FilterCreatedBefore(time.Now().Add(-c.args.MaxAge.Duration))}, c.projectFilters...)
+		projects, err := c.projectRepo.FindRandomProjects(filters, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range projects {
+			comment := fmt.Sprintf("%s: created at %s, older than %s", policy, project.CreatedAt.UTC().Format(time.RFC3339), c.args.MaxAge.Duration)
+			candidates = append(candidates, deletionCandidate{project: project, policy: policy, comment: comment})
+		}
+
+	case DeletePolicyFailed:
+		states := []string{models.ProjectFailed, models.ProjectDeleteFailed}
+		projects, err := c.projectRepo.FindByStates(c.exitnode, states, time.Now().Add(-c.args.StuckFor.Duration), c.projectFilters)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range projects {
+			if len(candidates) >= n {
+				break
+			}
+			comment := fmt.Sprintf("%s: in the %s state since %s", policy, project.State, project.UpdatedAt.UTC().Format(time.RFC3339))
+			candidates = append(candidates, deletionCandidate{project: project, policy: policy, comment: comment})
+		}
+
+	case DeletePolicyIdle:
+		filters := append([]repos.Filter{repos.FilterIdleProjects(time.Now().Add(-c.args.MaxIdle.Duration))}, c.projectFilters...)
+		projects, err := c.projectRepo.FindRandomProjects(filters, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range projects {
+			comment := fmt.Sprintf("%s: not queried for %s", policy, c.args.MaxIdle.Duration)
+			candidates = append(candidates, deletionCandidate{project: project, policy: policy, comment: comment})
+		}
+	}
+	return candidates, nil
 }
 
 func (c *DeleteProject) randomProject() (*models.Project, error) {
@@ -119,20 +259,20 @@ func (c *DeleteProject) randomProject() (*models.Project, error) {
 	return &projects[0], nil
 }
 
-// Execute rule for a specified matrix. Will delete a project only if the are too many.
-func (c *DeleteProject) executeForMatrix(ctx context.Context, matrixProject *models.Project, matrix []string) error {
+// Selects a project for a specified matrix. Returns a project only if there are too many.
+func (c *DeleteProject) selectFromMatrix(ctx context.Context, matrixProject *models.Project, matrix []string) (*deletionCandidate, error) {
 	ctx = log.With(ctx, zap.Any("matrix", matrix))
 	// TODO: add exact matrix params with gorm?
 
 	filters, err := repos.MatrixFilters(matrixProject, matrix)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	filters = append(filters, c.projectFilters...)
 
 	projects, err := c.projectRepo.FindRandomProjects(filters, c.args.ProjectsN+1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	commonFeatures := models.CommonProjectFeatures(projects)
@@ -140,7 +280,7 @@ func (c *DeleteProject) executeForMatrix(ctx context.Context, matrixProject *mod
 	log.Info(ctx, "selected projects", zap.Int("count", len(projects)))
 
 	if len(projects) <= c.args.ProjectsN {
-		return nil
+		return nil, nil
 	}
 
 	// take only N projects
@@ -154,15 +294,17 @@ func (c *DeleteProject) executeForMatrix(ctx context.Context, matrixProject *mod
 	})
 
 	// take the middle project, because we don't want to take too old and too new projects
-	project := projects[len(projects)/2]
-	ctx = log.With(ctx, zap.Uint("projectID", project.ID))
-	log.Info(ctx, "selected project for deletion")
-
-	return c.deleteProject(ctx, &project)
+	return &deletionCandidate{
+		project: projects[len(projects)/2],
+		policy:  DeletePolicyMatrix,
+		comment: fmt.Sprintf("%s: more than %d projects with the same %s", DeletePolicyMatrix, c.args.ProjectsN, strings.Join(matrix, ", ")),
+	}, nil
 }
 
-// Delete a project.
-func (c *DeleteProject) deleteProject(ctx context.Context, projectDB *models.Project) error {
+// Delete a project selected by a policy.
+func (c *DeleteProject) deleteProject(ctx context.Context, candidate *deletionCandidate) error {
+	projectDB := &candidate.project
+
 	// TODO: kill background jobs for this project and wait for them to finish
 	projectLock := c.projectLocker.Get(projectDB.ID)
 	unlock := projectLock.TryExclusiveLock()
@@ -175,53 +317,95 @@ func (c *DeleteProject) deleteProject(ctx context.Context, projectDB *models.Pro
 		return errors.New("project is already deleted")
 	}
 
-	if c.args.SkipFailedQueries.Enabled {
+	// failed projects usually have failed queries
+	if c.args.SkipFailedQueries.Enabled && candidate.policy != DeletePolicyFailed {
 		err := c.hasRecentFailedQueries(projectDB)
 		if err != nil {
 			return err
 		}
 	}
 
-	// preparing a query
-	prep, err := c.neonClient.DeleteProject(projectDB.ProjectID)
+	neonClient, err := c.neonAccounts.Client(projectDB.NeonAccount)
 	if err != nil {
 		return err
 	}
 
-	dbQuery := prep.Query(&projectDB.ID, projectDB.RegionID, c.exitnode)
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID: &projectDB.ID,
+		RegionID:  &projectDB.RegionID,
+		Exitnode:  &c.exitnode,
+	})
 
-	// 1. save delete_project query to db
-	err = c.queryRepo.Save(dbQuery)
-	if err != nil {
-		return fmt.Errorf("failed to perist delete_project query: %w", err)
+	if err := c.deleter.delete(ctx, neonClient, saver, projectDB, candidate.comment); err != nil {
+		return err
 	}
 
-	// 2. set deleted_at in db
-	err = c.projectRepo.Delete(projectDB)
-	if err != nil {
-		return err
+	log.Info(ctx, "project deleted")
+	projectLock.Deleted.Store(true)
+
+	c.projectLocker.Delete(projectDB.ID)
+	return nil
+}
+
+// Deletes projects in Neon and then in the database. The caller must hold the exclusive project lock.
+type projectDeleter struct {
+	projectRepo *repos.ProjectRepo
+	branchRepo  *repos.BranchRepo
+	replicaRepo *repos.ReplicaRepo
+}
+
+func newProjectDeleter(a *app.App) *projectDeleter {
+	return &projectDeleter{
+		projectRepo: a.Repo.Project,
+		branchRepo:  a.Repo.Branch,
+		replicaRepo: a.Repo.Replica,
 	}
+}
 
-	// 3. call API
-	_, result, err := prep.Do(ctx)
+// Deletes the project, comment is the reason of the deletion.
+func (d *projectDeleter) delete(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+	comment string,
+) error {
+	// 1. mark as deleting, the project is not queried anymore
+	if err := d.projectRepo.MarkDeleting(project, comment); err != nil {
+		return fmt.Errorf("failed to update project state: %w", err)
+	}
 
-	dbErr := c.queryRepo.FinishSaveResult(dbQuery, result)
-	if dbErr != nil {
-		log.Error(ctx, "failed to persist query result", zap.Error(dbErr))
-		if err == nil {
-			err = dbErr
-		} else {
-			err = errors.Join(err, dbErr)
+	// 2. call API, every attempt is saved to db. Projects without ID were never created in Neon.
+	if project.ProjectID != "" {
+		prep, err := neonClient.DeleteProject(project.ProjectID)
+		if err != nil {
+			return err
+		}
+		_, err = queryAPI(ctx, prep, saver)
+		if errors.Is(err, neonapi.ErrNotFound) {
+			log.Warn(ctx, "project not found, treating as already deleted", zap.Error(err))
+			err = nil
+		}
+		if err != nil {
+			if stateErr := d.projectRepo.UpdateState(project, models.ProjectDeleteFailed); stateErr != nil {
+				log.Error(ctx, "failed to update project state", zap.Error(stateErr))
+			}
+			return err
 		}
 	}
-	if err != nil {
+
+	// 3. set deleted_at in db
+	if err := d.projectRepo.Delete(project); err != nil {
 		return err
 	}
 
-	log.Info(ctx, "project deleted")
-	projectLock.Deleted.Store(true)
-
-	c.projectLocker.Delete(projectDB.ID)
+	// branches and endpoints are deleted together with the project
+	if err := d.branchRepo.DeleteByProject(project.ID); err != nil {
+		log.Error(ctx, "failed to delete project branches", zap.Error(err))
+	}
+	if err := d.replicaRepo.DeleteByProject(project.ID); err != nil {
+		log.Error(ctx, "failed to delete project replicas", zap.Error(err))
+	}
 	return nil
 }
 
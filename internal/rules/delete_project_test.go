@@ -0,0 +1,34 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+)
+
+func TestNewDeleteProject_policies(t *testing.T) {
+	a := &app.App{Config: &conf.App{}, Repo: &app.Repos{}}
+
+	c, err := NewDeleteProject(a, json.RawMessage(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{DeletePolicyMatrix}, c.args.Policies)
+	assert.Equal(t, 1, c.args.MaxDeletions)
+	assert.Equal(t, time.Hour, c.args.StuckFor.Duration)
+
+	c, err = NewDeleteProject(a, json.RawMessage(`{"Policies": ["failed", "age", "idle"], "MaxAge": "168h", "MaxIdle": "24h", "MaxDeletions": 5}`))
+	require.NoError(t, err)
+	assert.Equal(t, 5, c.args.MaxDeletions)
+
+	_, err = NewDeleteProject(a, json.RawMessage(`{"Policies": ["age"]}`))
+	assert.Error(t, err)
+	_, err = NewDeleteProject(a, json.RawMessage(`{"Policies": ["idle"]}`))
+	assert.Error(t, err)
+	_, err = NewDeleteProject(a, json.RawMessage(`{"Policies": ["unknown"]}`))
+	assert.Error(t, err)
+}
@@ -8,7 +8,9 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
 	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
 	"github.com/petuhovskiy/neon-lights/internal/rdesc"
 )
 
@@ -76,8 +78,14 @@ func (e *Executor) executeOnce(ctx context.Context, r *Rule) error {
 
 	ctx = log.Into(ctx, string(r.desc.Act))
 	if r.desc.Timeout != nil {
-		// we don't want to cancel context, because Execute can do background work
-		ctx, _ = context.WithTimeout(ctx, r.desc.Timeout.Duration) //nolint:govet
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.desc.Timeout.Duration)
+		// queries cut off by the rule timeout are cancelled, not timed out
+		ctx = models.WithRuleDeadline(ctx)
+		// Execute can do background work, the context is canceled once it's finished
+		var jobs *bgjobs.Group
+		ctx, jobs = bgjobs.WithGroup(ctx)
+		defer jobs.AfterAll(cancel)
 	}
 	err := r.impl.Execute(ctx)
 
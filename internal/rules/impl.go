@@ -29,6 +29,24 @@ func loadImpl(base *app.App, executor *Executor, desc rdesc.Rule) (RuleImpl, err
 		return NewChangeMode(base, desc.Args)
 	case rdesc.ActTest:
 		return NewTestRule(base, desc.Args)
+	case rdesc.ActCheckCertificates:
+		return NewCheckCertificates(base, desc.Args)
+	case rdesc.ActCreateBranch:
+		return NewCreateBranch(base, desc.Args)
+	case rdesc.ActDeleteBranch:
+		return NewDeleteBranch(base, desc.Args)
+	case rdesc.ActControlEndpoint:
+		return NewControlEndpoint(base, desc.Args)
+	case rdesc.ActUpdateAutoscaling:
+		return NewUpdateAutoscaling(base, desc.Args)
+	case rdesc.ActReconcileProjects:
+		return NewReconcileProjects(base, desc.Args)
+	case rdesc.ActCollectConsumption:
+		return NewCollectConsumption(base, desc.Args)
+	case rdesc.ActRotatePassword:
+		return NewRotatePassword(base, desc.Args)
+	case rdesc.ActRecoverProjects:
+		return NewRecoverProjects(base, desc.Args)
 	default:
 		return nil, fmt.Errorf("unknown rule act %s: %w", desc.Act, ErrUnknownRule)
 	}
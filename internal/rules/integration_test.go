@@ -0,0 +1,496 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/conf"
+	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonfake"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+)
+
+// Creates an app connected to TEST_POSTGRES_DSN and the fake Neon API. Every call uses a new
+// exitnode and provider, so tests don't see each other's projects and regions.
+// Tests are skipped without the database, except in CI, where Postgres is provided by the workflow.
+func newIntegrationApp(t *testing.T, opts neonfake.Options) (*app.App, *neonfake.Server, models.Region) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("TEST_POSTGRES_DSN must be set in CI")
+		}
+		t.Skip("TEST_POSTGRES_DSN is not set, run `make test-integration` with a Postgres database")
+	}
+
+	fake := neonfake.NewServer(opts)
+	t.Cleanup(fake.Close)
+
+	suffix := time.Now().UnixNano()
+	a, err := app.NewApp(&conf.App{
+		PostgresDSN:            dsn,
+		Exitnode:               fmt.Sprintf("it-%d", suffix),
+		Provider:               fmt.Sprintf("fake-%d", suffix),
+		NeonAPIKey:             "key",
+		NeonAPIURL:             fake.URL,
+		NeonAPITimeout:         10 * time.Second,
+		NeonAPIMaxAttempts:     3,
+		NeonAPIRetryMinBackoff: 10 * time.Millisecond,
+		NeonAPIRetryMaxBackoff: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	region := models.Region{Provider: a.Config.Provider, DatabaseRegion: "aws-test-1"}
+	require.NoError(t, a.DB.Create(&region).Error)
+	return a, fake, region
+}
+
+// Saves the project of the app exitnode in the region, the project is also created in the fake if inNeon is set.
+// State is ready if not set.
+func createTestProject(
+	t *testing.T,
+	a *app.App,
+	fake *neonfake.Server,
+	region models.Region,
+	project models.Project,
+	inNeon bool,
+) *models.Project {
+	project.RegionID = region.ID
+	project.CreatedByExitnode = a.Config.Exitnode
+	if project.State == "" {
+		project.State = models.ProjectReady
+	}
+	if inNeon {
+		project.ProjectID = fake.AddProject(project.Name, region.DatabaseRegion)
+	}
+	require.NoError(t, a.Repo.Project.Create(&project))
+	return &project
+}
+
+func TestIntegration_createAndDeleteProject(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+
+	create, err := NewCreateProject(a, json.RawMessage(`{"SuspendTimeout": [{"Weight": 1, "Item": 1}]}`))
+	require.NoError(t, err)
+	account, err := a.NeonAccounts.Get(app.DefaultNeonAccount)
+	require.NoError(t, err)
+	require.NoError(t, create.createProject(ctx, account, region))
+
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	project := projects[0]
+	assert.Equal(t, app.DefaultNeonAccount, project.NeonAccount)
+	assert.Equal(t, models.ProjectReady, project.State)
+	assert.NotEmpty(t, project.ConnectionString)
+	assert.NotEmpty(t, project.EndpointID)
+	_, ok := fake.Project(project.ProjectID)
+	assert.True(t, ok)
+
+	del, err := NewDeleteProject(a, json.RawMessage(`{"SkipFailedQueries": {"Enabled": false}}`))
+	require.NoError(t, err)
+	require.NoError(t, del.deleteProject(ctx, &deletionCandidate{project: project, policy: DeletePolicyMatrix, comment: "test"}))
+
+	_, ok = fake.Project(project.ProjectID)
+	assert.False(t, ok)
+	assert.Equal(t, models.ProjectDeleted, project.State)
+	assert.Equal(t, "test", project.DeletionComment)
+}
+
+func TestIntegration_createProjectQuota(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{MaxProjects: 1})
+	fake.AddProject("other", region.DatabaseRegion)
+
+	create, err := NewCreateProject(a, json.RawMessage(`{}`))
+	require.NoError(t, err)
+	create.executeForRegion(context.Background(), region)
+
+	assert.True(t, create.paused(app.DefaultNeonAccount).After(time.Now()))
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, models.ProjectFailed, projects[0].State)
+	assert.True(t, projects[0].DeletedAt.Valid)
+
+	// the failed attempt doesn't delay the next one
+	last, err := a.Repo.Project.FindLastCreatedProject(region.ID)
+	require.NoError(t, err)
+	assert.Nil(t, last)
+}
+
+func TestIntegration_deletePolicies(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+	prefix := projectNamePrefix(a.Config.Exitnode)
+	now := time.Now()
+
+	twoDaysAgo := now.Add(-48 * time.Hour)
+
+	old := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: twoDaysAgo}, Name: prefix + "1"}, true)
+	queried := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: twoDaysAgo}, Name: prefix + "2"}, true)
+	require.NoError(t, a.Repo.Query.Save(&models.Query{ProjectID: &queried.ID, Kind: models.QueryDB}))
+	young := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: now}, Name: prefix + "3"}, true)
+	failed := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: twoDaysAgo}, Name: prefix + "4", State: models.ProjectFailed}, true)
+	deleteFailed := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: twoDaysAgo}, Name: prefix + "5", State: models.ProjectDeleteFailed}, true)
+	// left to recover_projects
+	creating := createTestProject(t, a, fake, region, models.Project{Model: gorm.Model{CreatedAt: twoDaysAgo}, Name: prefix + "6", State: models.ProjectCreating}, false)
+	// FindByStates compares updated_at, which is set on creation
+	require.NoError(t, a.DB.Model(&models.Project{}).
+		Where("id IN ?", []uint{failed.ID, deleteFailed.ID, creating.ID}).
+		UpdateColumn("updated_at", twoDaysAgo).Error)
+
+	del, err := NewDeleteProject(a, json.RawMessage(`{"Policies": ["age", "idle", "failed"], "MaxAge": "24h", "MaxIdle": "1h", "MaxDeletions": 2, "SkipFailedQueries": {"Enabled": false}}`))
+	require.NoError(t, err)
+
+	selectedIDs := func(policy string) []uint {
+		candidates, err := del.selectProjects(ctx, policy, 10)
+		require.NoError(t, err)
+		var ids []uint
+		for _, candidate := range candidates {
+			assert.Equal(t, policy, candidate.policy)
+			assert.Contains(t, candidate.comment, policy+": ")
+			ids = append(ids, candidate.project.ID)
+		}
+		return ids
+	}
+	assert.ElementsMatch(t, []uint{old.ID, queried.ID}, selectedIDs(DeletePolicyAge))
+	assert.ElementsMatch(t, []uint{old.ID}, selectedIDs(DeletePolicyIdle))
+	assert.ElementsMatch(t, []uint{failed.ID, deleteFailed.ID}, selectedIDs(DeletePolicyFailed))
+
+	// the failed policy applies the project filters
+	filtered, err := NewDeleteProject(a, json.RawMessage(fmt.Sprintf(`{"Policies": ["failed"], "RawProjectFilter": "projects.id <> %d"}`, failed.ID)))
+	require.NoError(t, err)
+	candidates, err := filtered.selectProjects(ctx, DeletePolicyFailed, 10)
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	assert.Equal(t, deleteFailed.ID, candidates[0].project.ID)
+
+	// the age policy selects 2 projects, MaxDeletions stops the other policies
+	require.NoError(t, del.Execute(ctx))
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	byID := make(map[uint]models.Project)
+	for _, project := range projects {
+		byID[project.ID] = project
+	}
+	for _, project := range []*models.Project{old, queried} {
+		assert.Equal(t, models.ProjectDeleted, byID[project.ID].State)
+		assert.Contains(t, byID[project.ID].DeletionComment, "age: ")
+		_, ok := fake.Project(project.ProjectID)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, models.ProjectReady, byID[young.ID].State)
+	assert.Equal(t, models.ProjectFailed, byID[failed.ID].State)
+	assert.Equal(t, models.ProjectDeleteFailed, byID[deleteFailed.ID].State)
+	assert.Equal(t, models.ProjectCreating, byID[creating.ID].State)
+}
+
+func TestIntegration_collectConsumption(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+	prefix := projectNamePrefix(a.Config.Exitnode)
+
+	account, err := a.NeonAccounts.Get(app.DefaultNeonAccount)
+	require.NoError(t, err)
+
+	var ids []uint
+	for i := 1; i <= 3; i++ {
+		projectID := fake.AddProject(fmt.Sprintf("%s%d", prefix, i), region.DatabaseRegion)
+		prep, err := account.Client.ListEndpoints(projectID)
+		require.NoError(t, err)
+		endpoints, _, err := prep.Do(ctx)
+		require.NoError(t, err)
+		require.Len(t, endpoints.Endpoints, 1)
+		endpointID := endpoints.Endpoints[0].ID
+		// suspended, operations of the fake are finished by the next request
+		suspend, err := account.Client.SuspendEndpoint(projectID, endpointID)
+		require.NoError(t, err)
+		_, _, err = suspend.Do(ctx)
+		require.NoError(t, err)
+
+		project := createTestProject(t, a, fake, region, models.Project{
+			Name:       fmt.Sprintf("%s%d", prefix, i),
+			ProjectID:  projectID,
+			EndpointID: endpointID,
+		}, false)
+		ids = append(ids, project.ID)
+	}
+
+	collect, err := NewCollectConsumption(a, json.RawMessage(`{"Interval": "1h", "SkipBranches": true}`))
+	require.NoError(t, err)
+	countSnapshots := func() int64 {
+		var count int64
+		require.NoError(t, a.DB.Model(&models.ConsumptionSnapshot{}).Where("project_id IN ?", ids).Count(&count).Error)
+		return count
+	}
+
+	// every project is collected
+	require.NoError(t, collect.collect(ctx))
+	assert.Equal(t, int64(3), countSnapshots())
+
+	// not collected again until the interval passes
+	require.NoError(t, collect.collect(ctx))
+	assert.Equal(t, int64(3), countSnapshots())
+
+	// idle endpoints don't accrue compute time
+	collect.args.Interval = rdesc.Duration{Duration: time.Nanosecond}
+	require.NoError(t, collect.collect(ctx))
+	assert.Equal(t, int64(6), countSnapshots())
+	var checks []models.Query
+	require.NoError(t, a.DB.Where("project_id IN ? AND method = ?", ids, "consumption_idle").Find(&checks).Error)
+	require.Len(t, checks, 3)
+	for _, check := range checks {
+		assert.Equal(t, models.QueryCheck, check.Kind)
+		assert.False(t, check.IsFailed)
+	}
+}
+
+func TestIntegration_reconcileProjects(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+
+	orphanID := fake.AddProject(projectNamePrefix(a.Config.Exitnode)+"1", region.DatabaseRegion)
+	otherID := fake.AddProject("test@other-1", region.DatabaseRegion)
+	// exitnode "x-y" shares the name prefix with exitnode "x"
+	longerID := fake.AddProject(projectNamePrefix(a.Config.Exitnode+"-y")+"1", region.DatabaseRegion)
+
+	reconcile, err := NewReconcileProjects(a, json.RawMessage(`{"MinAge": "0s", "PageSize": 1}`))
+	require.NoError(t, err)
+	require.NoError(t, reconcile.reconcile(ctx))
+
+	_, ok := fake.Project(orphanID)
+	assert.False(t, ok)
+	_, ok = fake.Project(otherID)
+	assert.True(t, ok)
+	_, ok = fake.Project(longerID)
+	assert.True(t, ok)
+}
+
+func TestIntegration_reconcileProjectsAdopt(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+	prefix := projectNamePrefix(a.Config.Exitnode)
+
+	// same region name, but another provider
+	otherRegion := models.Region{Provider: a.Config.Provider + "-other", DatabaseRegion: "aws-other-1"}
+	require.NoError(t, a.DB.Create(&otherRegion).Error)
+
+	adoptedID := fake.AddProject(prefix+"1", region.DatabaseRegion)
+	otherProviderID := fake.AddProject(prefix+"2", otherRegion.DatabaseRegion)
+	// deleted in the database, but not in Neon
+	deleted := createTestProject(t, a, fake, region, models.Project{Name: prefix + "3"}, true)
+	deletedID := deleted.ProjectID
+	require.NoError(t, a.Repo.Project.Delete(deleted))
+
+	reconcile, err := NewReconcileProjects(a, json.RawMessage(`{"Orphans": "adopt", "MinAge": "0s"}`))
+	require.NoError(t, err)
+	require.NoError(t, reconcile.reconcile(ctx))
+
+	projects, err := a.Repo.Project.FindByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, adoptedID, projects[0].ProjectID)
+	assert.Equal(t, region.ID, projects[0].RegionID)
+
+	_, ok := fake.Project(otherProviderID)
+	assert.True(t, ok)
+	_, ok = fake.Project(deletedID)
+	assert.False(t, ok)
+}
+
+func TestIntegration_recoverProjects(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+	prefix := projectNamePrefix(a.Config.Exitnode)
+
+	// crashed after the API call, before the project ID was saved, requested settings are applied on resume
+	created := createTestProject(t, a, fake, region, models.Project{
+		Name:                  prefix + "1",
+		SuspendTimeoutSeconds: 1,
+		AutoscalingMinCu:      0.5,
+		AutoscalingMaxCu:      2,
+		ReadReplicas:          1,
+		State:                 models.ProjectCreating,
+	}, false)
+	createdID := fake.AddProject(created.Name, region.DatabaseRegion)
+	// crashed before the API call
+	notCreated := createTestProject(t, a, fake, region, models.Project{Name: prefix + "2", State: models.ProjectCreating}, false)
+	// crashed during deletion
+	deleting := createTestProject(t, a, fake, region, models.Project{Name: prefix + "3", State: models.ProjectDeleting}, true)
+	deletingID := deleting.ProjectID
+	// left to the failed policy of delete_project
+	failed := createTestProject(t, a, fake, region, models.Project{Name: prefix + "4", State: models.ProjectFailed}, true)
+	deleteFailed := createTestProject(t, a, fake, region, models.Project{Name: prefix + "5", State: models.ProjectDeleteFailed}, true)
+
+	recoverRule, err := NewRecoverProjects(a, json.RawMessage(`{"MinAge": "0s"}`))
+	require.NoError(t, err)
+	require.NoError(t, recoverRule.recover(ctx))
+
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	byID := make(map[uint]models.Project)
+	for _, project := range projects {
+		byID[project.ID] = project
+	}
+
+	assert.Equal(t, models.ProjectReady, byID[created.ID].State)
+	assert.Equal(t, createdID, byID[created.ID].ProjectID)
+	assert.NotEmpty(t, byID[created.ID].ConnectionString)
+	assert.NotEmpty(t, byID[created.ID].EndpointID)
+	assert.Equal(t, 1, byID[created.ID].SuspendTimeoutSeconds)
+	assert.Equal(t, 0.5, byID[created.ID].AutoscalingMinCu)
+	assert.Equal(t, 2.0, byID[created.ID].AutoscalingMaxCu)
+	replicas, err := a.Repo.Replica.FindByProject(created.ID)
+	require.NoError(t, err)
+	assert.Len(t, replicas, 1)
+
+	assert.Equal(t, models.ProjectFailed, byID[notCreated.ID].State)
+	assert.True(t, byID[notCreated.ID].DeletedAt.Valid)
+
+	assert.Equal(t, models.ProjectDeleted, byID[deleting.ID].State)
+	_, ok := fake.Project(deletingID)
+	assert.False(t, ok)
+
+	for _, project := range []*models.Project{failed, deleteFailed} {
+		assert.Equal(t, project.State, byID[project.ID].State)
+		_, ok := fake.Project(project.ProjectID)
+		assert.True(t, ok)
+	}
+}
+
+func TestIntegration_changeMode(t *testing.T) {
+	a, _, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+
+	create, err := NewCreateProject(a, json.RawMessage(`{}`))
+	require.NoError(t, err)
+	account, err := a.NeonAccounts.Get(app.DefaultNeonAccount)
+	require.NoError(t, err)
+	require.NoError(t, create.createProject(ctx, account, region))
+
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+
+	// modes are shared by all exitnodes
+	modeName := a.Config.Exitnode + "-always-on"
+	timeout, minCu, maxCu := 0, 1.0, 2.0
+	require.NoError(t, a.Repo.Mode.Save(&models.ProjectMode{
+		Name:                  modeName,
+		SuspendTimeoutSeconds: &timeout,
+		AutoscalingMinCu:      &minCu,
+		AutoscalingMaxCu:      &maxCu,
+		Scenarios:             []string{"alwaysOn"},
+	}))
+
+	change, err := NewChangeMode(a, json.RawMessage(`{"NewMode": [{"Weight": 1, "Item": "unused"}], "QueryBeforeChange": {"Driver": [{"Weight": 1, "Item": "fake"}], "Scenario": "activityV1"}}`))
+	require.NoError(t, err)
+	require.NoError(t, change.executeForProject(ctx, projects[0], modeName))
+
+	projects, err = a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	project := projects[0]
+	assert.Equal(t, modeName, project.CurrentMode)
+	assert.Equal(t, 0, project.SuspendTimeoutSeconds)
+	assert.Equal(t, 1.0, project.AutoscalingMinCu)
+	assert.Equal(t, 2.0, project.AutoscalingMaxCu)
+
+	// new projects get the settings of the mode
+	create, err = NewCreateProject(a, json.RawMessage(fmt.Sprintf(`{"Mode": [{"Weight": 1, "Item": %q}]}`, modeName)))
+	require.NoError(t, err)
+	require.NoError(t, create.createProject(ctx, account, region))
+	projects, err = a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 2)
+	for _, project := range projects {
+		assert.Equal(t, modeName, project.CurrentMode)
+		assert.Equal(t, 0, project.SuspendTimeoutSeconds)
+		assert.Equal(t, 2.0, project.AutoscalingMaxCu)
+	}
+
+	// activityV1 is not allowed in the mode
+	query, err := NewQueryProject(a, json.RawMessage(fmt.Sprintf(
+		`{"Driver": [{"Weight": 1, "Item": "fake"}], "Scenario": "activityV1", "RawProjectFilter": "projects.created_by_exitnode = '%s'"}`,
+		a.Config.Exitnode,
+	)))
+	require.NoError(t, err)
+	filters, err := query.modeFilters()
+	require.NoError(t, err)
+	found, err := a.Repo.Project.FindRandomProjects(filters, 10)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestIntegration_rotatePassword(t *testing.T) {
+	a, fake, region := newIntegrationApp(t, neonfake.Options{})
+	ctx := context.Background()
+
+	create, err := NewCreateProject(a, json.RawMessage(`{}`))
+	require.NoError(t, err)
+	account, err := a.NeonAccounts.Get(app.DefaultNeonAccount)
+	require.NoError(t, err)
+	require.NoError(t, create.createProject(ctx, account, region))
+
+	projects, err := a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	project := projects[0]
+	oldConnstr := project.ConnectionString
+	roleName, err := connstrRole(oldConnstr)
+	require.NoError(t, err)
+
+	branch := models.Branch{ProjectID: project.ID, BranchID: "br-test", ConnectionString: oldConnstr}
+	require.NoError(t, a.Repo.Branch.Create(&branch))
+	replica := models.ReadReplica{ProjectID: project.ID, ConnectionString: oldConnstr}
+	require.NoError(t, a.Repo.Replica.Create(&replica))
+
+	// accepts only the current password of the fake API
+	a.Drivers.Register(drivers.Registration{
+		Name: "it-password",
+		New: func(ctx context.Context, params drivers.Params) (drivers.Driver, error) {
+			u, err := url.Parse(params.Connstr)
+			if err != nil {
+				return nil, err
+			}
+			password, _ := u.User.Password()
+			if current, _ := fake.Password(project.ProjectID, u.User.Username()); password != current {
+				return nil, &pgconn.PgError{Code: invalidPasswordCode}
+			}
+			return drivers.NewFake(params.Connstr, params.Saver, drivers.FakeOptions{}), nil
+		},
+	})
+
+	rotate, err := NewRotatePassword(a, json.RawMessage(`{"Drivers": ["it-password"], "PropagationTimeout": "5s", "PollInterval": "10ms"}`))
+	require.NoError(t, err)
+	require.NoError(t, rotate.executeForProject(ctx, &project))
+
+	newPassword, ok := fake.Password(project.ProjectID, roleName)
+	require.True(t, ok)
+	newConnstr, err := replacePassword(oldConnstr, newPassword)
+	require.NoError(t, err)
+	assert.NotEqual(t, oldConnstr, newConnstr)
+
+	projects, err = a.Repo.Project.FindAllByExitnode(a.Config.Exitnode)
+	require.NoError(t, err)
+	assert.Equal(t, newConnstr, projects[0].ConnectionString)
+	branches, err := a.Repo.Branch.FindByProject(project.ID)
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	assert.Equal(t, newConnstr, branches[0].ConnectionString)
+	replicas, err := a.Repo.Replica.FindByProject(project.ID)
+	require.NoError(t, err)
+	require.Len(t, replicas, 1)
+	assert.Equal(t, newConnstr, replicas[0].ConnectionString)
+}
@@ -0,0 +1,111 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Number of times the locked project is waited for before giving up.
+const maxLockedRetries = 3
+
+// Waits for the operations started by an API call, polling them with GetOperation. Every operation
+// is saved as a check with the end-to-end duration reported by the API.
+func waitOperations(
+	ctx context.Context,
+	client *neonapi.Client,
+	saver *repos.QuerySaver,
+	projectID string,
+	ops []neonapi.Operation,
+) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	fetch := func(ctx context.Context, operationID string) (*neonapi.Operation, error) {
+		prep, err := client.GetOperation(projectID, operationID)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := queryAPI(ctx, prep, saver)
+		if err != nil {
+			return nil, err
+		}
+		return &resp.Operation, nil
+	}
+
+	res, err := neonapi.DefaultOperationWaiter.Wait(ctx, ops, fetch)
+	for i := range res {
+		op := &res[i]
+		check := checkQuery{
+			Method:    "operation_" + op.Action,
+			Addr:      op.ID,
+			Request:   projectID,
+			Response:  fmt.Sprintf(`{"status": %q, "failures_count": %d}`, op.Status, op.FailuresCount),
+			StartedAt: op.CreatedAt,
+			Err:       op.Err(),
+		}
+		if op.Done() {
+			check.FinishedAt = op.UpdatedAt
+		} else {
+			check.Err = fmt.Errorf("operation is %s: %w", op.Status, err)
+		}
+		if saveErr := check.save(ctx, saver); saveErr != nil {
+			err = errors.Join(err, saveErr)
+		}
+	}
+	return err
+}
+
+// Waits for all running operations of the project, e.g. started by other rules or by the API itself.
+func waitAllOperations(ctx context.Context, client *neonapi.Client, saver *repos.QuerySaver, projectID string) error {
+	prep, err := client.GetOperations(projectID)
+	if err != nil {
+		return err
+	}
+	resp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return err
+	}
+
+	var pending []neonapi.Operation
+	for _, op := range resp.Operations {
+		if !op.Done() {
+			pending = append(pending, op)
+		}
+	}
+	return waitOperations(ctx, client, saver, projectID, pending)
+}
+
+// Calls the API, and if the project is locked, waits for all operations and tries again.
+// The client doesn't retry locked requests itself, so this is the only retry layer for them.
+func queryAPIWhenUnlocked[T any](
+	ctx context.Context,
+	client *neonapi.Client,
+	prep *neonapi.Prepared[T],
+	saver *repos.QuerySaver,
+	projectID string,
+) (*T, error) {
+	policy := prep.RetryPolicy()
+	policy.RetryLocked = false
+	prep = prep.WithRetryPolicy(policy)
+
+	for i := 0; ; i++ {
+		resp, err := queryAPI(ctx, prep, saver)
+		if !errors.Is(err, neonapi.ErrLocked) || i >= maxLockedRetries {
+			return resp, err
+		}
+
+		// new operations were started after we checked, wait for them too
+		log.Warn(ctx, "project is locked, waiting for operations", zap.Error(err))
+		if err := waitAllOperations(ctx, client, saver, projectID); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -2,36 +2,41 @@ package rules
 
 import (
 	"context"
-	"errors"
 	"fmt"
 
 	"go.uber.org/zap"
 
 	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
 	"github.com/petuhovskiy/neon-lights/internal/neonapi"
 	"github.com/petuhovskiy/neon-lights/internal/repos"
 )
 
+// Calls the API, retrying according to the client retry policy. Every attempt is saved
+// as a separate query, retries are related to the first attempt.
 func queryAPI[T any](ctx context.Context, prep *neonapi.Prepared[T], saver *repos.QuerySaver) (*T, error) {
-	dbQuery := prep.QueryNoArgs()
-	err := saver.Save(dbQuery)
-	if err != nil {
-		return nil, fmt.Errorf("failed to persist query: %w", err)
-	}
-
-	resp, result, err := prep.Do(ctx)
-	dbErr := saver.FinishSaveResult(dbQuery, result)
-
-	// 1. save response to the database
-	if dbErr != nil {
-		log.Error(ctx, "failed to persist query result", zap.Error(dbErr))
-		if err == nil {
-			err = dbErr
-		} else {
-			err = errors.Join(err, dbErr)
-		}
-	}
-
-	// 2. return
+	var firstQuery, dbQuery *models.Query
+	resp, _, err := prep.DoWithHooks(ctx, neonapi.Hooks{
+		Before: func(attempt int) error {
+			dbQuery = prep.QueryNoArgs()
+			if firstQuery != nil {
+				dbQuery.RelatedQueryID = &firstQuery.ID
+			}
+			if err := saver.Save(dbQuery); err != nil {
+				return fmt.Errorf("failed to persist query: %w", err)
+			}
+			if firstQuery == nil {
+				firstQuery = dbQuery
+			}
+			return nil
+		},
+		After: func(attempt int, result *models.QueryResult) error {
+			err := saver.FinishSaveResult(dbQuery, result)
+			if err != nil {
+				log.Error(ctx, "failed to persist query result", zap.Error(err))
+			}
+			return err
+		},
+	})
 	return resp, err
 }
@@ -0,0 +1,57 @@
+package rules
+
+import (
+	"context"
+	"time"
+
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+const checkDriverName = "testodrome"
+
+// checkQuery is a result of a check performed by a rule. It's saved as models.Query,
+// so that checks can be analyzed together with other queries.
+type checkQuery struct {
+	// Name of the check, e.g. "certificate_expiry".
+	Method string
+	// What was checked, e.g. hostname.
+	Addr     string
+	Request  string
+	Response string
+	// Optional, current time is used if not set.
+	StartedAt time.Time
+	// Optional, current time is used if not set.
+	FinishedAt time.Time
+	// Check is failed if Err is not nil.
+	Err error
+}
+
+func (c *checkQuery) save(ctx context.Context, saver *repos.QuerySaver) error {
+	finishedAt := c.FinishedAt
+	if finishedAt.IsZero() {
+		finishedAt = time.Now()
+	}
+	startedAt := c.StartedAt
+	if startedAt.IsZero() {
+		startedAt = finishedAt
+	}
+	duration := finishedAt.Sub(startedAt)
+
+	query := &models.Query{
+		Kind:    models.QueryCheck,
+		Addr:    c.Addr,
+		Driver:  checkDriverName,
+		Method:  c.Method,
+		Request: c.Request,
+		QueryResult: models.QueryResult{
+			IsFinished: true,
+			Response:   c.Response,
+			StartedAt:  &startedAt,
+			FinishedAt: &finishedAt,
+			Duration:   &duration,
+		},
+	}
+	query.SetError(ctx, c.Err)
+	return saver.Save(query)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/petuhovskiy/neon-lights/internal/app"
 	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
 	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/httpclient"
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
 	"github.com/petuhovskiy/neon-lights/internal/rdesc"
@@ -28,21 +29,65 @@ type QueryProject struct {
 	projectFilters []repos.Filter
 	regionRepo     *repos.RegionRepo
 	projectRepo    *repos.ProjectRepo
+	branchRepo     *repos.BranchRepo
+	replicaRepo    *repos.ReplicaRepo
 	queryRepo      *repos.QueryRepo
+	modeRepo       *repos.ModeRepo
 	register       *bgjobs.Register
 	exitnode       string
 	projectLocker  *bgjobs.ProjectLocker
 	scenario       queryScenario
+	httpClients    map[drivers.Name]rdesc.Wrand[*httpclient.Client]
+	driverRegistry *drivers.Registry
 	nowRunning     atomic.Int64
 }
 
 type QueryProjectArgs struct {
-	ConcurrencyLimit  int
-	Scenario          string
-	UsePooler         rdesc.Wrand[bool]
+	ConcurrencyLimit int
+	Scenario         string
+	UsePooler        rdesc.Wrand[bool]
+	// How the connection string is built, see ConnVariant.
+	ConnVariant       rdesc.Wrand[ConnVariant]
 	Driver            rdesc.Wrand[drivers.Name]
 	MaxRandomProjects uint
 	RawProjectFilter  string
+	// HTTP client configurations for HTTP-based drivers, picked randomly for every execution.
+	// Drivers without configuration use the default client.
+	HTTPClient map[drivers.Name]rdesc.Wrand[httpclient.Options]
+	// Additional relay drivers, in addition to the ones from the config.
+	Relays map[drivers.Name]drivers.RelayConfig
+	// Options for the go-serverless driver.
+	Serverless drivers.ServerlessOptions
+	// Options for the fake driver, which doesn't connect to the database.
+	Fake drivers.FakeOptions
+	// What to query in the project, one of TargetXXX. Default is TargetPrimary.
+	Target rdesc.Wrand[string]
+}
+
+const (
+	// Default branch of the project.
+	TargetPrimary = "primary"
+	// Random branch created by create_branch. Default branch is used if the project has no branches.
+	TargetBranch = "branch"
+	// Random read replica created by create_project. Default branch is used if the project has no replicas.
+	TargetReplica = "replica"
+)
+
+var defaultTargets = rdesc.Wrand[string]{
+	{Weight: 1, Item: TargetPrimary},
+}
+
+// Connection target picked for the execution.
+type queryTarget struct {
+	name    string
+	connstr string
+	// Set if the target is a non-default branch.
+	branchID *uint
+}
+
+// Returns true if the target is read-only, writes should go to the primary.
+func (t queryTarget) readOnly() bool {
+	return t.name == TargetReplica
 }
 
 var defaultUsePooler = rdesc.Wrand[bool]{
@@ -74,14 +119,25 @@ func NewQueryProject(a *app.App, j json.RawMessage) (*QueryProject, error) {
 		args.Driver = defaultDrivers
 	}
 
+	if args.ConnVariant == nil {
+		args.ConnVariant = defaultConnVariants
+	}
+
 	if args.MaxRandomProjects < 1 {
 		args.MaxRandomProjects = 1
 	}
 
+	if args.Target == nil {
+		args.Target = defaultTargets
+	}
+
 	scenario, err := getScenario(args.Scenario)
 	if err != nil {
 		return nil, err
 	}
+	if err := validateTargets(args.Target, args.Scenario, scenario); err != nil {
+		return nil, err
+	}
 
 	var projectFilters []repos.Filter
 	projectFilters = append(projectFilters, a.RegionFilters...)
@@ -89,23 +145,158 @@ func NewQueryProject(a *app.App, j json.RawMessage) (*QueryProject, error) {
 		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
 	}
 
-	log.Info(context.Background(), "initialized QueryProject rule", zap.Any("args", args))
+	httpClients, err := newHTTPClients(args.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	driverRegistry := a.Drivers
+	if len(args.Relays) > 0 {
+		driverRegistry = driverRegistry.Clone()
+		for name, relay := range args.Relays {
+			if err := driverRegistry.RegisterRelay(name, relay); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	driverParams := drivers.Params{Serverless: args.Serverless, Fake: args.Fake}
+	args.Driver, err = supportedDrivers(context.Background(), driverRegistry, args.Driver, driverParams, scenario.requires())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info(context.Background(), "initialized QueryProject rule", zap.Any("args", args.redacted()))
 
 	return &QueryProject{
 		args:           args,
 		projectFilters: projectFilters,
 		regionRepo:     a.Repo.Region,
 		projectRepo:    a.Repo.Project,
+		branchRepo:     a.Repo.Branch,
+		replicaRepo:    a.Repo.Replica,
 		queryRepo:      a.Repo.Query,
+		modeRepo:       a.Repo.Mode,
 		register:       a.Register,
 		exitnode:       a.Config.Exitnode,
 		projectLocker:  a.ProjectLocker,
 		scenario:       scenario,
+		httpClients:    httpClients,
+		driverRegistry: driverRegistry,
 	}, nil
 }
 
+// Replaces secrets in logged args.
+const redactedSecret = "<redacted>"
+
+// Returns a copy of the args without passwords, tokens and relay header values, for logging.
+func (a QueryProjectArgs) redacted() QueryProjectArgs {
+	a.ConnVariant = append(rdesc.Wrand[ConnVariant](nil), a.ConnVariant...)
+	for i := range a.ConnVariant {
+		if a.ConnVariant[i].Item.Password != "" {
+			a.ConnVariant[i].Item.Password = redactedSecret
+		}
+	}
+
+	if a.Relays != nil {
+		relays := make(map[drivers.Name]drivers.RelayConfig, len(a.Relays))
+		for name, relay := range a.Relays {
+			if relay.AuthToken != "" {
+				relay.AuthToken = redactedSecret
+			}
+			if relay.Headers != nil {
+				headers := make(map[string]string, len(relay.Headers))
+				for key := range relay.Headers {
+					headers[key] = redactedSecret
+				}
+				relay.Headers = headers
+			}
+			relays[name] = relay
+		}
+		a.Relays = relays
+	}
+	return a
+}
+
+// Checks that targets are known and the scenario can run on them. Scenarios that write to the
+// target would fail on read-only replicas.
+func validateTargets(targets rdesc.Wrand[string], scenarioName string, scenario queryScenario) error {
+	for _, target := range targets {
+		switch target.Item {
+		case TargetPrimary, TargetBranch:
+		case TargetReplica:
+			if !scenario.readOnlyTargets() {
+				return fmt.Errorf("scenario %s writes to the target, it can't be used with the %s target", scenarioName, target.Item)
+			}
+		default:
+			return fmt.Errorf("unknown target: %s", target.Item)
+		}
+	}
+	return nil
+}
+
+// Removes drivers that can't run the scenario. Other drivers are picked with the same
+// relative weights, so that capability mismatches are not recorded as failures.
+func supportedDrivers(
+	ctx context.Context,
+	registry *drivers.Registry,
+	all rdesc.Wrand[drivers.Name],
+	params drivers.Params,
+	required drivers.Capabilities,
+) (rdesc.Wrand[drivers.Name], error) {
+	var supported rdesc.Wrand[drivers.Name]
+	for _, item := range all {
+		reg, ok := registry.Get(item.Item)
+		if !ok {
+			return nil, fmt.Errorf("unknown driver: %s", item.Item)
+		}
+		if !reg.Supports(params, required...) {
+			log.Warn(ctx, "driver doesn't support the scenario, skipping", zap.String("driver", string(item.Item)))
+			continue
+		}
+		supported = append(supported, item)
+	}
+
+	if len(supported) == 0 {
+		return nil, fmt.Errorf("no drivers support capabilities %v", required)
+	}
+	return supported, nil
+}
+
+// Creates clients once, so that keep-alive connections can be reused between executions.
+func newHTTPClients(opts map[drivers.Name]rdesc.Wrand[httpclient.Options]) (map[drivers.Name]rdesc.Wrand[*httpclient.Client], error) {
+	clients := make(map[drivers.Name]rdesc.Wrand[*httpclient.Client])
+	for name, wrand := range opts {
+		for _, item := range wrand {
+			client, err := httpclient.New(item.Item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid http client for driver %s: %w", name, err)
+			}
+			clients[name] = append(clients[name], rdesc.WrandItem[*httpclient.Client]{
+				Weight: item.Weight,
+				Item:   client,
+			})
+		}
+	}
+	return clients, nil
+}
+
+// Returns nil if there is no configured client for the driver.
+func (r *QueryProject) pickHTTPClient(driverName drivers.Name) *httpclient.Client {
+	clients, ok := r.httpClients[driverName]
+	if !ok || len(clients) == 0 {
+		return nil
+	}
+	return clients.Pick()
+}
+
 func (r *QueryProject) Execute(ctx context.Context) error {
-	projects, err := r.projectRepo.FindRandomProjects(r.projectFilters, int(r.args.MaxRandomProjects))
+	filters, err := r.modeFilters()
+	if err != nil {
+		return err
+	}
+
+	projects, err := r.projectRepo.FindRandomProjects(filters, int(r.args.MaxRandomProjects))
 	if err != nil {
 		return fmt.Errorf("failed to find random project: %w", err)
 	}
@@ -117,11 +308,32 @@ func (r *QueryProject) Execute(ctx context.Context) error {
 	return nil
 }
 
+// Returns project filters that skip projects in modes which don't allow the scenario.
+func (r *QueryProject) modeFilters() ([]repos.Filter, error) {
+	modes, err := r.modeRepo.All()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find modes: %w", err)
+	}
+
+	var disallowed []string
+	for _, mode := range modes {
+		if !mode.AllowsScenario(r.args.Scenario) {
+			disallowed = append(disallowed, mode.Name)
+		}
+	}
+	if len(disallowed) == 0 {
+		return r.projectFilters, nil
+	}
+
+	filters := append([]repos.Filter{}, r.projectFilters...)
+	return append(filters, repos.FilterExcludeModes(disallowed)), nil
+}
+
 func (r *QueryProject) startExecuteProject(ctx context.Context, project models.Project) {
 	ctx = log.With(ctx, zap.Uint("projectID", project.ID))
 	ctx = log.With(ctx, zap.String("scenario", r.args.Scenario))
 
-	r.register.Go(func() {
+	r.register.Go(ctx, func() {
 		err := r.executeForProject(ctx, project)
 		if err == ErrConcurrencyLimit || err == ErrProjectLocked {
 			err = nil
@@ -163,8 +375,17 @@ func (r *QueryProject) executeForProject(ctx context.Context, project models.Pro
 		return ErrConcurrencyLimit
 	}
 
+	target, err := r.pickTarget(ctx, project)
+	if err != nil {
+		return err
+	}
+
+	variant := r.args.ConnVariant.Pick()
+	driverName := r.args.Driver.Pick()
+	saver := r.querySaver(project, target, variant)
+
 	// running the scenario
-	driver, err1 := r.randomDriver(ctx, project, usePooler)
+	driver, err1 := r.newDriver(ctx, driverName, target, variant, usePooler, saver)
 	if err1 != nil {
 		return fmt.Errorf("failed to create driver: %w", err1)
 	}
@@ -173,10 +394,25 @@ func (r *QueryProject) executeForProject(ctx context.Context, project models.Pro
 		defer cc.Close(ctx)
 	}
 
-	return scenario.execute(ctx, queryParams{
+	params := queryParams{
 		driver:  driver,
 		project: &project,
-	})
+		saver:   saver,
+	}
+
+	if target.readOnly() {
+		primary := queryTarget{name: TargetPrimary, connstr: project.ConnectionString}
+		params.primary, err1 = r.newDriver(ctx, driverName, primary, variant, usePooler, saver)
+		if err1 != nil {
+			return fmt.Errorf("failed to create primary driver: %w", err1)
+		}
+
+		if cc, ok := params.primary.(drivers.CloseableDriver); ok {
+			defer cc.Close(ctx)
+		}
+	}
+
+	return scenario.execute(ctx, params)
 }
 
 func appendPoolerSuffix(connstr string) (string, error) {
@@ -191,16 +427,76 @@ func appendPoolerSuffix(connstr string) (string, error) {
 	return newConnstr, nil
 }
 
-func (r *QueryProject) randomDriver(ctx context.Context, project models.Project, usePooler bool) (drivers.Driver, error) {
-	// save queries to the database with project and exitnode info
-	saver := repos.NewQuerySaver(r.queryRepo, repos.QuerySaverArgs{
+// Picks a random target. Falls back to the default branch if the project has no branches or replicas.
+func (r *QueryProject) pickTarget(ctx context.Context, project models.Project) (queryTarget, error) {
+	primary := queryTarget{
+		name:    TargetPrimary,
+		connstr: project.ConnectionString,
+	}
+
+	switch r.args.Target.Pick() {
+	case TargetBranch:
+		return r.pickBranch(ctx, project, primary)
+	case TargetReplica:
+		return r.pickReplica(ctx, project, primary)
+	}
+	return primary, nil
+}
+
+func (r *QueryProject) pickBranch(ctx context.Context, project models.Project, primary queryTarget) (queryTarget, error) {
+	branch, err := r.branchRepo.FindRandomByProject(project.ID)
+	if err != nil {
+		return queryTarget{}, fmt.Errorf("failed to find branch: %w", err)
+	}
+	if branch == nil || branch.ConnectionString == "" {
+		log.Info(ctx, "project has no branches, querying the default branch")
+		return primary, nil
+	}
+
+	return queryTarget{
+		name:     TargetBranch,
+		connstr:  branch.ConnectionString,
+		branchID: &branch.ID,
+	}, nil
+}
+
+func (r *QueryProject) pickReplica(ctx context.Context, project models.Project, primary queryTarget) (queryTarget, error) {
+	replica, err := r.replicaRepo.FindRandomByProject(project.ID)
+	if err != nil {
+		return queryTarget{}, fmt.Errorf("failed to find replica: %w", err)
+	}
+	if replica == nil || replica.ConnectionString == "" {
+		log.Info(ctx, "project has no replicas, querying the default branch")
+		return primary, nil
+	}
+
+	return queryTarget{
+		name:    TargetReplica,
+		connstr: replica.ConnectionString,
+	}, nil
+}
+
+// Saves queries to the database with project and exitnode info.
+func (r *QueryProject) querySaver(project models.Project, target queryTarget, variant ConnVariant) *repos.QuerySaver {
+	return repos.NewQuerySaver(r.queryRepo, repos.QuerySaverArgs{
 		ProjectID:   &project.ID,
 		Exitnode:    &r.exitnode,
 		RegionID:    &project.RegionID,
 		ProjectMode: &project.CurrentMode,
+		ConnVariant: &variant.Name,
+		BranchID:    target.branchID,
 	})
+}
 
-	connstr := project.ConnectionString
+func (r *QueryProject) newDriver(
+	ctx context.Context,
+	driverName drivers.Name,
+	target queryTarget,
+	variant ConnVariant,
+	usePooler bool,
+	saver *repos.QuerySaver,
+) (drivers.Driver, error) {
+	connstr := target.connstr
 	if usePooler {
 		var err error
 		connstr, err = appendPoolerSuffix(connstr)
@@ -209,7 +505,11 @@ func (r *QueryProject) randomDriver(ctx context.Context, project models.Project,
 		}
 	}
 
-	driverName := r.args.Driver.Pick()
+	connstr, err := applyConnVariant(connstr, variant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply connstr variant %q: %w", variant.Name, err)
+	}
+
 	if strings.Contains(connstr, "?") {
 		connstr += "&"
 	} else {
@@ -217,24 +517,18 @@ func (r *QueryProject) randomDriver(ctx context.Context, project models.Project,
 	}
 	connstr += fmt.Sprintf("application_name=testodrome/%s", string(driverName))
 
-	log.Info(ctx, "using driver", zap.String("driver", string(driverName)))
-	switch driverName {
-	case drivers.PgxConn:
-		connstr += "&default_query_exec_mode=simple_protocol"
-		return drivers.PgxConnect(ctx, connstr, saver)
-	case drivers.GoServerless:
-		return drivers.NewServerless(connstr, saver)
-	case drivers.VercelEdge:
-		return drivers.NewVercelSL(connstr, saver, drivers.VercelEdge04), nil
-	case drivers.VercelEdgeHTTP07:
-		return drivers.NewVercelSL(connstr, saver, drivers.VercelEdge07), nil
-	case drivers.VercelEdgeHTTP08:
-		return drivers.NewVercelSL(connstr, saver, drivers.VercelEdge08), nil
-	case drivers.VercelNodeHTTP09:
-		return drivers.NewVercelSL(connstr, saver, drivers.VercelNode09), nil
-	case drivers.VercelNodePool09:
-		return drivers.NewVercelSL(connstr, saver, drivers.VercelNode09WS), nil
-	}
-
-	return nil, fmt.Errorf("unknown driver: %s", driverName)
+	log.Info(
+		ctx,
+		"using driver",
+		zap.String("driver", string(driverName)),
+		zap.String("connVariant", variant.Name),
+		zap.String("target", target.name),
+	)
+	return r.driverRegistry.New(ctx, driverName, drivers.Params{
+		Connstr:    connstr,
+		Saver:      saver,
+		HTTPClient: r.pickHTTPClient(driverName),
+		Serverless: r.args.Serverless,
+		Fake:       r.args.Fake,
+	})
 }
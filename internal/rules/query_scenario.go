@@ -2,8 +2,11 @@ package rules
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -11,6 +14,7 @@ import (
 	"github.com/petuhovskiy/neon-lights/internal/drivers"
 	"github.com/petuhovskiy/neon-lights/internal/log"
 	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
 )
 
 const av1Select1 = `SELECT 1`
@@ -21,15 +25,24 @@ const av1CreateTable = `CREATE TABLE IF NOT EXISTS activity_v1 (
 		created_at TIMESTAMP DEFAULT NOW()
 	  )`
 const av1DoActivity = `INSERT INTO activity_v1(nonce,val) SELECT $1 AS nonce, avg(id) AS val FROM activity_v1 RETURNING *`
+const av1CountNonce = `SELECT count(*) FROM activity_v1 WHERE nonce = $1`
 
 type queryParams struct {
 	project *models.Project
 	driver  drivers.Driver
+	// Driver for the default branch, set only if driver is connected to a read-only target.
+	primary drivers.Driver
+	// Saves checks performed by the scenario.
+	saver *repos.QuerySaver
 }
 
 type queryScenario interface {
 	execute(ctx context.Context, params queryParams) error
 	exclusive() bool
+	// Drivers without these capabilities won't be used for the scenario.
+	requires() drivers.Capabilities
+	// Returns true if the scenario can run on read-only targets, writes go to queryParams.primary.
+	readOnlyTargets() bool
 }
 
 func getScenario(name string) (queryScenario, error) {
@@ -40,6 +53,13 @@ func getScenario(name string) (queryScenario, error) {
 		return &alwaysOn{}, nil
 	case "awaitShutdown":
 		return &awaitShutdown{}, nil
+	case "transactionV1":
+		return &transactionV1{}, nil
+	case "replicaLagV1":
+		return &replicaLagV1{
+			timeout:      time.Minute,
+			pollInterval: 250 * time.Millisecond,
+		}, nil
 	}
 
 	return nil, fmt.Errorf("unknown scenario: %v", name)
@@ -52,6 +72,14 @@ func (a *activityV1) exclusive() bool {
 	return false
 }
 
+func (a *activityV1) requires() drivers.Capabilities {
+	return nil
+}
+
+func (a *activityV1) readOnlyTargets() bool {
+	return false
+}
+
 func (a *activityV1) execute(ctx context.Context, params queryParams) error {
 	queries := []drivers.SingleQuery{
 		// first query, can trigger a cold start
@@ -72,6 +100,14 @@ func (a *alwaysOn) exclusive() bool {
 	return false
 }
 
+func (a *alwaysOn) requires() drivers.Capabilities {
+	return nil
+}
+
+func (a *alwaysOn) readOnlyTargets() bool {
+	return false
+}
+
 func (a *alwaysOn) execute(ctx context.Context, params queryParams) error {
 	suspendTimeout := params.project.SuspendTimeout()
 	// we want to make one query at least every 1/4 of suspend timeout
@@ -129,6 +165,14 @@ func (a *awaitShutdown) exclusive() bool {
 	return true
 }
 
+func (a *awaitShutdown) requires() drivers.Capabilities {
+	return nil
+}
+
+func (a *awaitShutdown) readOnlyTargets() bool {
+	return false
+}
+
 func (a *awaitShutdown) execute(ctx context.Context, params queryParams) error {
 	// wake up + init
 	err := executeManyQueries(ctx, params.driver, []drivers.SingleQuery{
@@ -162,6 +206,135 @@ func (a *awaitShutdown) execute(ctx context.Context, params queryParams) error {
 	return nil
 }
 
+// transactionV1 executes several queries in a single transaction.
+type transactionV1 struct{}
+
+func (a *transactionV1) exclusive() bool {
+	return false
+}
+
+func (a *transactionV1) requires() drivers.Capabilities {
+	return drivers.Capabilities{drivers.CapTransactions, drivers.CapSessionState}
+}
+
+func (a *transactionV1) readOnlyTargets() bool {
+	return false
+}
+
+func (a *transactionV1) execute(ctx context.Context, params queryParams) error {
+	nonce := rand.Int63()
+	queries := []drivers.SingleQuery{
+		{Query: av1CreateTable},
+		{Query: "BEGIN"},
+		{Query: av1DoActivity, Params: []any{nonce}},
+		{Query: av1DoActivity, Params: []any{nonce}},
+		{Query: av1CountNonce, Params: []any{nonce}},
+		{Query: "COMMIT"},
+	}
+
+	return executeManyQueries(ctx, params.driver, queries)
+}
+
+// replicaLagV1 writes a row on the primary and polls the replica until the row is visible.
+// The time from the write to the first successful read is saved as a check.
+type replicaLagV1 struct {
+	timeout      time.Duration
+	pollInterval time.Duration
+}
+
+func (a *replicaLagV1) exclusive() bool {
+	return false
+}
+
+func (a *replicaLagV1) requires() drivers.Capabilities {
+	// count is parsed from the response
+	return drivers.Capabilities{drivers.CapRowsResponse}
+}
+
+func (a *replicaLagV1) readOnlyTargets() bool {
+	// reads from the replica, writes to the primary
+	return true
+}
+
+func (a *replicaLagV1) execute(ctx context.Context, params queryParams) error {
+	if params.primary == nil {
+		log.Info(ctx, "target is not a read replica, skipping replicaLagV1")
+		return nil
+	}
+
+	check, err := a.measure(ctx, params)
+	if err != nil {
+		return err
+	}
+	return errors.Join(check.Err, check.save(ctx, params.saver))
+}
+
+// Returns an error only if the write on the primary failed, replica failures are reported in the check.
+func (a *replicaLagV1) measure(ctx context.Context, params queryParams) (*checkQuery, error) {
+	nonce := rand.Int63()
+	err := executeManyQueries(ctx, params.primary, []drivers.SingleQuery{
+		{Query: av1CreateTable},
+		{Query: av1DoActivity, Params: []any{nonce}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	check := &checkQuery{
+		Method:    "replica_lag",
+		Addr:      params.project.ProjectID,
+		Request:   fmt.Sprintf("%d", nonce),
+		StartedAt: time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	var lastErr error
+	for polls := 1; ; polls++ {
+		var query *models.Query
+		query, lastErr = params.driver.Query(ctx, drivers.SingleQuery{Query: av1CountNonce, Params: []any{nonce}})
+		if lastErr == nil {
+			var count int64
+			count, lastErr = parseCount(query.Response)
+			if lastErr == nil && count > 0 {
+				check.Response = fmt.Sprintf(`{"polls": %d}`, polls)
+				return check, nil
+			}
+		}
+		// the table can be missing on the replica too, it's a part of the lag
+		if lastErr != nil {
+			log.Warn(ctx, "failed to read from replica", zap.Error(lastErr))
+		}
+
+		select {
+		case <-ctx.Done():
+			check.Response = fmt.Sprintf(`{"polls": %d}`, polls)
+			check.Err = fmt.Errorf("row is not visible on the replica: %w", ctx.Err())
+			if lastErr != nil {
+				check.Err = errors.Join(check.Err, lastErr)
+			}
+			return check, nil
+		case <-time.After(a.pollInterval):
+		}
+	}
+}
+
+// Parses a single number from drivers.CapRowsResponse response, e.g. [[1]].
+func parseCount(response string) (int64, error) {
+	dec := json.NewDecoder(strings.NewReader(response))
+	dec.UseNumber()
+
+	var rows [][]json.Number
+	if err := dec.Decode(&rows); err != nil {
+		return 0, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return 0, fmt.Errorf("expected a single value, got %s", response)
+	}
+	return rows[0][0].Int64()
+}
+
 func executeManyQueries(ctx context.Context, driver drivers.Driver, queries []drivers.SingleQuery) error {
 	log.Info(ctx, "executing queries", zap.Int("count", len(queries)))
 
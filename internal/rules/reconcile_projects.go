@@ -0,0 +1,405 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// What to do with projects that exist in Neon, but not in the database.
+const (
+	OrphanDelete = "delete"
+	OrphanAdopt  = "adopt"
+)
+
+// Rule to find projects of this exitnode that exist only in Neon or only in the database,
+// e.g. after a failed creation or deletion. Every action is saved as a check.
+type ReconcileProjects struct {
+	args          ReconcileProjectsArgs
+	regionFilters []repos.Filter
+	regionRepo    *repos.RegionRepo
+	projectRepo   *repos.ProjectRepo
+	branchRepo    *repos.BranchRepo
+	replicaRepo   *repos.ReplicaRepo
+	queryRepo     *repos.QueryRepo
+	neonAccounts  *app.NeonAccounts
+	register      *bgjobs.Register
+	exitnode      string
+	projectLocker *bgjobs.ProjectLocker
+	running       atomic.Bool
+}
+
+type ReconcileProjectsArgs struct {
+	// What to do with Neon projects missing in the database, one of OrphanXXX. Default is OrphanDelete.
+	// Projects deleted in the database are always deleted.
+	Orphans string
+	// Recently created projects are skipped, because they can be in the middle of creation.
+	MinAge rdesc.Duration
+	// Number of projects requested per page.
+	PageSize int
+	// Listing is stopped after this number of pages. Database rows are not deleted in this case,
+	// because the list is incomplete.
+	MaxPages int
+}
+
+var defaultReconcileProjectsArgs = ReconcileProjectsArgs{
+	Orphans:  OrphanDelete,
+	MinAge:   rdesc.Duration{Duration: time.Hour},
+	PageSize: 100,
+	MaxPages: 50,
+}
+
+func NewReconcileProjects(a *app.App, j json.RawMessage) (*ReconcileProjects, error) {
+	args := defaultReconcileProjectsArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.Orphans != OrphanDelete && args.Orphans != OrphanAdopt {
+		return nil, fmt.Errorf("unknown Orphans action: %s", args.Orphans)
+	}
+	if args.PageSize < 1 || args.MaxPages < 1 {
+		return nil, fmt.Errorf("PageSize and MaxPages must be positive")
+	}
+
+	return &ReconcileProjects{
+		args:          args,
+		regionFilters: a.RegionFilters,
+		regionRepo:    a.Repo.Region,
+		projectRepo:   a.Repo.Project,
+		branchRepo:    a.Repo.Branch,
+		replicaRepo:   a.Repo.Replica,
+		queryRepo:     a.Repo.Query,
+		neonAccounts:  a.NeonAccounts,
+		register:      a.Register,
+		exitnode:      a.Config.Exitnode,
+		projectLocker: a.ProjectLocker,
+	}, nil
+}
+
+func (c *ReconcileProjects) Execute(ctx context.Context) error {
+	// listing can take a while, don't start another one
+	if !c.running.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	c.register.Go(ctx, func() {
+		defer c.running.Store(false)
+		if err := c.reconcile(ctx); err != nil {
+			log.Error(ctx, "failed to reconcile projects", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+func (c *ReconcileProjects) reconcile(ctx context.Context) error {
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		Exitnode: &c.exitnode,
+	})
+
+	dbProjects, err := c.projectRepo.FindByExitnode(c.exitnode)
+	if err != nil {
+		return fmt.Errorf("failed to find projects: %w", err)
+	}
+	dbByID := make(map[string]*models.Project, len(dbProjects))
+	// projects without ID can exist in Neon, they are recovered by name in recover_projects
+	creating := make(map[string]bool)
+	byAccount := make(map[string][]*models.Project)
+	for i := range dbProjects {
+		dbProject := &dbProjects[i]
+		if dbProject.ProjectID == "" {
+			creating[dbProject.Name] = true
+			continue
+		}
+		dbByID[dbProject.ProjectID] = dbProject
+		byAccount[dbProject.NeonAccount] = append(byAccount[dbProject.NeonAccount], dbProject)
+	}
+
+	// accounts can share an organization, so orphans are looked up in all projects
+	var errs []error
+	for _, account := range c.neonAccounts.All() {
+		ctx := log.With(ctx, zap.String("neonAccount", account.Name))
+		if err := c.reconcileAccount(ctx, saver, account, dbByID, creating, byAccount[account.Name]); err != nil {
+			errs = append(errs, fmt.Errorf("account %q: %w", account.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reconciles projects listed by the account. dbByID has live projects of the exitnode, creating has names
+// of the projects without ID. owned are the projects owned by the account, only they are checked for being stale.
+func (c *ReconcileProjects) reconcileAccount(
+	ctx context.Context,
+	saver *repos.QuerySaver,
+	account *app.NeonAccount,
+	dbByID map[string]*models.Project,
+	creating map[string]bool,
+	owned []*models.Project,
+) error {
+	neonProjects, complete, err := c.listProjects(ctx, account.Client, saver)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	inNeon := make(map[string]bool, len(neonProjects))
+	var orphans []neonapi.Project
+	var orphanIDs []string
+	for _, project := range neonProjects {
+		inNeon[project.ID] = true
+
+		if dbByID[project.ID] != nil || creating[project.Name] {
+			continue
+		}
+		if now.Sub(project.CreatedAt) < c.args.MinAge.Duration {
+			continue
+		}
+		orphans = append(orphans, project)
+		orphanIDs = append(orphanIDs, project.ID)
+	}
+
+	// only orphans can have deleted rows, not loading all deleted projects
+	deleted, err := c.projectRepo.FindDeletedByProjectIDs(c.exitnode, orphanIDs)
+	if err != nil {
+		return fmt.Errorf("failed to find deleted projects: %w", err)
+	}
+	deletedByID := make(map[string]*models.Project, len(deleted))
+	for i := range deleted {
+		deletedByID[deleted[i].ProjectID] = &deleted[i]
+	}
+
+	for i := range orphans {
+		project := &orphans[i]
+		action := c.args.Orphans
+		dbProject := deletedByID[project.ID]
+		if dbProject != nil {
+			// deletion has failed after the project was deleted in the database
+			action = OrphanDelete
+		}
+		if err := c.handleOrphan(ctx, account, saver, project, dbProject, action); err != nil {
+			log.Error(ctx, "failed to handle orphan project", zap.String("projectID", project.ID), zap.Error(err))
+		}
+	}
+
+	if !complete {
+		log.Warn(ctx, "project list is incomplete, not deleting stale projects", zap.Int("listed", len(neonProjects)))
+		return nil
+	}
+
+	for _, dbProject := range owned {
+		if inNeon[dbProject.ProjectID] {
+			continue
+		}
+		// interrupted creation and deletion are handled by recover_projects
+		if models.IsIntermediateProjectState(dbProject.State) {
+			continue
+		}
+		if now.Sub(dbProject.CreatedAt) < c.args.MinAge.Duration {
+			continue
+		}
+		if err := c.deleteStale(ctx, saver, dbProject); err != nil {
+			log.Error(ctx, "failed to delete stale project", zap.Uint("projectID", dbProject.ID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Lists all projects created by this exitnode. Returns false if the list is incomplete.
+func (c *ReconcileProjects) listProjects(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+) ([]neonapi.Project, bool, error) {
+	prefix := projectNamePrefix(c.exitnode)
+
+	var projects []neonapi.Project
+	var cursor string
+	for page := 0; page < c.args.MaxPages; page++ {
+		prep, err := neonClient.ListProjects(cursor, c.args.PageSize, prefix)
+		if err != nil {
+			return nil, false, err
+		}
+		resp, err := queryAPI(ctx, prep, saver)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// search also matches project IDs and substrings of the name
+		for _, project := range resp.Projects {
+			if isExitnodeProjectName(project.Name, c.exitnode) {
+				projects = append(projects, project)
+			}
+		}
+
+		if len(resp.Projects) < c.args.PageSize || resp.Pagination.Cursor == "" || resp.Pagination.Cursor == cursor {
+			return projects, true, nil
+		}
+		cursor = resp.Pagination.Cursor
+	}
+	return projects, false, nil
+}
+
+// Deletes or adopts the project that exists in Neon, but not in the database. dbProject is set if
+// the project is deleted in the database.
+func (c *ReconcileProjects) handleOrphan(
+	ctx context.Context,
+	account *app.NeonAccount,
+	saver *repos.QuerySaver,
+	project *neonapi.Project,
+	dbProject *models.Project,
+	action string,
+) error {
+	ctx = log.With(ctx, zap.String("projectID", project.ID), zap.String("action", action))
+	if dbProject != nil {
+		saver = saver.With(repos.QuerySaverArgs{ProjectID: &dbProject.ID, RegionID: &dbProject.RegionID})
+	}
+
+	log.Info(ctx, "found orphan project", zap.String("name", project.Name))
+	check := checkQuery{
+		Method:  "reconcile_" + action + "_orphan",
+		Addr:    project.ID,
+		Request: project.Name,
+	}
+
+	var err error
+	switch action {
+	case OrphanDelete:
+		err = c.deleteOrphan(ctx, account.Client, saver, project)
+	case OrphanAdopt:
+		var adopted *models.Project
+		adopted, err = c.adoptOrphan(ctx, account, saver, project)
+		if adopted == nil && err == nil {
+			// not in the regions of the exitnode
+			return nil
+		}
+		if adopted != nil {
+			saver = saver.With(repos.QuerySaverArgs{ProjectID: &adopted.ID, RegionID: &adopted.RegionID})
+		}
+	}
+
+	check.Err = err
+	if saveErr := check.save(ctx, saver); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
+
+func (c *ReconcileProjects) deleteOrphan(ctx context.Context, neonClient *neonapi.Client, saver *repos.QuerySaver, project *neonapi.Project) error {
+	prep, err := neonClient.DeleteProject(project.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = queryAPI(ctx, prep, saver)
+	if errors.Is(err, neonapi.ErrNotFound) {
+		log.Warn(ctx, "project not found, treating as already deleted", zap.Error(err))
+		err = nil
+	}
+	return err
+}
+
+// Saves the project to the database, so that it's queried and deleted by other rules. Returns nil
+// without an error if the project is not in the regions of the exitnode for the account provider.
+func (c *ReconcileProjects) adoptOrphan(
+	ctx context.Context,
+	account *app.NeonAccount,
+	saver *repos.QuerySaver,
+	project *neonapi.Project,
+) (*models.Project, error) {
+	var filters []repos.Filter
+	filters = append(filters, c.regionFilters...)
+	filters = append(filters, repos.FilterByRegionProvider(account.Provider))
+	regions, err := c.regionRepo.Find(filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find regions: %w", err)
+	}
+	var region *models.Region
+	for i := range regions {
+		if regions[i].DatabaseRegion == project.RegionID {
+			region = &regions[i]
+		}
+	}
+	if region == nil {
+		log.Warn(ctx, "orphan project is not in the regions of the exitnode, skipping", zap.String("regionID", project.RegionID))
+		return nil, nil
+	}
+
+	dbProject := models.Project{
+		RegionID:          region.ID,
+		Name:              project.Name,
+		ProjectID:         project.ID,
+		CreatedByExitnode: c.exitnode,
+		NeonAccount:       account.Name,
+		PgVersion:         project.PgVersion,
+		Provisioner:       project.Provisioner,
+		State:             models.ProjectReady,
+	}
+	endpoint, err := loadProjectDetails(ctx, account.Client, saver, &dbProject)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != nil {
+		dbProject.SuspendTimeoutSeconds = endpoint.SuspendTimeoutSeconds
+		dbProject.AutoscalingMinCu = endpoint.AutoscalingLimitMinCu
+		dbProject.AutoscalingMaxCu = endpoint.AutoscalingLimitMaxCu
+	}
+
+	if err := c.projectRepo.Create(&dbProject); err != nil {
+		return nil, fmt.Errorf("failed to create project in the database: %w", err)
+	}
+	log.Info(ctx, "adopted orphan project", zap.Uint("dbProjectID", dbProject.ID))
+	return &dbProject, nil
+}
+
+// Soft-deletes the project that doesn't exist in Neon anymore.
+func (c *ReconcileProjects) deleteStale(ctx context.Context, saver *repos.QuerySaver, dbProject *models.Project) error {
+	ctx = log.With(ctx, zap.Uint("projectID", dbProject.ID))
+	saver = saver.With(repos.QuerySaverArgs{ProjectID: &dbProject.ID, RegionID: &dbProject.RegionID})
+
+	projectLock := c.projectLocker.Get(dbProject.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		// will be retried on the next execution
+		return nil
+	}
+	defer unlock()
+
+	log.Info(ctx, "project doesn't exist in Neon, deleting from the database")
+	dbProject.DeletionComment = "reconcile_projects: doesn't exist in Neon"
+	err := c.projectRepo.Delete(dbProject)
+	if err == nil {
+		if err := c.branchRepo.DeleteByProject(dbProject.ID); err != nil {
+			log.Error(ctx, "failed to delete project branches", zap.Error(err))
+		}
+		if err := c.replicaRepo.DeleteByProject(dbProject.ID); err != nil {
+			log.Error(ctx, "failed to delete project replicas", zap.Error(err))
+		}
+		projectLock.Deleted.Store(true)
+		c.projectLocker.Delete(dbProject.ID)
+	}
+
+	check := checkQuery{
+		Method:  "reconcile_delete_stale",
+		Addr:    dbProject.ProjectID,
+		Request: dbProject.Name,
+		Err:     err,
+	}
+	if saveErr := check.save(ctx, saver); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// What to do with projects which creation was interrupted.
+const (
+	RecoverResume   = "resume"
+	RecoverRollback = "rollback"
+)
+
+// Rule to find projects of this exitnode stuck in an intermediate state (creating, configuring,
+// deleting), e.g. after a restart, and to finish or roll back the interrupted step. Projects that
+// failed to be created or deleted are deleted by the failed policy of delete_project.
+// Every recovery is saved as a check.
+type RecoverProjects struct {
+	args          RecoverProjectsArgs
+	projectRepo   *repos.ProjectRepo
+	queryRepo     *repos.QueryRepo
+	deleter       *projectDeleter
+	configurator  *projectConfigurator
+	neonAccounts  *app.NeonAccounts
+	register      *bgjobs.Register
+	exitnode      string
+	projectLocker *bgjobs.ProjectLocker
+	running       atomic.Bool
+}
+
+type RecoverProjectsArgs struct {
+	// Projects are recovered if their state hasn't changed for this duration. Default is 10 minutes.
+	MinAge rdesc.Duration
+	// What to do with interrupted creations, one of RecoverXXX. Default is RecoverResume.
+	// Interrupted deletions are always retried.
+	Creating string
+}
+
+var defaultRecoverProjectsArgs = RecoverProjectsArgs{
+	MinAge:   rdesc.Duration{Duration: 10 * time.Minute},
+	Creating: RecoverResume,
+}
+
+func NewRecoverProjects(a *app.App, j json.RawMessage) (*RecoverProjects, error) {
+	args := defaultRecoverProjectsArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.Creating != RecoverResume && args.Creating != RecoverRollback {
+		return nil, fmt.Errorf("unknown Creating action: %s", args.Creating)
+	}
+
+	return &RecoverProjects{
+		args:          args,
+		projectRepo:   a.Repo.Project,
+		queryRepo:     a.Repo.Query,
+		deleter:       newProjectDeleter(a),
+		configurator:  newProjectConfigurator(a),
+		neonAccounts:  a.NeonAccounts,
+		register:      a.Register,
+		exitnode:      a.Config.Exitnode,
+		projectLocker: a.ProjectLocker,
+	}, nil
+}
+
+func (c *RecoverProjects) Execute(ctx context.Context) error {
+	if !c.running.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	c.register.Go(ctx, func() {
+		defer c.running.Store(false)
+		if err := c.recover(ctx); err != nil {
+			log.Error(ctx, "failed to recover projects", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+func (c *RecoverProjects) recover(ctx context.Context) error {
+	states := []string{
+		models.ProjectCreating,
+		models.ProjectConfiguring,
+		models.ProjectDeleting,
+	}
+	projects, err := c.projectRepo.FindByStates(c.exitnode, states, time.Now().Add(-c.args.MinAge.Duration), nil)
+	if err != nil {
+		return fmt.Errorf("failed to find stuck projects: %w", err)
+	}
+
+	for i := range projects {
+		project := &projects[i]
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID), zap.String("state", project.State))
+		if err := c.recoverProject(ctx, project); err != nil {
+			log.Error(ctx, "failed to recover project", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (c *RecoverProjects) recoverProject(ctx context.Context, project *models.Project) error {
+	// projects that are being created or deleted by this process are locked
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	check := checkQuery{
+		Addr:    project.Name,
+		Request: project.State,
+	}
+
+	action, err := c.recoverState(ctx, neonClient, saver, project)
+	if project.State == models.ProjectDeleted {
+		projectLock.Deleted.Store(true)
+		c.projectLocker.Delete(project.ID)
+	}
+	log.Info(ctx, "recovered project", zap.String("action", action), zap.String("newState", project.State), zap.Error(err))
+
+	check.Method = "recover_" + action
+	check.Err = err
+	if saveErr := check.save(ctx, saver); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
+
+// Finishes or rolls back the interrupted step. Returns the name of the action.
+func (c *RecoverProjects) recoverState(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+) (string, error) {
+	switch project.State {
+	case models.ProjectDeleting:
+		return "deletion", c.deleter.delete(ctx, neonClient, saver, project, project.DeletionComment)
+	}
+
+	// the process has crashed before the project ID was saved, looking for the project by name
+	if project.ProjectID == "" {
+		neonProject, err := findProjectByName(ctx, neonClient, saver, project.Name)
+		if err != nil {
+			return "find", err
+		}
+		if neonProject == nil {
+			project.DeletionComment = "recover_projects: not found in Neon"
+			return "discard", c.projectRepo.Discard(project)
+		}
+		project.ProjectID = neonProject.ID
+		project.State = models.ProjectConfiguring
+		if err := c.projectRepo.Save(project); err != nil {
+			return "find", fmt.Errorf("failed to save project ID: %w", err)
+		}
+	}
+
+	if c.args.Creating == RecoverRollback {
+		return "rollback", c.deleter.delete(ctx, neonClient, saver, project, "recover_projects: rollback of an interrupted creation")
+	}
+	return "resume", c.resumeCreation(ctx, neonClient, saver, project)
+}
+
+// Loads the project details from Neon, applies the requested settings the same way as create_project,
+// marks the project as ready and creates the requested read replicas.
+func (c *RecoverProjects) resumeCreation(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+) error {
+	endpoint, err := loadProjectDetails(ctx, neonClient, saver, project)
+	if err != nil {
+		return err
+	}
+	if err := c.projectRepo.Save(project); err != nil {
+		return fmt.Errorf("failed to save project details: %w", err)
+	}
+
+	if err := c.configurator.applySettings(ctx, neonClient, saver, project, endpoint, nil); err != nil {
+		return err
+	}
+	return c.configurator.finish(ctx, neonClient, saver, project)
+}
+
+// Number of projects requested per page, the max allowed by the API.
+const findProjectPageSize = 400
+
+// Returns the project of this exitnode with the exact name, or nil if it doesn't exist.
+func findProjectByName(ctx context.Context, neonClient *neonapi.Client, saver *repos.QuerySaver, name string) (*neonapi.Project, error) {
+	// search also matches substrings, e.g. "test@node-1" matches "test@node-10", all pages are checked
+	var cursor string
+	for {
+		prep, err := neonClient.ListProjects(cursor, findProjectPageSize, name)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := queryAPI(ctx, prep, saver)
+		if err != nil {
+			return nil, err
+		}
+		for i := range resp.Projects {
+			if resp.Projects[i].Name == name {
+				return &resp.Projects[i], nil
+			}
+		}
+
+		if len(resp.Projects) < findProjectPageSize || resp.Pagination.Cursor == "" || resp.Pagination.Cursor == cursor {
+			return nil, nil
+		}
+		cursor = resp.Pagination.Cursor
+	}
+}
+
+// Fills the connection string, the default branch and endpoint of the project from Neon.
+// Returns the read-write endpoint of the default branch, if any.
+func loadProjectDetails(
+	ctx context.Context,
+	neonClient *neonapi.Client,
+	saver *repos.QuerySaver,
+	project *models.Project,
+) (*neonapi.Endpoint, error) {
+	connPrep, err := neonClient.GetConnectionURI(project.ProjectID, projectDatabaseName, projectRoleName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := queryAPI(ctx, connPrep, saver)
+	if err != nil {
+		return nil, err
+	}
+
+	branchesPrep, err := neonClient.ListBranches(project.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := queryAPI(ctx, branchesPrep, saver)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointsPrep, err := neonClient.ListEndpoints(project.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := queryAPI(ctx, endpointsPrep, saver)
+	if err != nil {
+		return nil, err
+	}
+
+	project.ConnectionString = conn.URI
+	for _, branch := range branches.Branches {
+		if branch.Default {
+			project.MainBranchID = branch.ID
+		}
+	}
+	var res *neonapi.Endpoint
+	for i, endpoint := range endpoints.Endpoints {
+		if endpoint.BranchID == project.MainBranchID && endpoint.Type == "read_write" {
+			project.EndpointID = endpoint.ID
+			res = &endpoints.Endpoints[i]
+		}
+	}
+	return res, nil
+}
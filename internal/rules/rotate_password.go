@@ -0,0 +1,408 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/drivers"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to reset the password of the project role in random projects, the role used by all other
+// rules. The new credentials are saved to the project, its branches and read replicas, and every
+// driver must reject the old connection string and accept the new one within PropagationTimeout.
+// The time until the new credentials are propagated is saved as a check for every driver.
+type RotatePassword struct {
+	args           RotatePasswordArgs
+	projectFilters []repos.Filter
+	projectRepo    *repos.ProjectRepo
+	branchRepo     *repos.BranchRepo
+	replicaRepo    *repos.ReplicaRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
+	register       *bgjobs.Register
+	exitnode       string
+	projectLocker  *bgjobs.ProjectLocker
+	driverRegistry *drivers.Registry
+}
+
+type RotatePasswordArgs struct {
+	MaxRandomProjects uint
+	RawProjectFilter  string
+	// All drivers are checked after every rotation. Default is the same as in query_project.
+	Drivers []drivers.Name
+	// Connect through the pooler instead of connecting directly.
+	UsePooler bool
+	// Max time for the old password to be rejected and the new one to be accepted. Default is 1 minute.
+	PropagationTimeout rdesc.Duration
+	// Interval between connection attempts. Default is 1 second.
+	PollInterval rdesc.Duration
+}
+
+var defaultRotatePasswordArgs = RotatePasswordArgs{
+	PropagationTimeout: rdesc.Duration{Duration: time.Minute},
+	PollInterval:       rdesc.Duration{Duration: time.Second},
+}
+
+// Saved as ConnVariant of the queries with the old password, these queries are expected to fail.
+const oldPasswordVariant = "old_password"
+
+// SQLSTATE of the rejected password, invalid_password.
+const invalidPasswordCode = "28P01"
+
+func NewRotatePassword(a *app.App, j json.RawMessage) (*RotatePassword, error) {
+	args := defaultRotatePasswordArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.MaxRandomProjects < 1 {
+		args.MaxRandomProjects = 1
+	}
+	if args.Drivers == nil {
+		for _, item := range defaultDrivers {
+			args.Drivers = append(args.Drivers, item.Item)
+		}
+	}
+	if len(args.Drivers) == 0 {
+		return nil, fmt.Errorf("at least one driver is required")
+	}
+	for _, name := range args.Drivers {
+		if _, ok := a.Drivers.Get(name); !ok {
+			return nil, fmt.Errorf("unknown driver: %s", name)
+		}
+	}
+	if args.PropagationTimeout.Duration <= 0 || args.PollInterval.Duration <= 0 {
+		return nil, fmt.Errorf("PropagationTimeout and PollInterval must be positive")
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &RotatePassword{
+		args:           args,
+		projectFilters: projectFilters,
+		projectRepo:    a.Repo.Project,
+		branchRepo:     a.Repo.Branch,
+		replicaRepo:    a.Repo.Replica,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
+		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
+		projectLocker:  a.ProjectLocker,
+		driverRegistry: a.Drivers,
+	}, nil
+}
+
+func (c *RotatePassword) Execute(ctx context.Context) error {
+	projects, err := c.projectRepo.FindRandomProjects(c.projectFilters, int(c.args.MaxRandomProjects))
+	if err != nil {
+		return fmt.Errorf("failed to find random projects: %w", err)
+	}
+
+	for _, project := range projects {
+		project := project
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID))
+		c.register.Go(ctx, func() {
+			if err := c.executeForProject(ctx, &project); err != nil {
+				log.Error(ctx, "failed to rotate password", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+func (c *RotatePassword) executeForProject(ctx context.Context, project *models.Project) error {
+	// exclusive lock, other rules can't use the old password until the new one is saved
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	oldConnstr := project.ConnectionString
+	roleName, err := connstrRole(oldConnstr)
+	if err != nil {
+		return err
+	}
+	ctx = log.With(ctx, zap.String("role", roleName))
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	branchID, err := c.mainBranchID(ctx, neonClient, saver, project)
+	if err != nil {
+		return err
+	}
+
+	poolerConnstr := func(connstr string) (string, error) {
+		if !c.args.UsePooler {
+			return connstr, nil
+		}
+		return appendPoolerSuffix(connstr)
+	}
+	oldDriverConnstr, err := poolerConnstr(oldConnstr)
+	if err != nil {
+		return err
+	}
+
+	// otherwise the old password could be rejected only because it was never accepted
+	check := c.waitConnstr(ctx, saver, c.args.Drivers[0], oldDriverConnstr, true, time.Now())
+	if check.Err != nil {
+		return fmt.Errorf("role password before the rotation: %w", check.Err)
+	}
+
+	prep, err := neonClient.ResetRolePassword(project.ProjectID, branchID, roleName)
+	if err != nil {
+		return err
+	}
+	log.Info(ctx, "resetting role password")
+	resp, err := queryAPIWhenUnlocked(ctx, neonClient, prep, saver, project.ProjectID)
+	if err != nil {
+		return err
+	}
+	if resp.Role.Password == "" {
+		return fmt.Errorf("no password in the response")
+	}
+
+	newConnstr, err := replacePassword(oldConnstr, resp.Role.Password)
+	if err != nil {
+		return err
+	}
+	// the old password can stop working at any moment, saving the new one before waiting
+	if err := c.saveConnstr(ctx, project, roleName, newConnstr, resp.Role.Password); err != nil {
+		return err
+	}
+
+	if err := waitOperations(ctx, neonClient, saver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+	rotatedAt := time.Now()
+
+	newDriverConnstr, err := poolerConnstr(newConnstr)
+	if err != nil {
+		return err
+	}
+
+	oldVariant := oldPasswordVariant
+	oldSaver := saver.With(repos.QuerySaverArgs{ConnVariant: &oldVariant})
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, driverName := range c.args.Drivers {
+		driverName := driverName
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			check := c.waitConnstr(ctx, saver, driverName, newDriverConnstr, true, rotatedAt)
+			mu.Lock()
+			errs = append(errs, check.Err, check.save(ctx, saver))
+			mu.Unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			check := c.waitConnstr(ctx, oldSaver, driverName, oldDriverConnstr, false, rotatedAt)
+			mu.Lock()
+			errs = append(errs, check.Err, check.save(ctx, saver))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Saves the new credentials to the project, and to its branches and read replicas that use the same role.
+// Called under the exclusive project lock, so other rules see only the new credentials.
+func (c *RotatePassword) saveConnstr(ctx context.Context, project *models.Project, roleName string, connstr string, password string) error {
+	if err := c.projectRepo.UpdateConnectionString(project, connstr); err != nil {
+		return fmt.Errorf("failed to save new connstr: %w", err)
+	}
+	project.ConnectionString = connstr
+
+	// returns the connstr with the new password, or false if it's for another role
+	rotated := func(connstr string) (string, bool) {
+		if role, err := connstrRole(connstr); err != nil || role != roleName {
+			return "", false
+		}
+		res, err := replacePassword(connstr, password)
+		return res, err == nil
+	}
+
+	branches, err := c.branchRepo.FindByProject(project.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find branches: %w", err)
+	}
+	for i := range branches {
+		branch := &branches[i]
+		if branchConnstr, ok := rotated(branch.ConnectionString); ok {
+			if err := c.branchRepo.UpdateConnectionString(branch, branchConnstr); err != nil {
+				return fmt.Errorf("failed to save branch connstr: %w", err)
+			}
+		} else {
+			log.Warn(ctx, "branch connstr is not updated", zap.Uint("branchID", branch.ID))
+		}
+	}
+
+	replicas, err := c.replicaRepo.FindByProject(project.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find replicas: %w", err)
+	}
+	for i := range replicas {
+		replica := &replicas[i]
+		if replicaConnstr, ok := rotated(replica.ConnectionString); ok {
+			if err := c.replicaRepo.UpdateConnectionString(replica, replicaConnstr); err != nil {
+				return fmt.Errorf("failed to save replica connstr: %w", err)
+			}
+		} else {
+			log.Warn(ctx, "replica connstr is not updated", zap.Uint("replicaID", replica.ID))
+		}
+	}
+	return nil
+}
+
+// Returns the default branch ID, fetching it from the API for old projects.
+func (c *RotatePassword) mainBranchID(ctx context.Context, neonClient *neonapi.Client, saver *repos.QuerySaver, project *models.Project) (string, error) {
+	if project.MainBranchID != "" {
+		return project.MainBranchID, nil
+	}
+
+	prep, err := neonClient.ListBranches(project.ProjectID)
+	if err != nil {
+		return "", err
+	}
+	resp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return "", err
+	}
+	for _, branch := range resp.Branches {
+		if branch.Default || branch.Primary {
+			return branch.ID, nil
+		}
+	}
+	return "", fmt.Errorf("project has no default branch")
+}
+
+// Connects with the driver until the connection is accepted (or rejected with an authentication
+// error, if accepted is false) or the timeout is reached. Every attempt uses a new connection.
+func (c *RotatePassword) waitConnstr(
+	ctx context.Context,
+	saver drivers.QuerySaver,
+	driverName drivers.Name,
+	connstr string,
+	accepted bool,
+	rotatedAt time.Time,
+) *checkQuery {
+	check := &checkQuery{
+		Method:    "password_rotation_new",
+		Addr:      string(driverName),
+		StartedAt: rotatedAt,
+	}
+	if !accepted {
+		check.Method = "password_rotation_old"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.args.PropagationTimeout.Duration)
+	defer cancel()
+
+	var lastErr error
+	for polls := 1; ; polls++ {
+		lastErr = c.tryConnect(ctx, saver, driverName, connstr)
+		done := lastErr == nil
+		if !accepted {
+			// network errors and timeouts don't mean the password is rejected
+			done = isAuthError(lastErr)
+		}
+		if done && ctx.Err() == nil {
+			check.Response = pollsResponse(polls, lastErr)
+			return check
+		}
+
+		select {
+		case <-ctx.Done():
+			check.Response = pollsResponse(polls, lastErr)
+			if accepted {
+				check.Err = fmt.Errorf("new password is not accepted: %w", errors.Join(ctx.Err(), lastErr))
+			} else {
+				check.Err = fmt.Errorf("old password is not rejected: %w", errors.Join(ctx.Err(), lastErr))
+			}
+			return check
+		case <-time.After(c.args.PollInterval.Duration):
+		}
+	}
+}
+
+// Returns true if the server rejected the credentials, SQLSTATE 28P01 (invalid_password).
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == invalidPasswordCode
+	}
+	// drivers that don't return pgconn errors, e.g. sql-over-http
+	msg := err.Error()
+	return strings.Contains(msg, invalidPasswordCode) || strings.Contains(msg, "password authentication failed")
+}
+
+// Returns nil if the connection is accepted and a simple query is executed.
+func (c *RotatePassword) tryConnect(ctx context.Context, saver drivers.QuerySaver, driverName drivers.Name, connstr string) error {
+	driver, err := c.driverRegistry.New(ctx, driverName, drivers.Params{
+		Connstr: connstr,
+		Saver:   saver,
+	})
+	if err != nil {
+		return err
+	}
+	if cc, ok := driver.(drivers.CloseableDriver); ok {
+		defer cc.Close(ctx)
+	}
+
+	_, err = driver.Query(ctx, drivers.SingleQuery{Query: av1Select1})
+	return err
+}
+
+func pollsResponse(polls int, lastErr error) string {
+	res := struct {
+		Polls     int    `json:"polls"`
+		LastError string `json:"last_error,omitempty"`
+	}{Polls: polls}
+	if lastErr != nil {
+		res.LastError = lastErr.Error()
+	}
+	j, _ := json.Marshal(res)
+	return string(j)
+}
@@ -0,0 +1,158 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/petuhovskiy/neon-lights/internal/app"
+	"github.com/petuhovskiy/neon-lights/internal/bgjobs"
+	"github.com/petuhovskiy/neon-lights/internal/log"
+	"github.com/petuhovskiy/neon-lights/internal/models"
+	"github.com/petuhovskiy/neon-lights/internal/neonapi"
+	"github.com/petuhovskiy/neon-lights/internal/rdesc"
+	"github.com/petuhovskiy/neon-lights/internal/repos"
+)
+
+// Rule to change autoscaling limits of the default endpoint in random projects.
+type UpdateAutoscaling struct {
+	args           UpdateAutoscalingArgs
+	projectFilters []repos.Filter
+	projectRepo    *repos.ProjectRepo
+	queryRepo      *repos.QueryRepo
+	neonAccounts   *app.NeonAccounts
+	register       *bgjobs.Register
+	exitnode       string
+	projectLocker  *bgjobs.ProjectLocker
+}
+
+type UpdateAutoscalingArgs struct {
+	// New limits, projects that already have the picked limits are skipped.
+	Autoscaling       rdesc.Wrand[AutoscalingLimits]
+	MaxRandomProjects uint
+	RawProjectFilter  string
+}
+
+func NewUpdateAutoscaling(a *app.App, j json.RawMessage) (*UpdateAutoscaling, error) {
+	var args UpdateAutoscalingArgs
+	err := json.Unmarshal(j, &args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal args: %w", err)
+	}
+
+	if args.Autoscaling == nil {
+		return nil, fmt.Errorf("Autoscaling field must be set")
+	}
+	for _, limits := range args.Autoscaling {
+		if err := limits.Item.validate(); err != nil {
+			return nil, err
+		}
+		if limits.Item.isDefault() {
+			return nil, fmt.Errorf("autoscaling limits must be set explicitly")
+		}
+	}
+	if args.MaxRandomProjects < 1 {
+		args.MaxRandomProjects = 1
+	}
+
+	var projectFilters []repos.Filter
+	projectFilters = append(projectFilters, a.RegionFilters...)
+	if args.RawProjectFilter != "" {
+		projectFilters = append(projectFilters, repos.RawFilter(args.RawProjectFilter))
+	}
+
+	return &UpdateAutoscaling{
+		args:           args,
+		projectFilters: projectFilters,
+		projectRepo:    a.Repo.Project,
+		queryRepo:      a.Repo.Query,
+		neonAccounts:   a.NeonAccounts,
+		register:       a.Register,
+		exitnode:       a.Config.Exitnode,
+		projectLocker:  a.ProjectLocker,
+	}, nil
+}
+
+func (c *UpdateAutoscaling) Execute(ctx context.Context) error {
+	projects, err := c.projectRepo.FindRandomProjects(c.projectFilters, int(c.args.MaxRandomProjects))
+	if err != nil {
+		return fmt.Errorf("failed to find random projects: %w", err)
+	}
+
+	for _, project := range projects {
+		project := project
+		limits := c.args.Autoscaling.Pick()
+		ctx := log.With(ctx, zap.Uint("projectID", project.ID), zap.Any("limits", limits))
+		c.register.Go(ctx, func() {
+			if err := c.executeForProject(ctx, &project, limits); err != nil {
+				log.Error(ctx, "failed to update autoscaling limits", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+func (c *UpdateAutoscaling) executeForProject(ctx context.Context, project *models.Project, limits AutoscalingLimits) error {
+	if project.AutoscalingMinCu == limits.MinCu && project.AutoscalingMaxCu == limits.MaxCu {
+		return nil
+	}
+
+	// exclusive lock, compute can be restarted during the update
+	projectLock := c.projectLocker.Get(project.ID)
+	unlock := projectLock.TryExclusiveLock()
+	if unlock == nil {
+		return nil
+	}
+	defer unlock()
+
+	if projectLock.Deleted.Load() {
+		return nil
+	}
+
+	neonClient, err := c.neonAccounts.Client(project.NeonAccount)
+	if err != nil {
+		return err
+	}
+
+	endpointID, err := projectEndpointID(project)
+	if err != nil {
+		return err
+	}
+
+	prep, err := neonClient.UpdateEndpoint(project.ProjectID, endpointID, &neonapi.UpdateEndpoint{
+		AutoscalingLimitMinCu: &limits.MinCu,
+		AutoscalingLimitMaxCu: &limits.MaxCu,
+	})
+	if err != nil {
+		return err
+	}
+
+	saver := repos.NewQuerySaver(c.queryRepo, repos.QuerySaverArgs{
+		ProjectID:   &project.ID,
+		RegionID:    &project.RegionID,
+		Exitnode:    &c.exitnode,
+		ProjectMode: &project.CurrentMode,
+	})
+
+	log.Info(
+		ctx,
+		"updating autoscaling limits",
+		zap.Float64("oldMinCu", project.AutoscalingMinCu),
+		zap.Float64("oldMaxCu", project.AutoscalingMaxCu),
+	)
+	resp, err := queryAPI(ctx, prep, saver)
+	if err != nil {
+		return err
+	}
+	if err := waitOperations(ctx, neonClient, saver, project.ProjectID, resp.Operations); err != nil {
+		return err
+	}
+
+	if resp.Endpoint != nil {
+		limits.MinCu = resp.Endpoint.AutoscalingLimitMinCu
+		limits.MaxCu = resp.Endpoint.AutoscalingLimitMaxCu
+	}
+	return c.projectRepo.UpdateAutoscaling(project, limits.MinCu, limits.MaxCu)
+}
@@ -4,6 +4,7 @@ CREATE INDEX queries_region_id_created_at_idx ON queries (region_id, created_at)
 CREATE INDEX queries_is_finished_is_failed_driver_exitnode_created_at_idx ON queries (is_finished, is_failed, driver, exitnode, created_at);
 CREATE INDEX queries_project_id_created_at_idx ON queries (project_id, created_at);
 CREATE INDEX queries_project_id_query_id_idx ON queries (project_id, id);
+CREATE INDEX queries_meta_remote_addr_created_at_idx ON queries ((meta->>'remote_addr'), created_at);
 
 INSERT INTO regions(id, created_at, updated_at, "provider", database_region, supports_neon_vm) VALUES (1, now(), now(), 'neon.tech', 'aws-us-east-1', 't');
 INSERT INTO regions(id, created_at, updated_at, "provider", database_region, supports_neon_vm) VALUES (2, now(), now(), 'neon.tech', 'aws-us-east-2', 't');